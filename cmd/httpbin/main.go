@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/neixir/httpfromtcp/internal/debughandlers"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// One above the main server, so both can run at the same time:
+// HTTPBIN_URL=http://localhost:42070 go run ./cmd/httpserver
+const port = 42070
+
+func main() {
+	server, err := server.Serve(port, debughandlers.Handler)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	defer server.Close()
+	log.Println("httpbin started on port", port)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	log.Println("httpbin gracefully stopped")
+}
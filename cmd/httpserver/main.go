@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
 
+	"github.com/neixir/httpfromtcp/internal/client"
+	"github.com/neixir/httpfromtcp/internal/compress"
+	"github.com/neixir/httpfromtcp/internal/fileserver"
 	"github.com/neixir/httpfromtcp/internal/headers"
 	"github.com/neixir/httpfromtcp/internal/request"
 	"github.com/neixir/httpfromtcp/internal/response"
@@ -20,6 +22,10 @@ import (
 
 const port = 42069
 
+// Where Chapter8 proxies /httpbin/x to. Set HTTPBIN_URL to use a local
+// debughandlers server (go run ./cmd/httpbin) instead of the real one.
+var httpbinBaseUrl = "https://httpbin.org"
+
 func Chapter7(w *response.Writer, req *request.Request) {
 	target := req.RequestLine.RequestTarget
 
@@ -36,7 +42,7 @@ func Chapter7(w *response.Writer, req *request.Request) {
 	}
 }
 
-// Add a new proxy handler to your server that maps /httpbin/x to https://httpbin.org/x,
+// Add a new proxy handler to your server that maps /httpbin/x to https://httpbin.org/x (or httpbinBaseUrl),
 // supporting both proxying and chunked responsing.
 func Chapter8(w *response.Writer, req *request.Request) {
 	target := req.RequestLine.RequestTarget
@@ -47,31 +53,45 @@ func Chapter8(w *response.Writer, req *request.Request) {
 	}
 
 	path := strings.TrimPrefix(target, "/httpbin")
-	httpbinUrl := fmt.Sprint("https://httpbin.org", path)
+	httpbinUrl := fmt.Sprint(httpbinBaseUrl, path)
 
 	// I used http.Get to make the request to httpbin.org and httpbinResponse.Body.Read to read the response body.
+	// Now it's our own client, so the whole proxy runs on this project's code.
 	// I used a buffer size of 1024 bytes, and then printed n on every call to Read so that I could see
 	// how much data was being read.
 	// Use n as your chunk size and write that chunk data back to the client as soon as you get it from httpbin.org.
-	httpbinResponse, err := http.Get(httpbinUrl)
+	// The upstream request shares the context of ours, so if the client hangs up
+	// (or the server shuts down) we stop pulling from httpbin.org too.
+	upstreamRequest, err := client.NewRequest(req.Context(), "GET", httpbinUrl, nil)
+	if err != nil {
+		log.Printf("error creating httpbin request: %v", err)
+		return
+	}
+
+	httpbinResponse, err := client.DefaultClient.Do(upstreamRequest)
 	if err != nil {
-		log.Fatalf("error getting httpbin: %v", err)
+		log.Printf("error getting httpbin: %v", err)
+		return
 	}
 
 	defer httpbinResponse.Body.Close()
 
 	// Status Line
-	err = w.WriteStatusLine(response.StatusCode(httpbinResponse.StatusCode)) // response.StatusOk)
+	err = w.WriteStatusLine(httpbinResponse.StatusLine.StatusCode) // response.StatusOk)
 	if err != nil {
 		log.Fatalf("error writing status line: %v", err)
 	}
 
 	// Be sure to remove the Content-Length header from the response,
+	// and the framing and connection headers of the upstream, which were for
+	// that connection and not ours
 	resHeaders := make(headers.Headers)
-	for key, values := range httpbinResponse.Header {
-		if strings.ToLower(key) != "content-length" {
-			resHeaders[key] = strings.Join(values, ", ") // pq values es un array de strings
+	for key, value := range httpbinResponse.Headers {
+		switch strings.ToLower(key) {
+		case "content-length", "transfer-encoding", "trailer", "connection", "keep-alive":
+			continue
 		}
+		resHeaders[key] = value
 	}
 
 	// and add the Transfer-Encoding: chunked header
@@ -92,6 +112,20 @@ func Chapter8(w *response.Writer, req *request.Request) {
 	for {
 		n, err := httpbinResponse.Body.Read(buf)
 
+		// Read can return data together with io.EOF, so send what we got first
+		if n > 0 {
+			// Keep track of the full response body as you read it in chunks from the httpbin server
+			fullbody = append(fullbody, buf[:n]...)
+			// fullbodyLength += n
+
+			// fmt.Printf("Chunk of %d bytes\n", n)
+			_, werr := w.WriteChunkedBody(buf[:n]) // :n pq el buffer tindra coses velles i potser no l'omplim
+			if werr != nil {
+				log.Printf("error writing chunk: %v", werr)
+				return
+			}
+		}
+
 		if err == io.EOF {
 			hash := sha256.Sum256([]byte(fullbody))
 			trailers := headers.Headers{ //map[string]string{
@@ -104,52 +138,29 @@ func Chapter8(w *response.Writer, req *request.Request) {
 		}
 
 		if err != nil {
-			log.Fatalf("error reading chunk: %v", err)
-		}
-
-		if n > 0 {
-			// Keep track of the full response body as you read it in chunks from the httpbin server
-			fullbody = append(fullbody, buf[:n]...)
-			// fullbodyLength += n
-
-			// fmt.Printf("Chunk of %d bytes\n", n)
-			w.WriteChunkedBody(buf[:n]) // :n pq el buffer tindra coses velles i potser no l'omplim
+			// Cancelled context (client gone) ends up here too
+			log.Printf("error reading chunk: %v", err)
+			return
 		}
 	}
 
 }
 
+// The assets directory, compressed for clients that accept it
+var assets = compress.Middleware(server.StripPrefix("/assets", fileserver.FileServer("assets")))
+
+// Serves the video at /video, and everything in the assets directory under /assets/.
+// A missing file is a 404 now instead of taking the whole server down.
 func Chapter9(w *response.Writer, req *request.Request) {
 	target := req.RequestLine.RequestTarget
 
-	if target != "/video" {
-		return
-	}
-
-	// Llegim el fitxer
-	data, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		log.Fatalf("error reading file: %v", err)
-	}
-
-	// Status Line
-	err = w.WriteStatusLine(response.StatusOk)
-	if err != nil {
-		log.Fatalf("error writing status line: %v", err)
-	}
-
-	// Be sure to remove the Content-Length header from the response,
-	resHeaders := response.GetDefaultHeaders(len(data))
-
-	headers.OverwriteHeader(resHeaders, "Content-Type", "video/mp4")
+	switch {
+	case target == "/video":
+		fileserver.ServeFile(w, req, "assets/vim.mp4")
 
-	err = w.WriteHeaders(resHeaders)
-	if err != nil {
-		log.Fatalf("error writing headers: %v", err)
+	case strings.HasPrefix(target, "/assets/"):
+		assets(w, req)
 	}
-
-	w.WriteBody([]byte(data))
-
 }
 
 func sendHTMLResponse(w *response.Writer, status response.StatusCode, title, h1, msg string) {
@@ -174,6 +185,10 @@ func sendHTMLResponse(w *response.Writer, status response.StatusCode, title, h1,
 }
 
 func main() {
+	if u := os.Getenv("HTTPBIN_URL"); u != "" {
+		httpbinBaseUrl = u
+	}
+
 	server, err := server.Serve(port, Chapter9)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/debughandlers"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChapter7(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		status response.StatusCode
+		title  string
+	}{
+		{"/", response.StatusOk, "200 OK"},
+		{"/yourproblem", response.StatusBadRequest, "400 Bad Request"},
+		{"/myproblem", response.StatusInternalServerError, "500 Internal Server Error"},
+	} {
+		res := servertest.Record(Chapter7, servertest.NewRequest("GET", tc.target, nil)).Result(t)
+		assert.Equal(t, tc.status, res.StatusLine.StatusCode, tc.target)
+		assert.Equal(t, "text/html", res.Headers.Get("Content-Type"), tc.target)
+		assert.Contains(t, string(res.Body), "<title>"+tc.title+"</title>", tc.target)
+	}
+}
+
+func TestChapter8Proxy(t *testing.T) {
+	// The local httpbin replaces https://httpbin.org as the upstream
+	upstream := servertest.NewServer(debughandlers.Handler)
+	defer upstream.Close()
+
+	oldBase := httpbinBaseUrl
+	httpbinBaseUrl = upstream.URL
+	defer func() { httpbinBaseUrl = oldBase }()
+
+	proxy := servertest.NewServer(Chapter8)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /httpbin/stream/5 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(body)), "\n"), 5)
+
+	// The trailers describe the whole body
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(body)), res.Trailer.Get("X-Content-SHA256"))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Trailer.Get("X-Content-Length"))
+}
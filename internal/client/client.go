@@ -0,0 +1,452 @@
+// Package client is an HTTP/1.1 client built on this project's own code: requests
+// are written straight to a TCP (or TLS) connection and the responses are read
+// with response.ResponseReader, so nothing goes through net/http.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/cookie"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+const (
+	DefaultDialTimeout    = 30 * time.Second
+	DefaultIdleTimeout    = 90 * time.Second
+	DefaultMaxIdlePerHost = 2
+	DefaultMaxRedirects   = 10
+
+	userAgent = "httpfromtcp"
+)
+
+var ErrTooManyRedirects = errors.New("client: too many redirects")
+
+// Used by Get, like http.DefaultClient
+var DefaultClient = &Client{}
+
+// A Client sends requests and keeps their connections around for the next ones.
+// The zero value is ready to use, and a Client is safe for concurrent use.
+type Client struct {
+	// For the whole exchange, from dialing to the end of the body. None if 0.
+	Timeout time.Duration
+
+	// To connect, DefaultDialTimeout if 0
+	DialTimeout time.Duration
+
+	// How long an unused connection is kept, DefaultIdleTimeout if 0
+	IdleTimeout time.Duration
+
+	// Unused connections kept for each host, DefaultMaxIdlePerHost if 0, none if negative
+	MaxIdlePerHost int
+
+	// Redirects followed before giving up, DefaultMaxRedirects if 0.
+	// If negative, redirects aren't followed and Do returns them as they are.
+	MaxRedirects int
+
+	// If set, cookies are sent from the jar and the ones the server sets are saved in it
+	Jar *Jar
+
+	// For https, nil means the defaults
+	TLSConfig *tls.Config
+
+	pool pool
+}
+
+// A Response is what Do returns. Its Body has to be closed, and read to the end
+// if the connection is going to be reused.
+type Response struct {
+	StatusLine response.StatusLine
+	Headers    headers.Headers
+	Body       io.ReadCloser
+
+	// The trailer fields of a chunked body, once it's been read to the end
+	Trailers headers.Headers
+
+	// The request this answers, the last one if there were redirects
+	Request *request.Request
+}
+
+// NewRequest returns a request for rawURL, which must be an absolute http or https
+// URL. The URL goes in the RequestTarget as it is (absolute form), and Do sends
+// just its path.
+func NewRequest(ctx context.Context, method, rawURL string, body []byte) (*request.Request, error) {
+	if method == "" {
+		method = "GET"
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return nil, fmt.Errorf("client: invalid method %q", method)
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("client: no host in %q", rawURL)
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: u.String(),
+			Method:        method,
+		},
+		Headers: headers.Headers{"host": u.Host},
+		Body:    body,
+	}
+	return req.WithContext(ctx), nil
+}
+
+// Get fetches url with the DefaultClient.
+func Get(ctx context.Context, url string) (*Response, error) {
+	req, err := NewRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultClient.Do(req)
+}
+
+// Do sends req and returns the response once its headers are in, following
+// redirects as MaxRedirects says. The request's context, and Timeout, cover
+// reading the body too.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	ctx := req.Context()
+	cancel := context.CancelFunc(func() {})
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+
+	maxRedirects := c.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+
+	for redirects := 0; ; redirects++ {
+		u, err := requestURL(req)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		res, err := c.send(ctx, c.withCookies(req, u), u)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		res.Request = req
+
+		if c.Jar != nil {
+			c.Jar.SetCookies(u, setCookies(res.Headers))
+		}
+
+		location := res.Headers.Get("Location")
+		if !isRedirect(res.StatusLine.StatusCode) || location == "" || maxRedirects < 0 {
+			// The timeout lasts until the body is closed
+			res.Body.(*body).cancel = cancel
+			return res, nil
+		}
+
+		// Read a bit of what's left, so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+		res.Body.Close()
+
+		if redirects >= maxRedirects {
+			cancel()
+			return nil, ErrTooManyRedirects
+		}
+
+		req, err = redirectRequest(req, u, res.StatusLine.StatusCode, location)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+}
+
+// CloseIdleConnections closes the connections kept for reuse.
+func (c *Client) CloseIdleConnections() {
+	c.pool.closeAll()
+}
+
+// Sends one request and reads the headers of its response.
+func (c *Client) send(ctx context.Context, req *request.Request, u *url.URL) (*Response, error) {
+	key := u.Scheme + "://" + hostPort(u)
+
+	// A connection from the pool may have been closed by the server in the
+	// meantime, and then we try again with a new one. Only for requests that can
+	// safely be sent twice.
+	pc := c.pool.get(key, c.idleTimeout())
+	reused := pc != nil
+
+	for {
+		if pc == nil {
+			var err error
+			pc, err = c.dial(ctx, u, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Cancelling the context makes whatever we're doing on the connection fail right away
+		stop := context.AfterFunc(ctx, func() {
+			pc.conn.SetDeadline(time.Unix(1, 0))
+		})
+
+		rr := response.NewResponseReader(pc.conn)
+		rr.Method = req.RequestLine.Method
+		err := writeRequest(pc.conn, req, u)
+		var res *response.Response
+		if err == nil {
+			res, err = rr.ReadHeader()
+		}
+
+		if err != nil {
+			stop()
+			pc.conn.Close()
+
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if reused && idempotent(req.RequestLine.Method) && staleConn(err) {
+				pc = nil
+				reused = false
+				continue
+			}
+			return nil, err
+		}
+
+		return &Response{
+			StatusLine: res.StatusLine,
+			Headers:    res.Headers,
+			Trailers:   res.Trailers,
+			Body: &body{
+				c:         c,
+				pc:        pc,
+				rr:        rr,
+				ctx:       ctx,
+				stop:      stop,
+				keepAlive: keepAlive(req, res),
+			},
+		}, nil
+	}
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL, key string) (*persistConn, error) {
+	timeout := c.DialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "https" {
+		cfg := &tls.Config{}
+		if c.TLSConfig != nil {
+			cfg = c.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return &persistConn{conn: conn, key: key}, nil
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c *Client) maxIdle() int {
+	if c.MaxIdlePerHost == 0 {
+		return DefaultMaxIdlePerHost
+	}
+	return c.MaxIdlePerHost
+}
+
+// A copy of req with the jar's cookies added to the ones it already had
+func (c *Client) withCookies(req *request.Request, u *url.URL) *request.Request {
+	if c.Jar == nil {
+		return req
+	}
+	cookies := c.Jar.Cookies(u)
+	if len(cookies) == 0 {
+		return req
+	}
+
+	r2 := *req
+	r2.Headers = maps.Clone(req.Headers)
+	for _, ck := range cookies {
+		r2.Headers.Add("cookie", ck.Name+"="+ck.Value)
+	}
+	return &r2
+}
+
+// The URL of a request from NewRequest, or of a server request being sent on,
+// which only has a path and the Host header
+func requestURL(req *request.Request) (*url.URL, error) {
+	target := req.RequestLine.RequestTarget
+	if strings.HasPrefix(target, "/") {
+		target = "http://" + req.Headers.Get("Host") + target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("client: no host for %q", req.RequestLine.RequestTarget)
+	}
+	return u, nil
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Writes the request with its target in origin form, just the path and the
+// query, and the headers every request needs.
+func writeRequest(w io.Writer, req *request.Request, u *url.URL) error {
+	r2 := *req
+	r2.RequestLine.RequestTarget = u.RequestURI()
+	r2.RequestLine.HttpVersion = "1.1"
+	r2.Headers = maps.Clone(req.Headers)
+	if r2.Headers == nil {
+		r2.Headers = headers.Headers{}
+	}
+
+	if r2.Headers.Get("Host") == "" {
+		r2.Headers.Set("Host", u.Host)
+	}
+	if r2.Headers.Get("User-Agent") == "" {
+		r2.Headers.Set("User-Agent", userAgent)
+	}
+
+	// Methods that usually have a body say so even when it's empty
+	switch r2.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+		if len(r2.Body) == 0 && r2.Headers.Get("Transfer-Encoding") == "" {
+			r2.Headers.Set("Content-Length", "0")
+		}
+	}
+
+	_, err := r2.WriteTo(w)
+	return err
+}
+
+// Whether the connection can carry another request after this response
+func keepAlive(req *request.Request, res *response.Response) bool {
+	if req.Headers.HasToken("Connection", "close") || res.Headers.HasToken("Connection", "close") {
+		return false
+	}
+	if res.StatusLine.HttpVersion == "1.0" && !res.Headers.HasToken("Connection", "keep-alive") {
+		return false
+	}
+	// Without a length or chunks the body ends with the connection
+	return !res.CloseDelimited()
+}
+
+// Errors that mean the server closed a kept connection before we used it
+func staleConn(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func isRedirect(code response.StatusCode) bool {
+	switch code {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// The request to send next for a redirect. 307 and 308 repeat the request as it
+// was, the others turn it into a GET without a body, as browsers do.
+func redirectRequest(req *request.Request, u *url.URL, code response.StatusCode, location string) (*request.Request, error) {
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("client: bad redirect location %q: %w", location, err)
+	}
+	next := u.ResolveReference(loc)
+	if next.Scheme != "http" && next.Scheme != "https" {
+		return nil, fmt.Errorf("client: redirect to unsupported scheme %q", next.Scheme)
+	}
+
+	r2 := *req
+	r2.RequestLine.RequestTarget = next.String()
+	r2.Headers = maps.Clone(req.Headers)
+	r2.Headers.Set("host", next.Host)
+
+	method := req.RequestLine.Method
+	if code != response.StatusTemporaryRedirect && code != response.StatusPermanentRedirect && method != "GET" && method != "HEAD" {
+		r2.RequestLine.Method = "GET"
+		r2.Body = nil
+		r2.Headers.Del("Content-Type")
+	}
+
+	// Credentials are for the host they were meant for, and never go out in the clear once they've been encrypted
+	if next.Host != u.Host || (u.Scheme == "https" && next.Scheme == "http") {
+		r2.Headers.Del("Authorization")
+		r2.Headers.Del("Cookie")
+	}
+
+	return &r2, nil
+}
+
+func setCookies(h headers.Headers) []*cookie.Cookie {
+	var cookies []*cookie.Cookie
+	for _, line := range h.Values("Set-Cookie") {
+		c, err := cookie.ParseSetCookie(line)
+		if err == nil {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
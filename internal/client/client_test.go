@@ -0,0 +1,372 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/cookie"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHandler(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+	body := ""
+	h := headers.Headers{}
+
+	switch {
+	case target == "/hello":
+		body = "hello"
+		h.Set("X-Test", "yes")
+
+	case target == "/echo":
+		body = req.RequestLine.Method + " " + req.Headers.Get("User-Agent") + " " + req.Headers.Get("X-Custom") + " " + string(req.Body)
+
+	case target == "/chunked":
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Connection": "close"})
+		for i := range 5 {
+			w.WriteChunkedBody([]byte(strconv.Itoa(i)))
+		}
+		w.WriteChunkedBodyDone(nil)
+		return
+
+	case target == "/trailers":
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Length", "Connection": "close"})
+		w.WriteChunkedBody([]byte("data"))
+		w.WriteChunkedBodyDone(headers.Headers{"X-Length": "4"})
+		return
+
+	case strings.HasPrefix(target, "/redirect/"):
+		n, _ := strconv.Atoi(strings.TrimPrefix(target, "/redirect/"))
+		if n > 0 {
+			sendRedirect(w, response.StatusFound, fmt.Sprintf("/redirect/%d", n-1))
+			return
+		}
+		body = "done"
+
+	case target == "/loop":
+		sendRedirect(w, response.StatusFound, "/loop")
+		return
+
+	case strings.HasPrefix(target, "/status/"):
+		code, _ := strconv.Atoi(strings.TrimPrefix(target, "/status/"))
+		sendRedirect(w, response.StatusCode(code), "/echo")
+		return
+
+	case target == "/set-cookie":
+		cookie.SetCookie(h, &cookie.Cookie{Name: "a", Value: "1", Path: "/"})
+		cookie.SetCookie(h, &cookie.Cookie{Name: "b", Value: "2", Path: "/cookies"})
+		cookie.SetCookie(h, &cookie.Cookie{Name: "c", Value: "3", Path: "/", Secure: true})
+
+	case strings.HasPrefix(target, "/cookies"):
+		body = req.Headers.Get("Cookie")
+
+	case target == "/slow":
+		select {
+		case <-req.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		return
+	}
+
+	defaults := response.GetDefaultHeaders(len(body))
+	for k, v := range h {
+		defaults[k] = v
+	}
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(defaults)
+	w.WriteBody([]byte(body))
+}
+
+func sendRedirect(w *response.Writer, code response.StatusCode, location string) {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", location)
+	w.WriteStatusLine(code)
+	w.WriteHeaders(h)
+}
+
+func do(t *testing.T, c *Client, method, url, body string) (*Response, string) {
+	req, err := NewRequest(t.Context(), method, url, []byte(body))
+	require.NoError(t, err)
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(data)
+}
+
+func TestDo(t *testing.T) {
+	s := servertest.NewServer(testHandler)
+	defer s.Close()
+	base := s.URL
+	c := &Client{}
+
+	// Test: A plain GET
+	res, body := do(t, c, "GET", base+"/hello", "")
+	assert.Equal(t, response.StatusOk, res.StatusLine.StatusCode)
+	assert.Equal(t, "yes", res.Headers.Get("X-Test"))
+	assert.Equal(t, "hello", body)
+
+	// Test: Method, headers and body get there
+	req, err := NewRequest(t.Context(), "POST", base+"/echo", []byte("some data"))
+	require.NoError(t, err)
+	req.Headers.Set("X-Custom", "custom")
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "POST httpfromtcp custom some data", string(data))
+
+	// Test: Chunked responses come dechunked
+	_, body = do(t, c, "GET", base+"/chunked", "")
+	assert.Equal(t, "01234", body)
+
+	// Test: HEAD has no body, even with a Content-Length
+	res, body = do(t, c, "HEAD", base+"/hello", "")
+	assert.Equal(t, "5", res.Headers.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	// Test: Trailers
+	res, body = do(t, c, "GET", base+"/trailers", "")
+	assert.Equal(t, "data", body)
+	assert.Equal(t, "4", res.Trailers.Get("X-Length"))
+
+	// Test: Bad requests
+	_, err = NewRequest(t.Context(), "GET", "ftp://example.com/", nil)
+	assert.Error(t, err)
+	_, err = NewRequest(t.Context(), "get", base, nil)
+	assert.Error(t, err)
+	_, err = NewRequest(t.Context(), "GET", "/relative", nil)
+	assert.Error(t, err)
+}
+
+func TestRedirects(t *testing.T) {
+	s := servertest.NewServer(testHandler)
+	defer s.Close()
+	base := s.URL
+	c := &Client{}
+
+	// Test: Followed, relative locations too
+	res, body := do(t, c, "GET", base+"/redirect/3", "")
+	assert.Equal(t, "done", body)
+	assert.Equal(t, base+"/redirect/0", res.Request.RequestLine.RequestTarget)
+
+	// Test: 303 (and 301, 302) turn a POST into a GET, 307 and 308 don't
+	_, body = do(t, c, "POST", base+"/status/303", "data")
+	assert.Equal(t, "GET httpfromtcp  ", body)
+	_, body = do(t, c, "POST", base+"/status/307", "data")
+	assert.Equal(t, "POST httpfromtcp  data", body)
+	_, body = do(t, c, "PUT", base+"/status/308", "data")
+	assert.Equal(t, "PUT httpfromtcp  data", body)
+
+	// Test: Too many
+	req, _ := NewRequest(t.Context(), "GET", base+"/loop", nil)
+	_, err := c.Do(req)
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: Not followed at all
+	res, _ = do(t, &Client{MaxRedirects: -1}, "GET", base+"/redirect/3", "")
+	assert.Equal(t, response.StatusFound, res.StatusLine.StatusCode)
+	assert.Equal(t, "/redirect/2", res.Headers.Get("Location"))
+
+	// Test: Credentials follow a redirect to the same host, not to another one or from https to http
+	withCredentials := func(target string) *request.Request {
+		req, err := NewRequest(t.Context(), "GET", target, nil)
+		require.NoError(t, err)
+		req.Headers.Set("Authorization", "Bearer secret")
+		req.Headers.Set("Cookie", "session=secret")
+		return req
+	}
+	for _, tc := range []struct {
+		from, location string
+		kept           bool
+	}{
+		{"https://example.com/a", "/b", true},
+		{"http://example.com/a", "https://example.com/b", true},
+		{"https://example.com/a", "https://other.example.com/b", false},
+		{"https://example.com/a", "http://example.com/b", false},
+	} {
+		u, _ := url.Parse(tc.from)
+		next, err := redirectRequest(withCredentials(tc.from), u, response.StatusFound, tc.location)
+		require.NoError(t, err)
+		assert.Equal(t, tc.kept, next.Headers.Get("Authorization") != "", tc.location)
+		assert.Equal(t, tc.kept, next.Headers.Get("Cookie") != "", tc.location)
+	}
+}
+
+// A server that keeps connections open, unlike ours, and counts them.
+// With closeAfter, it closes each connection after one response anyway, without saying so.
+func keepAliveServer(t *testing.T, closeAfter bool) (string, *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			go func() {
+				defer conn.Close()
+				for {
+					req, err := request.RequestFromReader(conn)
+					if err != nil || req.RequestLine.Method == "" {
+						return
+					}
+					body := req.RequestLine.RequestTarget
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+					if closeAfter {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return "http://" + l.Addr().String(), accepted
+}
+
+func TestConnectionReuse(t *testing.T) {
+	// Test: Bodies read to the end give the connection back
+	base, accepted := keepAliveServer(t, false)
+	c := &Client{}
+	for i := range 3 {
+		_, body := do(t, c, "GET", fmt.Sprintf("%s/%d", base, i), "")
+		assert.Equal(t, fmt.Sprintf("/%d", i), body)
+	}
+	assert.Equal(t, int32(1), accepted.Load())
+
+	// Test: Closed without reading, it can't be reused (too big to have come with the headers)
+	req, _ := NewRequest(t.Context(), "GET", base+"/unread?"+strings.Repeat("x", 10000), nil)
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	do(t, c, "GET", base+"/next", "")
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: Not kept at all
+	c = &Client{MaxIdlePerHost: -1}
+	base, accepted = keepAliveServer(t, false)
+	do(t, c, "GET", base+"/1", "")
+	do(t, c, "GET", base+"/2", "")
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: A connection the server closed in the meantime is retried on a new one
+	c = &Client{}
+	base, accepted = keepAliveServer(t, true)
+	do(t, c, "GET", base+"/1", "")
+	time.Sleep(20 * time.Millisecond)
+	_, body := do(t, c, "GET", base+"/2", "")
+	assert.Equal(t, "/2", body)
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: Idle for too long, not reused
+	c = &Client{IdleTimeout: 10 * time.Millisecond}
+	base, accepted = keepAliveServer(t, false)
+	do(t, c, "GET", base+"/1", "")
+	time.Sleep(30 * time.Millisecond)
+	do(t, c, "GET", base+"/2", "")
+	assert.Equal(t, int32(2), accepted.Load())
+}
+
+func TestTimeouts(t *testing.T) {
+	s := servertest.NewServer(testHandler)
+	defer s.Close()
+	base := s.URL
+
+	// Test: Client timeout
+	c := &Client{Timeout: 100 * time.Millisecond}
+	req, _ := NewRequest(t.Context(), "GET", base+"/slow", nil)
+	start := time.Now()
+	_, err := c.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: Cancelled context
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, _ = NewRequest(ctx, "GET", base+"/slow", nil)
+	_, err = (&Client{}).Do(req)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Test: Nobody listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	req, _ = NewRequest(t.Context(), "GET", "http://"+addr+"/", nil)
+	_, err = (&Client{}).Do(req)
+	assert.Error(t, err)
+}
+
+func TestJar(t *testing.T) {
+	s := servertest.NewServer(testHandler)
+	defer s.Close()
+	base := s.URL
+	c := &Client{Jar: NewJar()}
+
+	// Test: Cookies set by a response go back with the next requests
+	do(t, c, "GET", base+"/set-cookie", "")
+	_, body := do(t, c, "GET", base+"/cookies/x", "")
+	assert.Equal(t, "b=2; a=1", body)
+	_, body = do(t, c, "GET", base+"/cookie", "")
+	assert.Equal(t, "", body)
+
+	u := func(s string) *url.URL {
+		parsed, err := url.Parse(s)
+		require.NoError(t, err)
+		return parsed
+	}
+	names := func(cookies []*cookie.Cookie) []string {
+		var out []string
+		for _, c := range cookies {
+			out = append(out, c.Name+"="+c.Value)
+		}
+		return out
+	}
+
+	jar := NewJar()
+	jar.SetCookies(u("https://www.example.com/app/page"), []*cookie.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: "example.com"},
+		{Name: "secure", Value: "3", Secure: true, Path: "/"},
+		{Name: "other", Value: "4", Domain: "example.org"},
+		{Name: "gone", Value: "5", MaxAge: -1},
+		{Name: "old", Value: "6", Expires: time.Now().Add(-time.Hour)},
+	})
+
+	// Test: Host-only, domain and the default path
+	assert.Equal(t, []string{"host=1", "domain=2", "secure=3"}, names(jar.Cookies(u("https://www.example.com/app/x"))))
+	assert.Equal(t, []string{"domain=2"}, names(jar.Cookies(u("http://api.example.com/app"))))
+	assert.Equal(t, []string{"secure=3"}, names(jar.Cookies(u("https://www.example.com/application"))))
+	assert.Empty(t, jar.Cookies(u("https://example.org/app")))
+
+	// Test: Replaced, then deleted
+	jar.SetCookies(u("https://www.example.com/app/page"), []*cookie.Cookie{{Name: "host", Value: "new"}})
+	assert.Equal(t, []string{"host=new", "domain=2"}, names(jar.Cookies(u("http://www.example.com/app/"))))
+	jar.SetCookies(u("https://www.example.com/app/page"), []*cookie.Cookie{{Name: "host", Value: "", MaxAge: -1}})
+	assert.Equal(t, []string{"domain=2"}, names(jar.Cookies(u("http://www.example.com/app/"))))
+
+	// Test: Secure cookies can't come over http
+	jar.SetCookies(u("http://plain.example.net/"), []*cookie.Cookie{{Name: "s", Value: "1", Secure: true}})
+	assert.Empty(t, jar.Cookies(u("https://plain.example.net/")))
+}
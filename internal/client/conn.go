@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+type persistConn struct {
+	conn net.Conn
+	key  string
+
+	// When it went back to the pool
+	idleSince time.Time
+}
+
+// Idle connections by "scheme://host:port", the most recently used last
+type pool struct {
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+// Returns an idle connection for key, or nil. The ones idle for too long are closed.
+func (p *pool) get(key string, idleTimeout time.Duration) *persistConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+
+		if time.Since(pc.idleSince) < idleTimeout {
+			p.idle[key] = conns
+			return pc
+		}
+		pc.conn.Close()
+	}
+
+	delete(p.idle, key)
+	return nil
+}
+
+// Keeps pc for later, or closes it if there are max idle connections for its host already.
+func (p *pool) put(pc *persistConn, max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[pc.key]) >= max {
+		pc.conn.Close()
+		return
+	}
+
+	if p.idle == nil {
+		p.idle = map[string][]*persistConn{}
+	}
+	pc.idleSince = time.Now()
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+}
+
+func (p *pool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conns := range p.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+	p.idle = nil
+}
+
+var errBodyClosed = errors.New("client: read on closed body")
+
+// The body of a Response. Once it's read to the end, or closed, the connection
+// goes back to the pool if it can be used again, and is closed otherwise.
+type body struct {
+	c  *Client
+	pc *persistConn
+	rr *response.ResponseReader
+
+	ctx context.Context
+	// Stops the context from breaking the connection
+	stop func() bool
+	// Ends the client's timeout, if there's one
+	cancel context.CancelFunc
+
+	keepAlive bool
+	closed    bool
+	released  bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errBodyClosed
+	}
+	if b.released {
+		return 0, io.EOF
+	}
+
+	n, err := b.rr.Read(p)
+	if err == io.EOF {
+		b.release()
+		return n, io.EOF
+	}
+	if err != nil {
+		// The context is a better explanation than the deadline it set
+		if ctxErr := b.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		b.release()
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.release()
+	return nil
+}
+
+func (b *body) release() {
+	if b.released {
+		return
+	}
+	b.released = true
+
+	// If the context already got to the connection, it's no good anymore
+	untouched := b.stop()
+	reuse := untouched && b.keepAlive && b.rr.Done() && len(b.rr.Buffered()) == 0
+	if reuse && b.c.maxIdle() > 0 {
+		b.c.pool.put(b.pc, b.c.maxIdle())
+	} else {
+		b.pc.conn.Close()
+	}
+
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
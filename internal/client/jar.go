@@ -0,0 +1,185 @@
+package client
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/cookie"
+)
+
+// A Jar keeps the cookies servers set and gives them back to the requests they
+// belong to, following the rules of RFC 6265 for domains, paths, Secure and expiry.
+// There's no public suffix list, so a server could set a cookie for a whole
+// suffix like co.uk; fine for talking to servers we trust, not for a browser.
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]*jarEntry
+	// Counts the cookies as they come, for the order
+	seq uint64
+}
+
+type jarEntry struct {
+	name, value string
+
+	domain string
+	// Without a Domain attribute the cookie is only for the host that set it
+	hostOnly bool
+	path     string
+	secure   bool
+
+	// Zero for cookies that last as long as the jar
+	expires time.Time
+	// Older cookies go first when the paths are as long
+	created uint64
+}
+
+// NewJar returns an empty Jar.
+func NewJar() *Jar {
+	return &Jar{entries: map[string]*jarEntry{}}
+}
+
+// SetCookies stores the cookies that the response to u set. Cookies for some
+// other domain, or Secure ones over plain http, are dropped.
+func (j *Jar) SetCookies(u *url.URL, cookies []*cookie.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, c := range cookies {
+		e := &jarEntry{
+			name:   c.Name,
+			value:  c.Value,
+			domain: host,
+			path:   c.Path,
+			secure: c.Secure,
+		}
+
+		if c.Domain != "" {
+			domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+			// An IP address can only set cookies for itself
+			if !domainMatch(host, domain) || (net.ParseIP(host) != nil && host != domain) {
+				continue
+			}
+			e.domain = domain
+		} else {
+			e.hostOnly = true
+		}
+
+		if !strings.HasPrefix(e.path, "/") {
+			e.path = defaultPath(u.Path)
+		}
+
+		if e.secure && u.Scheme != "https" {
+			continue
+		}
+
+		key := e.name + ";" + e.domain + ";" + e.path
+		if old, ok := j.entries[key]; ok {
+			// Replacing keeps its place in the order
+			e.created = old.created
+		} else {
+			j.seq++
+			e.created = j.seq
+		}
+
+		switch {
+		case c.MaxAge < 0:
+			delete(j.entries, key)
+			continue
+		case c.MaxAge > 0:
+			e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			if !c.Expires.After(now) {
+				delete(j.entries, key)
+				continue
+			}
+			e.expires = c.Expires
+		}
+
+		if j.entries == nil {
+			j.entries = map[string]*jarEntry{}
+		}
+		j.entries[key] = e
+	}
+}
+
+// Cookies returns the cookies to send with a request to u, the ones with
+// the longest paths first.
+func (j *Jar) Cookies(u *url.URL) []*cookie.Cookie {
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var matches []*jarEntry
+	for key, e := range j.entries {
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+
+		if e.hostOnly && host != e.domain {
+			continue
+		}
+		if !e.hostOnly && !domainMatch(host, e.domain) {
+			continue
+		}
+		if !pathMatch(path, e.path) {
+			continue
+		}
+		if e.secure && u.Scheme != "https" {
+			continue
+		}
+
+		matches = append(matches, e)
+	}
+
+	sort.Slice(matches, func(a, b int) bool {
+		if len(matches[a].path) != len(matches[b].path) {
+			return len(matches[a].path) > len(matches[b].path)
+		}
+		return matches[a].created < matches[b].created
+	})
+
+	cookies := make([]*cookie.Cookie, len(matches))
+	for i, e := range matches {
+		cookies[i] = &cookie.Cookie{Name: e.name, Value: e.value}
+	}
+	return cookies
+}
+
+// The host is the domain, or a subdomain of it
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// The request path is the cookie path, or below it
+func pathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+}
+
+// Cookies without a Path are for the "directory" of the URL that set them
+func defaultPath(urlPath string) string {
+	i := strings.LastIndex(urlPath, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return urlPath[:i]
+}
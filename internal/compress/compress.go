@@ -0,0 +1,269 @@
+// Package compress has middleware for HTTP content codings: compressing responses
+// for clients that accept it, and decoding compressed request bodies, with gzip or
+// deflate from the standard library.
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/neixir/httpfromtcp/internal/conditional"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// Bodies smaller than this aren't worth compressing: the gzip header and the
+// chunked framing would eat most of the savings.
+const DefaultMinSize = 1024
+
+// Optional settings for MiddlewareWithConfig. The zero value is what Middleware uses.
+type Config struct {
+	// Responses with a Content-Length below this are sent as they are (DefaultMinSize if 0)
+	MinSize int
+
+	// Compression level, from flate.BestSpeed to flate.BestCompression (flate.DefaultCompression if 0 or invalid)
+	Level int
+}
+
+// Middleware compresses the responses of h for clients that accept gzip or deflate.
+// The body is compressed as the handler writes it and goes out chunked, so
+// nothing is held in memory. Small bodies, types that are already compressed,
+// range responses and HEAD requests are left alone.
+func Middleware(h server.HandlerFunc) server.HandlerFunc {
+	return MiddlewareWithConfig(Config{}, h)
+}
+
+// Like Middleware, with the settings in cfg.
+func MiddlewareWithConfig(cfg Config, h server.HandlerFunc) server.HandlerFunc {
+	if cfg.MinSize == 0 {
+		cfg.MinSize = DefaultMinSize
+	}
+	if cfg.Level == 0 || cfg.Level < flate.HuffmanOnly || cfg.Level > flate.BestCompression {
+		cfg.Level = flate.DefaultCompression
+	}
+
+	c := &compressor{cfg: cfg}
+
+	return func(w *response.Writer, req *request.Request) {
+		w.AddFilter(c.filter(req))
+		h(w, req)
+		w.Finish()
+	}
+}
+
+// Encodings we can produce, in order of preference
+var supported = []string{"gzip", "deflate"}
+
+// Negotiate picks the content coding for a response from the request's Accept-Encoding:
+// "gzip", "deflate", or "" to send it uncompressed. The highest q-value wins, and on a
+// tie the order in supported. "*" stands for any coding not listed, and q=0 rules one out.
+func Negotiate(acceptEncoding string) string {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return ""
+	}
+
+	qs := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		qs[coding] = parseQ(params)
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range supported {
+		q, ok := qs[coding]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	// Somebody who really prefers identity gets identity
+	if q, ok := qs["identity"]; ok && q > bestQ {
+		return ""
+	}
+
+	return best
+}
+
+// The q-value in the parameters of an Accept-Encoding element, 1 if there isn't one
+// and 0 if it's nonsense.
+func parseQ(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.ToLower(strings.TrimSpace(name)) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// Content types not worth compressing again (prefixes, matched against the media type)
+var precompressed = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+	// Not compressed, but it has to get to the client as soon as it's written
+	"text/event-stream",
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	// SVG is text, even if it's an image
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+
+	for _, prefix := range precompressed {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Holds the writers of one middleware, allocating a gzip writer for every response is expensive
+type compressor struct {
+	cfg         Config
+	gzipWriters sync.Pool
+	zlibWriters sync.Pool
+}
+
+func (c *compressor) filter(req *request.Request) response.Filter {
+	encoding := Negotiate(req.Headers.Get("Accept-Encoding"))
+
+	return func(status response.StatusCode, h headers.Headers, next io.Writer) io.WriteCloser {
+		if status < 200 || h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+			return nil
+		}
+
+		// Whether or not this client gets it compressed, caches need to know that others might
+		if !h.HasToken("Vary", "Accept-Encoding") && h.Get("Vary") != "*" {
+			if vary := h.Get("Vary"); vary != "" {
+				h.Set("Vary", vary+", Accept-Encoding")
+			} else {
+				h.Set("Vary", "Accept-Encoding")
+			}
+		}
+
+		if encoding == "" || req.RequestLine.Method == "HEAD" || h.HasToken("Cache-Control", "no-transform") {
+			return nil
+		}
+
+		// Ranges are ranges of the uncompressed content
+		if status == response.StatusNoContent || status == response.StatusPartialContent ||
+			status == response.StatusNotModified || h.Get("Content-Range") != "" {
+			return nil
+		}
+
+		if cl := h.Get("Content-Length"); cl != "" {
+			n, err := strconv.Atoi(cl)
+			if err == nil && n < c.cfg.MinSize {
+				return nil
+			}
+		}
+
+		// The length isn't known until it's compressed, so it goes out chunked
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Content-Encoding", encoding)
+
+		// Same meaning, different bytes: the tag can't be strong anymore
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", conditional.Weaken(etag))
+		}
+
+		return c.newEncoder(encoding, next)
+	}
+}
+
+// Compresses into a buffer in front of next, so what reaches the connection are
+// decent-sized chunks and not every little block the compressor flushes.
+type encoder struct {
+	c        *compressor
+	encoding string
+	zw       interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	}
+	bw *bufio.Writer
+}
+
+func (c *compressor) newEncoder(encoding string, next io.Writer) *encoder {
+	e := &encoder{c: c, encoding: encoding, bw: bufio.NewWriterSize(next, 4096)}
+
+	switch encoding {
+	case "gzip":
+		if zw, ok := c.gzipWriters.Get().(*gzip.Writer); ok {
+			zw.Reset(e.bw)
+			e.zw = zw
+		} else {
+			// The level was checked when the middleware was made, so no error
+			zw, _ := gzip.NewWriterLevel(e.bw, c.cfg.Level)
+			e.zw = zw
+		}
+	case "deflate":
+		// "deflate" in HTTP is the zlib format, not raw deflate
+		if zw, ok := c.zlibWriters.Get().(*zlib.Writer); ok {
+			zw.Reset(e.bw)
+			e.zw = zw
+		} else {
+			zw, _ := zlib.NewWriterLevel(e.bw, c.cfg.Level)
+			e.zw = zw
+		}
+	}
+
+	return e
+}
+
+func (e *encoder) Write(p []byte) (int, error) {
+	return e.zw.Write(p)
+}
+
+// Writes the end of the compressed stream, flushes it and gives the compressor back.
+func (e *encoder) Close() error {
+	err := e.zw.Close()
+	if err == nil {
+		err = e.bw.Flush()
+	}
+
+	e.zw.Reset(nil)
+	switch e.encoding {
+	case "gzip":
+		e.c.gzipWriters.Put(e.zw)
+	case "deflate":
+		e.c.zlibWriters.Put(e.zw)
+	}
+
+	return err
+}
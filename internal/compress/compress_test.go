@@ -0,0 +1,289 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Setting Accept-Encoding ourselves stops the transport from decompressing for us.
+var client = &http.Client{Transport: &http.Transport{}}
+
+func get(t *testing.T, method, url, acceptEncoding string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, body
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	zr, err := gzip.NewReader(strings.NewReader(string(data)))
+	require.NoError(t, err)
+	out, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	return string(out)
+}
+
+var text = strings.Repeat("All work and no play makes Jack a dull boy.\n", 200)
+
+func testHandler(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(len(text))
+
+	switch req.RequestLine.RequestTarget {
+	case "/text":
+		h.Set("ETag", `"v1"`)
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		// In pieces, the middleware must not care
+		w.WriteBody([]byte(text[:100]))
+		w.WriteBody([]byte(text[100:]))
+
+	case "/small":
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("small"))
+
+	case "/image":
+		h.Set("Content-Type", "image/png")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(text))
+
+	case "/range":
+		h.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(text)-1, len(text)*2))
+		w.WriteStatusLine(response.StatusPartialContent)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(text))
+
+	case "/chunked":
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Lines")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		for line := range strings.Lines(text) {
+			w.WriteChunkedBody([]byte(line))
+		}
+		w.WriteChunkedBodyDone(headers.Headers{"X-Lines": "200"})
+
+	case "/unknown-length":
+		// No Content-Length and not chunked, the body ends when the handler returns
+		h.Del("Content-Length")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		w.WriteBodyFrom(strings.NewReader(text))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	s := servertest.NewServer(Middleware(testHandler))
+	defer s.Close()
+	base := s.URL
+
+	// Test: gzip, chunked, no Content-Length, weak ETag and Vary
+	res, body := get(t, "GET", base+"/text", "gzip, deflate")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, int64(-1), res.ContentLength)
+	assert.Equal(t, `W/"v1"`, res.Header.Get("ETag"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Less(t, len(body), len(text)/10)
+	assert.Equal(t, text, gunzip(t, body))
+
+	// Test: deflate when it's preferred, in zlib format
+	res, body = get(t, "GET", base+"/text", "gzip;q=0.5, deflate")
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	zr, err := zlib.NewReader(strings.NewReader(string(body)))
+	require.NoError(t, err)
+	out, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, text, string(out))
+
+	// Test: Identity for clients that don't want it, but still with Vary
+	res, body = get(t, "GET", base+"/text", "identity")
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, `"v1"`, res.Header.Get("ETag"))
+	assert.Equal(t, int64(len(text)), res.ContentLength)
+	assert.Equal(t, text, string(body))
+
+	// Test: HEAD is left alone
+	res, body = get(t, "HEAD", base+"/text", "gzip")
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(text)), res.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	// Test: Small bodies, compressed types and ranges aren't compressed
+	for _, path := range []string{"/small", "/image", "/range"} {
+		res, _ = get(t, "GET", base+path, "gzip")
+		assert.Equal(t, "", res.Header.Get("Content-Encoding"), path)
+		assert.NotEqual(t, int64(-1), res.ContentLength, path)
+	}
+
+	// Test: A chunked response keeps its trailers
+	res, body = get(t, "GET", base+"/chunked", "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, text, gunzip(t, body))
+	assert.Equal(t, "200", res.Trailer.Get("X-Lines"))
+
+	// Test: A body of unknown length is finished by the middleware
+	res, body = get(t, "GET", base+"/unknown-length", "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, text, gunzip(t, body))
+
+	// Test: The handler's headers are not modified
+	var seen headers.Headers
+	s2 := servertest.NewServer(Middleware(func(w *response.Writer, req *request.Request) {
+		seen = response.GetDefaultHeaders(len(text))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(seen)
+		w.WriteBody([]byte(text))
+	}))
+	defer s2.Close()
+	base = s2.URL
+	res, body = get(t, "GET", base+"/", "gzip")
+	assert.Equal(t, text, gunzip(t, body))
+	assert.Equal(t, strconv.Itoa(len(text)), seen.Get("Content-Length"))
+	assert.Equal(t, "", seen.Get("Content-Encoding"))
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"gzip;q=0.5, deflate;q=0.8", "deflate"},
+		{"gzip; q=0, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"br", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", "deflate"},
+		{"identity", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip;q=nonsense", ""},
+		{"gzip;q=2", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Negotiate(tt.accept), tt.accept)
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func deflated(t *testing.T, data []byte, raw bool) []byte {
+	var buf bytes.Buffer
+	var zw io.WriteCloser = zlib.NewWriter(&buf)
+	if raw {
+		zw, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func post(t *testing.T, url, contentEncoding string, body []byte) (*http.Response, string) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", contentEncoding)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(data)
+}
+
+func TestDecodeRequest(t *testing.T) {
+	// Echoes the body and the headers it got
+	echo := func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(req.Body))
+		h.Set("X-Content-Encoding", req.Headers.Get("Content-Encoding"))
+		h.Set("X-Content-Length", req.Headers.Get("Content-Length"))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		w.WriteBody(req.Body)
+	}
+	s := servertest.NewServer(DecodeRequest(int64(len(text)), echo))
+	defer s.Close()
+	base := s.URL
+
+	// Test: gzip
+	res, body := post(t, base, "gzip", gzipped(t, []byte(text)))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, text, body)
+	assert.Equal(t, "", res.Header.Get("X-Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(text)), res.Header.Get("X-Content-Length"))
+
+	// Test: deflate, both zlib and raw
+	res, body = post(t, base, "deflate", deflated(t, []byte(text), false))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, text, body)
+	res, body = post(t, base, "deflate", deflated(t, []byte(text), true))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, text, body)
+
+	// Test: Stacked codings are undone last to first
+	res, body = post(t, base, "deflate, gzip", gzipped(t, deflated(t, []byte(text), false)))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, text, body)
+
+	// Test: Uncompressed bodies go through untouched
+	res, body = post(t, base, "", []byte("plain"))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "plain", body)
+
+	// Test: Decoding to more than the limit is a 413, however small the compressed body
+	bomb := gzipped(t, []byte(text+"!"))
+	assert.Less(t, len(bomb), 1024)
+	res, _ = post(t, base, "gzip", bomb)
+	assert.Equal(t, 413, res.StatusCode)
+
+	// Test: The limit applies to every stage
+	res, _ = post(t, base, "gzip, gzip", gzipped(t, bomb))
+	assert.Equal(t, 413, res.StatusCode)
+
+	// Test: Unknown codings are a 415 that says what we accept
+	res, _ = post(t, base, "br", []byte("whatever"))
+	assert.Equal(t, 415, res.StatusCode)
+	assert.Equal(t, "gzip, deflate", res.Header.Get("Accept-Encoding"))
+
+	res, _ = post(t, base, "gzip, gzip, gzip, gzip, gzip", []byte("whatever"))
+	assert.Equal(t, 415, res.StatusCode)
+
+	// Test: A corrupt body is a 400
+	res, _ = post(t, base, "gzip", []byte("not gzip at all"))
+	assert.Equal(t, 400, res.StatusCode)
+}
@@ -0,0 +1,152 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// DecodeRequest uses this when maxSize is 0
+const DefaultMaxDecodedSize = 10 << 20
+
+// Nobody compresses a body more than a couple of times, except to hurt us
+const maxEncodings = 4
+
+var (
+	// Returned by DecodeBody when the decoded body would be bigger than allowed
+	ErrTooLarge = errors.New("compress: decoded body too large")
+
+	// Returned by DecodeBody for codings we can't undo (wrapped, with the coding)
+	ErrUnsupportedEncoding = errors.New("compress: unsupported content coding")
+)
+
+// DecodeBody undoes the content codings listed in contentEncoding, which were
+// applied in that order, so they're removed from last to first.
+// No decoded stage may be bigger than maxSize bytes, so a tiny zip bomb can't
+// fill up the memory.
+func DecodeBody(body []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	codings := []string{}
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+
+	if len(codings) > maxEncodings {
+		return nil, fmt.Errorf("%w: %d codings stacked", ErrUnsupportedEncoding, len(codings))
+	}
+
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		body, err = decode(body, codings[i], maxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+func decode(data []byte, coding string, maxSize int64) ([]byte, error) {
+	var r io.Reader
+
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+
+	case "deflate":
+		// Should be zlib, but plenty of clients send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err == nil {
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(data))
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, coding)
+	}
+
+	// Read one byte more than allowed, to tell "exactly maxSize" from "too much"
+	out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	return out, nil
+}
+
+// DecodeRequest returns a handler that decodes compressed request bodies before
+// calling h, so h sees the body as it was before compression, with Content-Length
+// updated and no Content-Encoding. A decoded body over maxSize bytes gets a 413,
+// a coding we don't know a 415, and a corrupt body a 400.
+// If maxSize is 0, DefaultMaxDecodedSize is used.
+func DecodeRequest(maxSize int64, h server.HandlerFunc) server.HandlerFunc {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecodedSize
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		contentEncoding := req.Headers.Get("Content-Encoding")
+		if contentEncoding == "" {
+			h(w, req)
+			return
+		}
+
+		body, err := DecodeBody(req.Body, contentEncoding, maxSize)
+		switch {
+		case errors.Is(err, ErrTooLarge):
+			writeError(w, response.StatusContentTooLarge, nil)
+			return
+		case errors.Is(err, ErrUnsupportedEncoding):
+			// Tell the client what we do understand
+			writeError(w, response.StatusUnsupportedMediaType, map[string]string{"Accept-Encoding": "gzip, deflate"})
+			return
+		case err != nil:
+			writeError(w, response.StatusBadRequest, nil)
+			return
+		}
+
+		// Copy the request, the caller may still be using the original
+		r2 := *req
+		r2.Headers = maps.Clone(req.Headers)
+		// Lowercase, like the parser leaves them
+		r2.Headers.Del("content-encoding")
+		r2.Headers.Set("content-length", strconv.Itoa(len(body)))
+		r2.Body = body
+
+		h(w, &r2)
+	}
+}
+
+func writeError(w *response.Writer, status response.StatusCode, extra map[string]string) {
+	body := fmt.Sprintf("%d %s\n", status, response.StatusText(status))
+
+	h := response.GetDefaultHeaders(len(body))
+	for key, value := range extra {
+		h.Set(key, value)
+	}
+
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
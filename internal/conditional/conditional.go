@@ -0,0 +1,228 @@
+// Package conditional implements validators (ETag, Last-Modified) and the
+// evaluation of conditional requests from RFC 9110 section 13, so clients can
+// revalidate what they have cached instead of downloading it again.
+package conditional
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+// ModTimeETag builds an entity tag from the modification time and size, the
+// way most file servers do. It's cheap, but two different contents written in
+// the same instant with the same size would get the same tag, hence the weak option.
+func ModTimeETag(modtime time.Time, size int64, weak bool) string {
+	tag := fmt.Sprintf(`"%x-%x"`, modtime.UnixNano(), size)
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// HashETag builds a strong entity tag from the content itself.
+func HashETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// HashETagReader is HashETag for content that comes from a reader.
+func HashETagReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// Weaken turns a strong entity tag into a weak one, for when the bytes change
+// but the meaning doesn't (compression, for example).
+func Weaken(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// SetValidators adds ETag and Last-Modified to h. Empty or zero values are skipped.
+func SetValidators(h headers.Headers, etag string, lastModified time.Time) {
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Evaluate checks the preconditions of the request against the current validators
+// of the resource, in the order of RFC 9110 section 13.2.2.
+// It returns 304 Not Modified, 412 Precondition Failed, or 0 if the request should
+// be processed normally. exists says whether there is a current representation at
+// all, which is what "*" matches. etag and lastModified may be empty/zero if unknown.
+func Evaluate(req *request.Request, exists bool, etag string, lastModified time.Time) response.StatusCode {
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+
+	// 1. If-Match, otherwise 2. If-Unmodified-Since
+	if ifMatch := req.Headers.Get("If-Match"); ifMatch != "" {
+		if !matchAny(ifMatch, exists, etag, strongMatch) {
+			return response.StatusPreconditionFailed
+		}
+	} else if since, ok := parseDate(req.Headers.Get("If-Unmodified-Since")); ok && !lastModified.IsZero() {
+		if truncate(lastModified).After(since) {
+			return response.StatusPreconditionFailed
+		}
+	}
+
+	// 3. If-None-Match, otherwise 4. If-Modified-Since (only for GET and HEAD)
+	if ifNoneMatch := req.Headers.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchAny(ifNoneMatch, exists, etag, weakMatch) {
+			if safe {
+				return response.StatusNotModified
+			}
+			return response.StatusPreconditionFailed
+		}
+	} else if since, ok := parseDate(req.Headers.Get("If-Modified-Since")); ok && safe && !lastModified.IsZero() {
+		if !truncate(lastModified).After(since) {
+			return response.StatusNotModified
+		}
+	}
+
+	// 5. If-Range is up to whoever handles the Range, see IfRange
+	return 0
+}
+
+// Check runs Evaluate and, if the request shouldn't go on, writes the 304 or 412
+// response. h has the headers a 304 must repeat (Cache-Control, Vary...), it may be nil.
+// Returns true if the handler should carry on and write the normal response.
+func Check(w *response.Writer, req *request.Request, exists bool, etag string, lastModified time.Time, h headers.Headers) bool {
+	status := Evaluate(req, exists, etag, lastModified)
+	if status == 0 {
+		return true
+	}
+
+	resHeaders := headers.Headers{}
+
+	if status == response.StatusNotModified {
+		// A 304 has no body, but carries the validators and caching headers
+		for _, key := range []string{"Cache-Control", "Content-Location", "Date", "Expires", "Vary"} {
+			if v := h.Get(key); v != "" {
+				resHeaders.Set(key, v)
+			}
+		}
+		SetValidators(resHeaders, etag, lastModified)
+
+		w.WriteStatusLine(status)
+		w.WriteHeaders(resHeaders)
+		return false
+	}
+
+	body := "412 Precondition Failed\n"
+	resHeaders.Set("Content-Type", "text/plain")
+	resHeaders.Set("Content-Length", strconv.Itoa(len(body)))
+
+	w.WriteStatusLine(status)
+	w.WriteHeaders(resHeaders)
+	w.WriteBody([]byte(body))
+	return false
+}
+
+// IfRange reports whether a Range in the request should be honoured, given the
+// resource's validators. If-Range holds either an entity tag, which must match
+// strongly, or a date, which must be exactly the Last-Modified.
+func IfRange(req *request.Request, etag string, lastModified time.Time) bool {
+	ifRange := strings.TrimSpace(req.Headers.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return strongMatch(ifRange, etag)
+	}
+
+	t, ok := parseDate(ifRange)
+	return ok && !lastModified.IsZero() && t.Equal(truncate(lastModified))
+}
+
+// Strong comparison: both tags strong and identical
+func strongMatch(a, b string) bool {
+	return a != "" && a == b && !strings.HasPrefix(a, "W/")
+}
+
+// Weak comparison: identical once the W/ is ignored
+func weakMatch(a, b string) bool {
+	return a != "" && b != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// Reports whether the list in an If-Match or If-None-Match header matches etag.
+// "*" matches any current representation, whether or not it has a tag.
+func matchAny(list string, exists bool, etag string, match func(a, b string) bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return exists
+	}
+
+	for _, tag := range splitETags(list) {
+		if match(tag, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a list of entity tags. Commas are allowed inside the quotes, so we can't just split on them.
+func splitETags(list string) []string {
+	tags := []string{}
+
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return tags
+		}
+
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = 2
+		}
+		if len(list) <= start || list[start] != '"' {
+			// Not a valid tag, skip to the next comma
+			_, rest, found := strings.Cut(list, ",")
+			if !found {
+				return tags
+			}
+			list = rest
+			continue
+		}
+
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+}
+
+func parseDate(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(s)
+	return t, err == nil
+}
+
+// HTTP dates have one second resolution
+func truncate(t time.Time) time.Time {
+	return t.Truncate(time.Second)
+}
@@ -0,0 +1,104 @@
+package conditional
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRequest(method string, h headers.Headers) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     h,
+	}
+}
+
+func TestETags(t *testing.T) {
+	modtime := time.Date(2025, 7, 22, 10, 0, 0, 0, time.UTC)
+
+	// Test: Same input, same tag
+	assert.Equal(t, ModTimeETag(modtime, 42, false), ModTimeETag(modtime, 42, false))
+	assert.NotEqual(t, ModTimeETag(modtime, 42, false), ModTimeETag(modtime, 43, false))
+	assert.True(t, strings.HasPrefix(ModTimeETag(modtime, 42, true), `W/"`))
+
+	// Test: Hash tags from bytes and from a reader agree
+	tag, err := HashETagReader(strings.NewReader("hola"))
+	assert.NoError(t, err)
+	assert.Equal(t, HashETag([]byte("hola")), tag)
+	assert.NotEqual(t, HashETag([]byte("adeu")), tag)
+
+	// Test: Weaken
+	assert.Equal(t, `W/"abc"`, Weaken(`"abc"`))
+	assert.Equal(t, `W/"abc"`, Weaken(`W/"abc"`))
+
+	// Test: Lists with commas inside the tags
+	assert.Equal(t, []string{`"a,b"`, `W/"c"`, `"d"`}, splitETags(`"a,b", W/"c" ,"d"`))
+}
+
+func TestEvaluate(t *testing.T) {
+	etag := `"v2"`
+	modtime := time.Date(2025, 7, 22, 10, 0, 0, 500, time.UTC)
+	before := modtime.Add(-time.Hour).Format(http.TimeFormat)
+	same := modtime.Format(http.TimeFormat)
+
+	cases := []struct {
+		name    string
+		method  string
+		headers headers.Headers
+		want    response.StatusCode
+	}{
+		{"no conditions", "GET", headers.Headers{}, 0},
+		{"If-None-Match matches", "GET", headers.Headers{"if-none-match": `"v1", "v2"`}, response.StatusNotModified},
+		{"If-None-Match weak matches", "GET", headers.Headers{"if-none-match": `W/"v2"`}, response.StatusNotModified},
+		{"If-None-Match star", "HEAD", headers.Headers{"if-none-match": "*"}, response.StatusNotModified},
+		{"If-None-Match other tag", "GET", headers.Headers{"if-none-match": `"v1"`}, 0},
+		{"If-None-Match matches on PUT", "PUT", headers.Headers{"if-none-match": `"v2"`}, response.StatusPreconditionFailed},
+		{"If-Match matches", "PUT", headers.Headers{"if-match": `"v2"`}, 0},
+		{"If-Match weak never matches", "PUT", headers.Headers{"if-match": `W/"v2"`}, response.StatusPreconditionFailed},
+		{"If-Match other tag", "PUT", headers.Headers{"if-match": `"v1"`}, response.StatusPreconditionFailed},
+		{"If-Modified-Since same second", "GET", headers.Headers{"if-modified-since": same}, response.StatusNotModified},
+		{"If-Modified-Since older", "GET", headers.Headers{"if-modified-since": before}, 0},
+		{"If-Modified-Since ignored on POST", "POST", headers.Headers{"if-modified-since": same}, 0},
+		{"If-Modified-Since bad date", "GET", headers.Headers{"if-modified-since": "yesterday"}, 0},
+		{"If-Unmodified-Since older", "PUT", headers.Headers{"if-unmodified-since": before}, response.StatusPreconditionFailed},
+		{"If-Unmodified-Since same second", "PUT", headers.Headers{"if-unmodified-since": same}, 0},
+		// If-None-Match takes precedence over If-Modified-Since
+		{"If-None-Match wins", "GET", headers.Headers{"if-none-match": `"v1"`, "if-modified-since": same}, 0},
+		// If-Match takes precedence over If-Unmodified-Since
+		{"If-Match wins", "PUT", headers.Headers{"if-match": `"v2"`, "if-unmodified-since": before}, 0},
+		// A failed If-Match beats a matching If-None-Match
+		{"If-Match first", "GET", headers.Headers{"if-match": `"v1"`, "if-none-match": `"v2"`}, response.StatusPreconditionFailed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, Evaluate(newRequest(c.method, c.headers), true, etag, modtime))
+		})
+	}
+
+	// Test: "*" is about whether there's a representation, not about its tag
+	assert.Equal(t, response.StatusCode(0), Evaluate(newRequest("GET", headers.Headers{"if-none-match": "*"}), false, "", time.Time{}))
+	assert.Equal(t, response.StatusPreconditionFailed, Evaluate(newRequest("PUT", headers.Headers{"if-match": "*"}), false, "", time.Time{}))
+	assert.Equal(t, response.StatusCode(0), Evaluate(newRequest("PUT", headers.Headers{"if-match": "*"}), true, "", time.Time{}))
+	assert.Equal(t, response.StatusNotModified, Evaluate(newRequest("GET", headers.Headers{"if-none-match": "*"}), true, "", time.Time{}))
+
+	// Test: Unknown validators never match a tag
+	assert.Equal(t, response.StatusPreconditionFailed, Evaluate(newRequest("PUT", headers.Headers{"if-match": `"v2"`}), true, "", time.Time{}))
+}
+
+func TestIfRange(t *testing.T) {
+	modtime := time.Date(2025, 7, 22, 10, 0, 0, 0, time.UTC)
+
+	assert.True(t, IfRange(newRequest("GET", headers.Headers{}), `"v1"`, modtime))
+	assert.True(t, IfRange(newRequest("GET", headers.Headers{"if-range": `"v1"`}), `"v1"`, modtime))
+	assert.False(t, IfRange(newRequest("GET", headers.Headers{"if-range": `"v0"`}), `"v1"`, modtime))
+	assert.False(t, IfRange(newRequest("GET", headers.Headers{"if-range": `W/"v1"`}), `W/"v1"`, modtime))
+	assert.True(t, IfRange(newRequest("GET", headers.Headers{"if-range": modtime.Format(http.TimeFormat)}), "", modtime))
+	assert.False(t, IfRange(newRequest("GET", headers.Headers{"if-range": modtime.Add(time.Hour).Format(http.TimeFormat)}), "", modtime))
+}
@@ -0,0 +1,305 @@
+// Package cookie implements HTTP cookies from RFC 6265: reading the Cookie header
+// of requests and building Set-Cookie headers for responses, and reading them
+// back on the client side.
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+)
+
+// Returned by Request.Cookie when there's no cookie with that name
+var ErrNoCookie = errors.New("cookie: named cookie not present")
+
+// SameSite controls whether the browser sends the cookie with cross-site requests.
+type SameSite int
+
+const (
+	// No SameSite attribute, the browser decides (Lax, in the modern ones)
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// A Cookie is one name=value pair, plus the attributes that go with it in a Set-Cookie.
+// A cookie parsed from a request only has Name and Value, browsers don't send the rest.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path   string
+	Domain string
+
+	// Zero means no Expires attribute
+	Expires time.Time
+	// Seconds. Zero means no Max-Age attribute, negative means delete the cookie now (Max-Age=0)
+	MaxAge int
+
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+
+	// Stored apart for each top level site (CHIPS), needs Secure
+	Partitioned bool
+}
+
+// Valid reports what's wrong with the cookie, if anything.
+func (c *Cookie) Valid() error {
+	if !isToken(c.Name) {
+		return fmt.Errorf("cookie: invalid name %q", c.Name)
+	}
+
+	if !validValue(c.Value) {
+		return fmt.Errorf("cookie: invalid value for %q", c.Name)
+	}
+
+	if strings.ContainsAny(c.Path, ";") || hasCTL(c.Path) {
+		return fmt.Errorf("cookie: invalid path %q", c.Path)
+	}
+
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return fmt.Errorf("cookie: invalid domain %q", c.Domain)
+	}
+
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return fmt.Errorf("cookie: invalid expiry %v", c.Expires)
+	}
+
+	// Browsers throw these away, better to find out here
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return errors.New("cookie: SameSite=None needs Secure")
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.New("cookie: Partitioned needs Secure")
+	}
+
+	return nil
+}
+
+// String returns the cookie as the value of a Set-Cookie header.
+// Call Valid first, String doesn't check anything.
+func (c *Cookie) String() string {
+	var b strings.Builder
+
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	b.WriteString(quoteValue(c.Value))
+
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		// A leading dot means nothing nowadays
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(http.TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+
+	return b.String()
+}
+
+// SetCookie adds a Set-Cookie for c to the response headers h, on its own line
+// next to any others. Invalid cookies aren't added.
+func SetCookie(h headers.Headers, c *Cookie) error {
+	err := c.Valid()
+	if err != nil {
+		return err
+	}
+
+	h.Add("Set-Cookie", c.String())
+	return nil
+}
+
+// Parse reads the pairs of a Cookie request header ("a=1; b=2").
+// Pairs with an invalid name or value are skipped, whatever the browser sends
+// we'd rather not fail the whole request for it.
+func Parse(header string) []*Cookie {
+	cookies := []*Cookie{}
+
+	for _, pair := range strings.Split(header, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !isToken(name) {
+			continue
+		}
+
+		// Quotes are allowed around the value, but aren't part of it
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !validValue(value) {
+			continue
+		}
+
+		cookies = append(cookies, &Cookie{Name: name, Value: value})
+	}
+
+	return cookies
+}
+
+// ParseSetCookie reads the value of a Set-Cookie response header, for clients.
+// Attributes it doesn't know, or with values that make no sense, are ignored
+// as RFC 6265 says, only a bad name or value is an error.
+func ParseSetCookie(line string) (*Cookie, error) {
+	parts := strings.Split(line, ";")
+
+	name, value, found := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	if !found || !isToken(name) {
+		return nil, fmt.Errorf("cookie: invalid Set-Cookie %q", line)
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	if !validValue(value) {
+		return nil, fmt.Errorf("cookie: invalid value for %q", name)
+	}
+
+	c := &Cookie{Name: name, Value: value}
+
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		val = strings.TrimSpace(val)
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "path":
+			if strings.HasPrefix(val, "/") {
+				c.Path = val
+			}
+		case "domain":
+			if validDomain(val) {
+				c.Domain = strings.ToLower(strings.TrimPrefix(val, "."))
+			}
+		case "expires":
+			t, err := http.ParseTime(val)
+			if err == nil {
+				c.Expires = t.UTC()
+			}
+		case "max-age":
+			secs, err := strconv.Atoi(val)
+			if err != nil {
+				continue
+			}
+			if secs <= 0 {
+				secs = -1
+			}
+			c.MaxAge = secs
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+
+	return c, nil
+}
+
+// Spaces and commas aren't cookie-octets, but they're common enough in values
+// that they're allowed as long as the value is quoted.
+func quoteValue(v string) string {
+	if strings.ContainsAny(v, " ,") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+func validValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if !isCookieOctet(v[i]) && v[i] != ' ' && v[i] != ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// cookie-octet from RFC 6265: printable US-ASCII but for the quote, comma, semicolon and backslash
+func isCookieOctet(c byte) bool {
+	return c == 0x21 ||
+		(c >= 0x23 && c <= 0x2B) ||
+		(c >= 0x2D && c <= 0x3A) ||
+		(c >= 0x3C && c <= 0x5B) ||
+		(c >= 0x5D && c <= 0x7E)
+}
+
+// Same characters as header names
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && !strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func validDomain(d string) bool {
+	d = strings.TrimPrefix(d, ".")
+	if d == "" || len(d) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+			if !isAlnum && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hasCTL(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7F {
+			return true
+		}
+	}
+	return false
+}
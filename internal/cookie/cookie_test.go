@@ -0,0 +1,118 @@
+package cookie_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/cookie"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieString(t *testing.T) {
+	// Test: Just a name and value
+	c := &cookie.Cookie{Name: "session", Value: "abc123"}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "session=abc123", c.String())
+
+	// Test: Every attribute
+	c = &cookie.Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/app",
+		Domain:      ".example.com",
+		Expires:     time.Date(2026, 10, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    cookie.SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "id=a3fWa; Path=/app; Domain=example.com; Expires=Wed, 21 Oct 2026 07:28:00 GMT; "+
+		"Max-Age=3600; HttpOnly; Secure; SameSite=None; Partitioned", c.String())
+
+	// Test: Deleting, and SameSite
+	c = &cookie.Cookie{Name: "old", MaxAge: -1, SameSite: cookie.SameSiteStrict}
+	assert.Equal(t, "old=; Max-Age=0; SameSite=Strict", c.String())
+	c = &cookie.Cookie{Name: "lax", Value: "1", SameSite: cookie.SameSiteLax}
+	assert.Equal(t, "lax=1; SameSite=Lax", c.String())
+
+	// Test: Spaces and commas get quoted
+	c = &cookie.Cookie{Name: "greeting", Value: "hello, world"}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, `greeting="hello, world"`, c.String())
+}
+
+func TestCookieValid(t *testing.T) {
+	invalid := []*cookie.Cookie{
+		{Name: "", Value: "x"},
+		{Name: "bad name", Value: "x"},
+		{Name: "semi;colon", Value: "x"},
+		{Name: "x", Value: "a;b"},
+		{Name: "x", Value: `a"b`},
+		{Name: "x", Value: "a\\b"},
+		{Name: "x", Value: "café"},
+		{Name: "x", Value: "a\r\nSet-Cookie: evil=1"},
+		{Name: "x", Path: "/a;b"},
+		{Name: "x", Path: "/a\n"},
+		{Name: "x", Domain: "exa mple.com"},
+		{Name: "x", Domain: "-example.com"},
+		{Name: "x", Domain: "example..com"},
+		{Name: "x", Expires: time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "x", SameSite: cookie.SameSiteNone},
+		{Name: "x", Partitioned: true},
+	}
+
+	for _, c := range invalid {
+		assert.Error(t, c.Valid(), "%+v", c)
+		assert.Error(t, cookie.SetCookie(headers.Headers{}, c))
+	}
+}
+
+func TestParse(t *testing.T) {
+	// Test: Pairs, quotes and junk
+	cookies := cookie.Parse(`a=1; b="two"; empty=; junk; bad name=x; c=x;y; d=caf` + "é" + `; e=5`)
+	got := map[string]string{}
+	for _, c := range cookies {
+		got[c.Name] = c.Value
+	}
+	assert.Equal(t, map[string]string{"a": "1", "b": "two", "empty": "", "c": "x", "e": "5"}, got)
+
+	// Test: Nothing
+	assert.Empty(t, cookie.Parse(""))
+}
+
+func TestSetCookie(t *testing.T) {
+	// Test: Each cookie goes out on its own header line
+	h := response.GetDefaultHeaders(0)
+	require.NoError(t, cookie.SetCookie(h, &cookie.Cookie{Name: "a", Value: "1", Expires: time.Date(2026, 10, 21, 7, 28, 0, 0, time.UTC)}))
+	require.NoError(t, cookie.SetCookie(h, &cookie.Cookie{Name: "b", Value: "2", HttpOnly: true}))
+
+	server, client := net.Pipe()
+	go func() {
+		w := response.NewWriter(server)
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		server.Close()
+	}()
+
+	br := bufio.NewReader(client)
+	setCookies := []string{}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		if value, found := strings.CutPrefix(line, "Set-Cookie: "); found {
+			setCookies = append(setCookies, strings.TrimSpace(value))
+		}
+	}
+	assert.ElementsMatch(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2; HttpOnly"}, setCookies)
+}
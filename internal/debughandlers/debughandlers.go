@@ -0,0 +1,421 @@
+// Package debughandlers is a local stand-in for the parts of https://httpbin.org
+// we use, so the proxy can be tested without network access.
+package debughandlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+// Upper bounds, so nobody can ask us to sleep or allocate forever
+const (
+	maxDelay       = 10 * time.Second
+	maxStreamLines = 100
+	maxBytes       = 100 * 1024
+	maxRedirects   = 100
+)
+
+// Handler routes the request to one of the endpoints below, like a server.HandlerFunc.
+//
+//	/get /post /anything/...  echo the request as JSON
+//	/headers /ip              parts of the same echo
+//	/status/{code}            respond with that status
+//	/delay/{n}                wait n seconds, then echo
+//	/stream/{n}               n JSON lines, chunked
+//	/bytes/{n}                n random bytes (?seed= makes them repeatable)
+//	/drip                     numbytes bytes spread over duration seconds
+//	/redirect/{n}             n redirects ending at /get
+//	/gzip                     gzip compressed echo
+func Handler(w *response.Writer, req *request.Request) {
+	u, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		writeText(w, response.StatusBadRequest, "invalid request target\n")
+		return
+	}
+
+	path := u.Path
+	method := req.RequestLine.Method
+
+	switch {
+	case path == "/get":
+		if method != "GET" && method != "HEAD" {
+			writeText(w, response.StatusMethodNotAllowed, "method not allowed\n")
+			return
+		}
+		writeJSON(w, response.StatusOk, echo(req, u, false))
+
+	case path == "/post":
+		if method != "POST" {
+			writeText(w, response.StatusMethodNotAllowed, "method not allowed\n")
+			return
+		}
+		writeJSON(w, response.StatusOk, echo(req, u, true))
+
+	case path == "/anything" || strings.HasPrefix(path, "/anything/"):
+		writeJSON(w, response.StatusOk, echo(req, u, true))
+
+	case path == "/headers":
+		writeJSON(w, response.StatusOk, map[string]any{"headers": canonicalHeaders(req.Headers)})
+
+	case path == "/ip":
+		writeJSON(w, response.StatusOk, map[string]any{"origin": origin(req)})
+
+	case strings.HasPrefix(path, "/status/"):
+		status(w, strings.TrimPrefix(path, "/status/"))
+
+	case strings.HasPrefix(path, "/delay/"):
+		delay(w, req, u, strings.TrimPrefix(path, "/delay/"))
+
+	case strings.HasPrefix(path, "/stream/"):
+		stream(w, req, u, strings.TrimPrefix(path, "/stream/"))
+
+	case strings.HasPrefix(path, "/bytes/"):
+		randomBytes(w, u, strings.TrimPrefix(path, "/bytes/"))
+
+	case path == "/drip":
+		drip(w, req, u)
+
+	case strings.HasPrefix(path, "/redirect/"):
+		redirect(w, strings.TrimPrefix(path, "/redirect/"))
+
+	case path == "/gzip":
+		gzipped(w, req)
+
+	default:
+		writeText(w, response.StatusNotFound, "404 Not Found\n")
+	}
+}
+
+// Builds the JSON document httpbin returns for /get, /post and /anything
+func echo(req *request.Request, u *url.URL, withBody bool) map[string]any {
+	doc := map[string]any{
+		"args":    flatten(u.Query()),
+		"headers": canonicalHeaders(req.Headers),
+		"origin":  origin(req),
+		"url":     fullURL(req, u),
+	}
+
+	if !withBody {
+		return doc
+	}
+
+	doc["method"] = req.RequestLine.Method
+	doc["data"] = string(req.Body)
+	doc["form"] = map[string]any{}
+	doc["files"] = map[string]any{}
+	doc["json"] = nil
+
+	contentType := req.Headers.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		if req.ParseForm() == nil {
+			doc["form"] = flatten(req.PostForm)
+			doc["data"] = ""
+		}
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		if req.ParseMultipartForm(request.MultipartLimits{}) == nil {
+			doc["form"] = flatten(url.Values(req.MultipartForm.Value))
+			doc["files"] = files(req.MultipartForm)
+			doc["data"] = ""
+		}
+	case json.Valid(req.Body):
+		var v any
+		json.Unmarshal(req.Body, &v)
+		doc["json"] = v
+	}
+
+	return doc
+}
+
+// Uploaded files by field name, with their content as text like httpbin does
+func files(form *request.MultipartForm) map[string]any {
+	out := map[string]any{}
+	for name, fhs := range form.File {
+		f, err := fhs[0].Open()
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		out[name] = string(data)
+	}
+	return out
+}
+
+func status(w *response.Writer, arg string) {
+	code, err := strconv.Atoi(arg)
+	if err != nil || code < 100 || code > 999 {
+		writeText(w, response.StatusBadRequest, "invalid status code\n")
+		return
+	}
+
+	h := headers.Headers{}
+
+	switch {
+	case code == 304 || code == 204 || code < 200:
+		// These never have a body, not even an empty one
+	case code >= 300 && code < 400:
+		h["Location"] = "/redirect/1"
+		h["Content-Length"] = "0"
+	default:
+		h["Content-Length"] = "0"
+	}
+
+	w.WriteStatusLine(response.StatusCode(code))
+	w.WriteHeaders(h)
+}
+
+func delay(w *response.Writer, req *request.Request, u *url.URL, arg string) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || seconds < 0 {
+		writeText(w, response.StatusBadRequest, "invalid delay\n")
+		return
+	}
+
+	d := min(time.Duration(seconds*float64(time.Second)), maxDelay)
+
+	if !sleep(req.Context().Done(), d) {
+		// Nobody is waiting for the answer anymore
+		return
+	}
+
+	writeJSON(w, response.StatusOk, echo(req, u, true))
+}
+
+func stream(w *response.Writer, req *request.Request, u *url.URL, arg string) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		writeText(w, response.StatusBadRequest, "invalid number of lines\n")
+		return
+	}
+	n = min(n, maxStreamLines)
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(headers.Headers{
+		"Content-Type":      "application/json",
+		"Transfer-Encoding": "chunked",
+	})
+
+	doc := echo(req, u, false)
+	for i := 0; i < n; i++ {
+		doc["id"] = i
+		line, _ := json.Marshal(doc)
+
+		_, err := w.WriteChunkedBody(append(line, '\n'))
+		if err != nil || req.Context().Err() != nil {
+			return
+		}
+	}
+
+	w.WriteChunkedBodyDone(nil)
+}
+
+func randomBytes(w *response.Writer, u *url.URL, arg string) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		writeText(w, response.StatusBadRequest, "invalid number of bytes\n")
+		return
+	}
+	n = min(n, maxBytes)
+
+	seed := time.Now().UnixNano()
+	if s := u.Query().Get("seed"); s != "" {
+		seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeText(w, response.StatusBadRequest, "invalid seed\n")
+			return
+		}
+	}
+
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	writeBody(w, response.StatusOk, "application/octet-stream", data)
+}
+
+// /drip?duration=2&numbytes=10&code=200&delay=0
+func drip(w *response.Writer, req *request.Request, u *url.URL) {
+	q := u.Query()
+
+	duration, err1 := floatParam(q, "duration", 2)
+	numBytes, err2 := floatParam(q, "numbytes", 10)
+	code, err3 := floatParam(q, "code", 200)
+	initialDelay, err4 := floatParam(q, "delay", 0)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil ||
+		duration < 0 || numBytes < 0 || initialDelay < 0 || code < 100 || code > 999 {
+		writeText(w, response.StatusBadRequest, "invalid drip parameters\n")
+		return
+	}
+
+	n := min(int(numBytes), maxBytes)
+	total := min(time.Duration((duration+initialDelay)*float64(time.Second)), maxDelay)
+	wait := min(time.Duration(initialDelay*float64(time.Second)), total)
+
+	ctx := req.Context()
+	if !sleep(ctx.Done(), wait) {
+		return
+	}
+
+	w.WriteStatusLine(response.StatusCode(code))
+	w.WriteHeaders(headers.Headers{
+		"Content-Type":      "application/octet-stream",
+		"Transfer-Encoding": "chunked",
+	})
+
+	var pause time.Duration
+	if n > 0 {
+		pause = (total - wait) / time.Duration(n)
+	}
+
+	for i := 0; i < n; i++ {
+		_, err := w.WriteChunkedBody([]byte("*"))
+		if err != nil {
+			return
+		}
+		if !sleep(ctx.Done(), pause) {
+			return
+		}
+	}
+
+	w.WriteChunkedBodyDone(nil)
+}
+
+func redirect(w *response.Writer, arg string) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > maxRedirects {
+		writeText(w, response.StatusBadRequest, "invalid number of redirects\n")
+		return
+	}
+
+	location := "/get"
+	if n > 1 {
+		location = fmt.Sprintf("/redirect/%d", n-1)
+	}
+
+	w.WriteStatusLine(response.StatusFound)
+	w.WriteHeaders(headers.Headers{
+		"Location":       location,
+		"Content-Length": "0",
+	})
+}
+
+func gzipped(w *response.Writer, req *request.Request) {
+	doc := map[string]any{
+		"gzipped": true,
+		"headers": canonicalHeaders(req.Headers),
+		"method":  req.RequestLine.Method,
+		"origin":  origin(req),
+	}
+	data, _ := json.MarshalIndent(doc, "", "  ")
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+
+	w.WriteStatusLine(response.StatusOk)
+	h := response.GetDefaultHeaders(buf.Len())
+	h["Content-Type"] = "application/json"
+	h["Content-Encoding"] = "gzip"
+	w.WriteHeaders(h)
+	w.WriteBody(buf.Bytes())
+}
+
+func writeJSON(w *response.Writer, status response.StatusCode, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeText(w, response.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeBody(w, status, "application/json", append(data, '\n'))
+}
+
+func writeText(w *response.Writer, status response.StatusCode, msg string) {
+	writeBody(w, status, "text/plain", []byte(msg))
+}
+
+func writeBody(w *response.Writer, status response.StatusCode, contentType string, body []byte) {
+	w.WriteStatusLine(status)
+	h := response.GetDefaultHeaders(len(body))
+	h["Content-Type"] = contentType
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// Header names as httpbin prints them ("User-Agent" instead of our lowercase "user-agent")
+func canonicalHeaders(h headers.Headers) map[string]string {
+	out := make(map[string]string, len(h))
+	for key, value := range h {
+		out[textproto.CanonicalMIMEHeaderKey(key)] = value
+	}
+	return out
+}
+
+// Single values as strings and repeated ones as lists, like httpbin does
+func flatten(values url.Values) map[string]any {
+	out := make(map[string]any, len(values))
+	for key, v := range values {
+		if len(v) == 1 {
+			out[key] = v[0]
+		} else {
+			out[key] = v
+		}
+	}
+	return out
+}
+
+func origin(req *request.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func fullURL(req *request.Request, u *url.URL) string {
+	host := req.Headers.Get("Host")
+	if host == "" {
+		host = "localhost"
+	}
+	return "http://" + host + u.RequestURI()
+}
+
+func floatParam(q url.Values, key string, def float64) (float64, error) {
+	v := q.Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// Waits for d, returns false if done was closed first.
+func sleep(done <-chan struct{}, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,193 @@
+package debughandlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Doesn't follow redirects, so the tests see them
+var client = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func getJSON(t *testing.T, res *http.Response) map[string]any {
+	defer res.Body.Close()
+	doc := map[string]any{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&doc))
+	return doc
+}
+
+func TestEcho(t *testing.T) {
+	s := servertest.NewServer(Handler)
+	defer s.Close()
+	base := s.URL
+
+	// Test: /get echoes args and headers
+	req, _ := http.NewRequest("GET", base+"/get?a=1&b=2&b=3", nil)
+	req.Header.Set("X-Test", "hola")
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	doc := getJSON(t, res)
+	assert.Equal(t, map[string]any{"a": "1", "b": []any{"2", "3"}}, doc["args"])
+	assert.Equal(t, "hola", doc["headers"].(map[string]any)["X-Test"])
+	assert.Equal(t, "127.0.0.1", doc["origin"])
+
+	// Test: /post with a JSON body
+	res, err = client.Post(base+"/post", "application/json", strings.NewReader(`{"coffee":true}`))
+	require.NoError(t, err)
+	doc = getJSON(t, res)
+	assert.Equal(t, map[string]any{"coffee": true}, doc["json"])
+	assert.Equal(t, "POST", doc["method"])
+
+	// Test: /anything with a form
+	req, _ = http.NewRequest("PUT", base+"/anything/deep/path", strings.NewReader("x=1&y=2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	doc = getJSON(t, res)
+	assert.Equal(t, map[string]any{"x": "1", "y": "2"}, doc["form"])
+	assert.Equal(t, "PUT", doc["method"])
+
+	// Test: /post with a multipart form and a file
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("name", "Jo")
+	fw, _ := mw.CreateFormFile("doc", "notes.txt")
+	fw.Write([]byte("remember the milk"))
+	mw.Close()
+	res, err = client.Post(base+"/post", mw.FormDataContentType(), &buf)
+	require.NoError(t, err)
+	doc = getJSON(t, res)
+	assert.Equal(t, map[string]any{"name": "Jo"}, doc["form"])
+	assert.Equal(t, map[string]any{"doc": "remember the milk"}, doc["files"])
+
+	// Test: /get refuses POST
+	res, err = client.Post(base+"/get", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 405, res.StatusCode)
+}
+
+func TestEndpoints(t *testing.T) {
+	s := servertest.NewServer(Handler)
+	defer s.Close()
+	base := s.URL
+
+	// Test: /status/{code}
+	res, err := client.Get(base + "/status/418")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 418, res.StatusCode)
+
+	// Test: /stream/{n}
+	res, err = client.Get(base + "/stream/3")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(body)), "\n"), 3)
+
+	// Test: /bytes/{n} with a seed is repeatable
+	res, err = client.Get(base + "/bytes/64?seed=7")
+	require.NoError(t, err)
+	first, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	res, err = client.Get(base + "/bytes/64?seed=7")
+	require.NoError(t, err)
+	second, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Len(t, first, 64)
+	assert.Equal(t, first, second)
+
+	// Test: /drip
+	res, err = client.Get(base + "/drip?duration=0.05&numbytes=5&code=201")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "*****", string(body))
+
+	// Test: /redirect/{n}
+	res, err = client.Get(base + "/redirect/3")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 302, res.StatusCode)
+	assert.Equal(t, "/redirect/2", res.Header.Get("Location"))
+	res, err = client.Get(base + "/redirect/1")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "/get", res.Header.Get("Location"))
+
+	// Test: /gzip (the client decompresses it for us)
+	res, err = client.Get(base + "/gzip")
+	require.NoError(t, err)
+	doc := getJSON(t, res)
+	assert.True(t, res.Uncompressed)
+	assert.Equal(t, true, doc["gzipped"])
+
+	// Test: /ip and /headers
+	res, err = client.Get(base + "/ip")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", getJSON(t, res)["origin"])
+	res, err = client.Get(base + "/headers")
+	require.NoError(t, err)
+	assert.Contains(t, getJSON(t, res)["headers"], "Host")
+
+	// Test: /delay/{n}
+	res, err = client.Get(base + "/delay/0.01")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: Unknown path
+	res, err = client.Get(base + "/nope")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestPipelining(t *testing.T) {
+	s := servertest.NewServer(Handler)
+	defer s.Close()
+	base := s.URL
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: The handlers keep the connection open, so requests sent ahead are all answered, in order
+	_, err = conn.Write([]byte("GET /get?n=1 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /status/204 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /get?n=3 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	var statuses []int
+	var args []any
+	for {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			break
+		}
+		statuses = append(statuses, res.StatusCode)
+		if res.StatusCode == 200 {
+			args = append(args, getJSON(t, res)["args"])
+		}
+		res.Body.Close()
+	}
+	assert.Equal(t, []int{200, 204, 200}, statuses)
+	require.Len(t, args, 2)
+	assert.Equal(t, "1", args[0].(map[string]any)["n"])
+	assert.Equal(t, "3", args[1].(map[string]any)["n"])
+}
@@ -0,0 +1,103 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+// One entry of the JSON directory listing
+type dirEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Writes the contents of the directory as HTML, or as JSON if the client asks for it
+// with "Accept: application/json" or "?format=json".
+func listDirectory(w *response.Writer, req *request.Request, fsys fs.FS, name string) {
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+
+	list := make([]dirEntry, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		entry := dirEntry{Name: e.Name(), IsDir: e.IsDir(), ModTime: info.ModTime().UTC()}
+		if !e.IsDir() {
+			entry.Size = info.Size()
+		}
+		list = append(list, entry)
+	}
+
+	var body []byte
+	var ctype string
+
+	if wantsJSON(req) {
+		body, _ = json.MarshalIndent(list, "", "  ")
+		body = append(body, '\n')
+		ctype = "application/json"
+	} else {
+		body = []byte(dirHTML(req, list))
+		ctype = "text/html; charset=utf-8"
+	}
+
+	h := response.GetDefaultHeaders(len(body))
+	h["Content-Type"] = ctype
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(h)
+
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+func wantsJSON(req *request.Request) bool {
+	if strings.Contains(req.Headers.Get("Accept"), "application/json") {
+		return true
+	}
+
+	u, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	return err == nil && u.Query().Get("format") == "json"
+}
+
+func dirHTML(req *request.Request, list []dirEntry) string {
+	title := "Index"
+	if u, err := url.ParseRequestURI(req.RequestLine.RequestTarget); err == nil {
+		title = "Index of " + u.Path
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<html>\n  <head>\n    <title>%s</title>\n  </head>\n  <body>\n", html.EscapeString(title))
+	fmt.Fprintf(&sb, "    <h1>%s</h1>\n    <ul>\n", html.EscapeString(title))
+
+	for _, e := range list {
+		name := e.Name
+		if e.IsDir {
+			name += "/"
+		}
+
+		// Escape for the URL first, then for the HTML attribute
+		link := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&sb, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(name))
+	}
+
+	sb.WriteString("    </ul>\n  </body>\n</html>\n")
+
+	return sb.String()
+}
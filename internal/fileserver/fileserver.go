@@ -0,0 +1,444 @@
+// Package fileserver serves files from a directory on disk or from any fs.FS
+// (like an embed.FS), with content type detection and directory listings.
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/conditional"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// How many bytes we look at to guess the content type when the extension doesn't tell us
+const sniffLen = 512
+
+// FileServer returns a handler that serves the files under root, using the request path.
+// Requests can't leave root, neither with ".." nor by following a symlink that points outside.
+func FileServer(root string) server.HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		// os.Root refuses any path, symlinks included, that resolves outside the directory
+		r, err := os.OpenRoot(root)
+		if err != nil {
+			writeError(w, response.StatusInternalServerError)
+			return
+		}
+		defer r.Close()
+
+		serve(w, req, r.FS())
+	}
+}
+
+// FileServerFS is like FileServer for an fs.FS, for example one embedded in the binary.
+func FileServerFS(fsys fs.FS) server.HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		serve(w, req, fsys)
+	}
+}
+
+// ServeFile answers the request with a single file from disk, whatever the request path is.
+func ServeFile(w *response.Writer, req *request.Request, filename string) {
+	if !allowedMethod(w, req) {
+		return
+	}
+
+	dir, name := filepath.Split(filepath.Clean(filename))
+	if dir == "" {
+		dir = "."
+	}
+
+	r, err := os.OpenRoot(dir)
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+	defer r.Close()
+
+	serveName(w, req, r.FS(), name, false)
+}
+
+func serve(w *response.Writer, req *request.Request, fsys fs.FS) {
+	if !allowedMethod(w, req) {
+		return
+	}
+
+	u, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		writeError(w, response.StatusBadRequest)
+		return
+	}
+
+	// u.Path is already decoded, so %2e%2e shows up here as ".." too
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == ".." {
+			writeError(w, response.StatusForbidden)
+			return
+		}
+	}
+	if strings.ContainsAny(u.Path, "\x00\\") {
+		writeError(w, response.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		writeError(w, response.StatusBadRequest)
+		return
+	}
+
+	// Directories are always addressed with a trailing slash, so relative links in them work
+	wantsDir := strings.HasSuffix(u.Path, "/")
+
+	serveName(w, req, fsys, name, wantsDir)
+}
+
+// Serves name from fsys: the file itself, the directory's index.html or a listing.
+func serveName(w *response.Writer, req *request.Request, fsys fs.FS, name string, wantsDir bool) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, statusForError(err))
+		return
+	}
+
+	if info.IsDir() {
+		target := req.RequestLine.RequestTarget
+		if !wantsDir {
+			redirect(w, relativeDir(target))
+			return
+		}
+
+		index, err := fsys.Open(path.Join(name, "index.html"))
+		if err == nil {
+			defer index.Close()
+			indexInfo, err := index.Stat()
+			if err == nil && !indexInfo.IsDir() {
+				serveContent(w, req, "index.html", indexInfo, index)
+				return
+			}
+		}
+
+		listDirectory(w, req, fsys, name)
+		return
+	}
+
+	// A file asked for as a directory doesn't exist
+	if wantsDir {
+		writeError(w, response.StatusNotFound)
+		return
+	}
+
+	serveContent(w, req, info.Name(), info, f)
+}
+
+// Writes the file, through ServeContent if it can seek.
+func serveContent(w *response.Writer, req *request.Request, name string, info fs.FileInfo, f fs.File) {
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			writeError(w, response.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	h := headers.Headers{
+		"ETag": conditional.ModTimeETag(info.ModTime(), info.Size(), false),
+	}
+
+	ServeContent(w, req, name, info.ModTime(), content, h)
+}
+
+// ServeContent answers the request with content, which can be anything that seeks:
+// a file, a bytes.Reader, a section of something bigger...
+// Conditional requests are answered with 304 or 412 using the ETag in h and modtime
+// (either can be missing). Range requests are answered with 206 Partial Content
+// (multipart/byteranges for more than one range) and If-Range is honoured.
+// name is only used to guess the content type if h doesn't have a Content-Type.
+// h holds extra response headers, like ETag; it may be nil.
+func ServeContent(w *response.Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker, h headers.Headers) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		writeError(w, response.StatusInternalServerError)
+		return
+	}
+
+	resHeaders := response.GetDefaultHeaders(0)
+	for key, value := range h {
+		resHeaders.Set(key, value)
+	}
+	resHeaders.Set("Accept-Ranges", "bytes")
+
+	etag := h.Get("ETag")
+	conditional.SetValidators(resHeaders, etag, modtime)
+
+	if !conditional.Check(w, req, true, etag, modtime, h) {
+		return
+	}
+
+	ctype := h.Get("Content-Type")
+	if ctype == "" {
+		ctype, err = sniffContentType(name, content)
+		if err != nil {
+			writeError(w, response.StatusInternalServerError)
+			return
+		}
+	}
+	resHeaders.Set("Content-Type", ctype)
+
+	var ranges []httpRange
+	rangeHeader := req.Headers.Get("Range")
+	if rangeHeader != "" && conditional.IfRange(req, etag, modtime) {
+		ranges, err = parseRange(rangeHeader, size)
+
+		switch {
+		case err == errNoOverlap:
+			body := "416 Range Not Satisfiable\n"
+			resHeaders.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			resHeaders.Set("Content-Type", "text/plain")
+			resHeaders.Set("Content-Length", strconv.Itoa(len(body)))
+			writeResponse(w, req, response.StatusRangeNotSatisfiable, resHeaders, []byte(body))
+			return
+
+		case err != nil || sumRanges(ranges) > size:
+			// A Range we don't understand is ignored, we send everything
+			ranges = nil
+		}
+	}
+
+	status := response.StatusOk
+	var sendSize int64
+	var body io.Reader
+	var startMultipart func()
+
+	switch len(ranges) {
+	case 0:
+		sendSize = size
+		_, err = content.Seek(0, io.SeekStart)
+		body = content
+
+	case 1:
+		status = response.StatusPartialContent
+		sendSize = ranges[0].length
+		resHeaders.Set("Content-Range", ranges[0].contentRange(size))
+		_, err = content.Seek(ranges[0].start, io.SeekStart)
+		body = content
+
+	default:
+		// The parts are produced on the fly through a pipe; only their total size is known up front
+		status = response.StatusPartialContent
+		boundary := multipart.NewWriter(io.Discard).Boundary()
+		sendSize, err = multipartSize(ranges, ctype, size, boundary)
+		resHeaders.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+
+		pr, pw := io.Pipe()
+		body = pr
+		startMultipart = func() {
+			go func() {
+				pw.CloseWithError(writeMultipart(pw, content, ranges, ctype, size, boundary))
+			}()
+		}
+		defer pr.Close()
+	}
+
+	if err != nil {
+		writeError(w, response.StatusInternalServerError)
+		return
+	}
+
+	resHeaders.Set("Content-Length", strconv.FormatInt(sendSize, 10))
+
+	w.WriteStatusLine(status)
+	w.WriteHeaders(resHeaders)
+
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	// Opening the file can take a while, no point sending it if the client already left
+	if req.Context().Err() != nil {
+		return
+	}
+
+	if startMultipart != nil {
+		startMultipart()
+	}
+
+	// Streamed straight from the file (sendfile when possible), never loaded in memory
+	w.WriteBodyFrom(io.LimitReader(body, sendSize))
+}
+
+// Writes status, headers and (unless it's a HEAD request) the body.
+func writeResponse(w *response.Writer, req *request.Request, status response.StatusCode, h headers.Headers, body []byte) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+// Writes a multipart/byteranges body, one part per range.
+func writeMultipart(dst io.Writer, content io.ReadSeeker, ranges []httpRange, ctype string, size int64, boundary string) error {
+	mw := multipart.NewWriter(dst)
+	mw.SetBoundary(boundary)
+
+	for _, r := range ranges {
+		part, err := mw.CreatePart(partHeader(r, ctype, size))
+		if err != nil {
+			return err
+		}
+
+		_, err = content.Seek(r.start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(part, content, r.length)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// The exact length of what writeMultipart will produce, for the Content-Length.
+func multipartSize(ranges []httpRange, ctype string, size int64, boundary string) (int64, error) {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	mw.SetBoundary(boundary)
+
+	for _, r := range ranges {
+		_, err := mw.CreatePart(partHeader(r, ctype, size))
+		if err != nil {
+			return 0, err
+		}
+		cw += countingWriter(r.length)
+	}
+
+	err := mw.Close()
+	return int64(cw), err
+}
+
+func partHeader(r httpRange, ctype string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {ctype},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+// Counts what's written to it and throws it away
+type countingWriter int64
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	*cw += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Content type from the name, or from the first bytes of content.
+// Leaves content at the start.
+func sniffContentType(name string, content io.ReadSeeker) (string, error) {
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype != "" {
+		return ctype, nil
+	}
+
+	_, err := content.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	_, err = content.Seek(0, io.SeekStart)
+	return http.DetectContentType(buf[:n]), err
+}
+
+func allowedMethod(w *response.Writer, req *request.Request) bool {
+	method := req.RequestLine.Method
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+
+	body := "405 Method Not Allowed\n"
+	h := response.GetDefaultHeaders(len(body))
+	h["Allow"] = "GET, HEAD"
+
+	w.WriteStatusLine(response.StatusMethodNotAllowed)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+
+	return false
+}
+
+// Maps the errors from opening a file to a status code.
+// Anything that isn't plainly "not there" (permissions, paths escaping the root) is a 403.
+func statusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return response.StatusNotFound
+	case errors.Is(err, fs.ErrInvalid):
+		return response.StatusBadRequest
+	default:
+		return response.StatusForbidden
+	}
+}
+
+func writeError(w *response.Writer, status response.StatusCode) {
+	body := strconv.Itoa(int(status)) + " " + response.StatusText(status) + "\n"
+
+	w.WriteStatusLine(status)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func redirect(w *response.Writer, location string) {
+	w.WriteStatusLine(response.StatusMovedPermanently)
+	w.WriteHeaders(headers.Headers{
+		"Location":       location,
+		"Content-Length": "0",
+	})
+}
+
+// The last segment of the target's path with a slash added, keeping the query
+// string. It's relative so it stays under wherever the file server is mounted:
+// under StripPrefix the target doesn't have the prefix anymore.
+func relativeDir(target string) string {
+	p, query, found := strings.Cut(target, "?")
+	dir := path.Base(p) + "/"
+	if found {
+		return dir + "?" + query
+	}
+	return dir
+}
@@ -0,0 +1,381 @@
+package fileserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Sends a raw request (so paths like /../x reach the server as they are) and reads the response.
+func do(t *testing.T, s *servertest.Server, method, target string, extraHeaders string) (*http.Response, string) {
+	conn, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n" + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	return res, string(body)
+}
+
+func TestFileServer(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "public")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "site"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hola\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "page"), []byte("<!DOCTYPE html><html></html>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "a b.md"), []byte("# a"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "site", "index.html"), []byte("<h1>home</h1>"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret.txt"), []byte("top secret"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(root, "inside.txt")))
+
+	s := servertest.NewServer(FileServer(root))
+	defer s.Close()
+
+	// Test: Plain file, content type from the extension
+	res, body := do(t, s, "GET", "/hello.txt", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "hola\n", body)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: No extension, content type is sniffed
+	res, _ = do(t, s, "GET", "/page", "")
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: HEAD has the headers but no body
+	res, body = do(t, s, "HEAD", "/hello.txt", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(5), res.ContentLength)
+	assert.Empty(t, body)
+
+	// Test: Missing file
+	res, _ = do(t, s, "GET", "/nope.txt", "")
+	assert.Equal(t, 404, res.StatusCode)
+
+	// Test: Traversal, plain and encoded
+	res, _ = do(t, s, "GET", "/../secret.txt", "")
+	assert.Equal(t, 403, res.StatusCode)
+	res, _ = do(t, s, "GET", "/docs/%2e%2e/%2e%2e/secret.txt", "")
+	assert.Equal(t, 403, res.StatusCode)
+
+	// Test: Symlink pointing outside the root
+	res, body = do(t, s, "GET", "/escape.txt", "")
+	assert.Equal(t, 403, res.StatusCode)
+	assert.NotContains(t, body, "top secret")
+
+	// Test: Symlink inside the root is fine
+	res, body = do(t, s, "GET", "/inside.txt", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "hola\n", body)
+
+	// Test: Directory without the slash is redirected
+	res, _ = do(t, s, "GET", "/docs?x=1", "")
+	assert.Equal(t, 301, res.StatusCode)
+	assert.Equal(t, "docs/?x=1", res.Header.Get("Location"))
+
+	// Test: index.html is served for the directory
+	res, body = do(t, s, "GET", "/site/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", body)
+
+	// Test: HTML listing escapes names
+	res, body = do(t, s, "GET", "/docs/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, body, `<a href="a%20b.md">a b.md</a>`)
+
+	// Test: JSON listing
+	res, body = do(t, s, "GET", "/", "Accept: application/json\r\n")
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var list []dirEntry
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	names := []string{}
+	for _, e := range list {
+		names = append(names, e.Name)
+	}
+	assert.Contains(t, names, "docs")
+	assert.Contains(t, names, "hello.txt")
+
+	// Test: Only GET and HEAD
+	res, _ = do(t, s, "POST", "/hello.txt", "")
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+}
+
+func TestFileServerFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.js":          {Data: []byte("console.log(1)")},
+		"img/logo":        {Data: []byte("\x89PNG\r\n\x1a\n0000")},
+		"img/index.html":  {Data: []byte("gallery")},
+		"other/data.json": {Data: []byte("{}")},
+	}
+
+	s := servertest.NewServer(server.StripPrefix("/static", FileServerFS(fsys)))
+	defer s.Close()
+
+	// Test: File from the fs.FS
+	res, body := do(t, s, "GET", "/static/app.js", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "console.log(1)", body)
+	assert.Contains(t, res.Header.Get("Content-Type"), "javascript")
+
+	// Test: Sniffed binary type
+	res, _ = do(t, s, "GET", "/static/img/logo", "")
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+
+	// Test: Index in a directory
+	_, body = do(t, s, "GET", "/static/img/", "")
+	assert.Equal(t, "gallery", body)
+
+	// Test: The slash redirect stays under the prefix
+	res, _ = do(t, s, "GET", "/static/img?x=1", "")
+	assert.Equal(t, 301, res.StatusCode)
+	assert.Equal(t, "img/?x=1", res.Header.Get("Location"))
+	u, err := url.Parse("http://localhost/static/img?x=1")
+	require.NoError(t, err)
+	loc, err := u.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	_, body = do(t, s, "GET", loc.RequestURI(), "")
+	assert.Equal(t, "gallery", body)
+
+	// Test: Outside the prefix
+	res, _ = do(t, s, "GET", "/app.js", "")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestParseRange(t *testing.T) {
+	// Test: Single, open ended and suffix ranges
+	ranges, err := parseRange("bytes=0-4, 95-, -3", 100)
+	require.NoError(t, err)
+	assert.Equal(t, []httpRange{{0, 5}, {95, 5}, {97, 3}}, ranges)
+
+	// Test: End past the size is clamped
+	ranges, err = parseRange("bytes=90-200", 100)
+	require.NoError(t, err)
+	assert.Equal(t, []httpRange{{90, 10}}, ranges)
+
+	// Test: Ranges past the end are dropped, the rest survive
+	ranges, err = parseRange("bytes=500-600, 0-0", 100)
+	require.NoError(t, err)
+	assert.Equal(t, []httpRange{{0, 1}}, ranges)
+
+	// Test: Nothing satisfiable
+	_, err = parseRange("bytes=100-", 100)
+	assert.ErrorIs(t, err, errNoOverlap)
+
+	// Test: Malformed
+	_, err = parseRange("bytes=5-1", 100)
+	assert.Error(t, err)
+	_, err = parseRange("lines=1-2", 100)
+	assert.Error(t, err)
+	_, err = parseRange("bytes=abc", 100)
+	assert.Error(t, err)
+
+	// Test: No ranges at all is malformed too, not unsatisfiable
+	for _, h := range []string{"bytes=", "bytes= , ,"} {
+		_, err = parseRange(h, 100)
+		assert.Error(t, err, h)
+		assert.NotErrorIs(t, err, errNoOverlap, h)
+	}
+}
+
+func TestServeContentRanges(t *testing.T) {
+	content := "0123456789abcdefghij"
+	modtime := time.Date(2025, 7, 22, 10, 0, 0, 0, time.UTC)
+
+	s := servertest.NewServer(func(w *response.Writer, req *request.Request) {
+		ServeContent(w, req, "data.txt", modtime, strings.NewReader(content), headers.Headers{"ETag": `"v1"`})
+	})
+	defer s.Close()
+
+	// Test: No Range, everything and Accept-Ranges
+	res, body := do(t, s, "GET", "/", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	assert.Equal(t, content, body)
+
+	// Test: Single range
+	res, body = do(t, s, "GET", "/", "Range: bytes=2-5\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, "bytes 2-5/20", res.Header.Get("Content-Range"))
+	assert.Equal(t, "2345", body)
+
+	// Test: Suffix range
+	_, body = do(t, s, "GET", "/", "Range: bytes=-3\r\n")
+	assert.Equal(t, "hij", body)
+
+	// Test: Multiple ranges come back as multipart/byteranges
+	res, body = do(t, s, "GET", "/", "Range: bytes=0-1, 10-11\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	parts := []string{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(data))
+		assert.Equal(t, "text/plain; charset=utf-8", p.Header.Get("Content-Type"))
+	}
+	assert.Equal(t, []string{"bytes 0-1/20 01", "bytes 10-11/20 ab"}, parts)
+
+	// Test: Unsatisfiable
+	res, _ = do(t, s, "GET", "/", "Range: bytes=50-60\r\n")
+	assert.Equal(t, 416, res.StatusCode)
+	assert.Equal(t, "bytes */20", res.Header.Get("Content-Range"))
+
+	// Test: Malformed Range is ignored
+	res, body = do(t, s, "GET", "/", "Range: bytes=9-2\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, content, body)
+	res, body = do(t, s, "GET", "/", "Range: bytes=\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, content, body)
+
+	// Test: If-Range with the current ETag honours the Range
+	res, _ = do(t, s, "GET", "/", "Range: bytes=0-0\r\nIf-Range: \"v1\"\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+
+	// Test: If-Range with an old ETag sends everything
+	res, _ = do(t, s, "GET", "/", "Range: bytes=0-0\r\nIf-Range: \"v0\"\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: If-Range with a weak ETag never matches
+	res, _ = do(t, s, "GET", "/", "Range: bytes=0-0\r\nIf-Range: W/\"v1\"\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+
+	// Test: If-Range with the modification date
+	res, _ = do(t, s, "GET", "/", "Range: bytes=0-0\r\nIf-Range: "+modtime.Format(http.TimeFormat)+"\r\n")
+	assert.Equal(t, 206, res.StatusCode)
+	res, _ = do(t, s, "GET", "/", "Range: bytes=0-0\r\nIf-Range: "+modtime.Add(-time.Hour).Format(http.TimeFormat)+"\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestConditionalGet(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "app.css"), []byte("body{}"), 0o644))
+	s := servertest.NewServer(FileServer(root))
+	defer s.Close()
+
+	// Test: Validators on the first response
+	res, _ := do(t, s, "GET", "/app.css", "")
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, lastModified)
+
+	// Test: Revalidating with the ETag
+	res, body := do(t, s, "GET", "/app.css", "If-None-Match: "+etag+"\r\n")
+	assert.Equal(t, 304, res.StatusCode)
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+	assert.Empty(t, body)
+
+	// Test: Revalidating with the date
+	res, _ = do(t, s, "GET", "/app.css", "If-Modified-Since: "+lastModified+"\r\n")
+	assert.Equal(t, 304, res.StatusCode)
+
+	// Test: Stale ETag gets the file
+	res, body = do(t, s, "GET", "/app.css", "If-None-Match: \"old\"\r\n")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "body{}", body)
+
+	// Test: If-Match with a stale ETag
+	res, _ = do(t, s, "GET", "/app.css", "If-Match: \"old\"\r\n")
+	assert.Equal(t, 412, res.StatusCode)
+}
+
+// A connection that notes whether the body went through its ReadFrom (sendfile)
+type readFromSpy struct {
+	*net.TCPConn
+	readFrom bool
+}
+
+func (c *readFromSpy) ReadFrom(r io.Reader) (int64, error) {
+	c.readFrom = true
+	return c.TCPConn.ReadFrom(r)
+}
+
+func TestServeContentSendfile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "big.bin")
+	data := []byte(strings.Repeat("0123456789", 100<<10))
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	serve := func(req *request.Request) (*readFromSpy, *http.Response, []byte) {
+		client, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		spy := &readFromSpy{TCPConn: conn.(*net.TCPConn)}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer conn.Close()
+			f, err := os.Open(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			ServeContent(response.NewWriter(spy), req, "big.bin", time.Now(), f, nil)
+		}()
+
+		res, err := http.ReadResponse(bufio.NewReader(client), nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		<-done
+		return spy, res, body
+	}
+
+	// Test: The whole file goes out through the connection's ReadFrom
+	spy, res, body := serve(servertest.NewRequest("GET", "/big.bin", nil))
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, data, body)
+	assert.True(t, spy.readFrom)
+
+	// Test: So does a single range
+	req := servertest.NewRequest("GET", "/big.bin", nil)
+	req.Headers.Set("Range", "bytes=10-29")
+	spy, res, body = serve(req)
+	assert.Equal(t, 206, res.StatusCode)
+	assert.Equal(t, data[10:30], body)
+	assert.True(t, spy.readFrom)
+}
@@ -0,0 +1,111 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// More ranges than this in one request and we just send the whole thing
+const maxRanges = 100
+
+// Returned by parseRange when none of the ranges overlaps the content
+var errNoOverlap = errors.New("range: no range overlaps the content")
+
+// A byte range, already resolved against the size of the content
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// Parses a Range header like "bytes=0-499, 1000-, -200" for content of the given size.
+// Ranges that start past the end are dropped; if that leaves nothing, errNoOverlap is returned.
+// Any other error means the header is malformed, and the Range should be ignored.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("range: unsupported unit")
+	}
+
+	specs := strings.Split(s[len(prefix):], ",")
+	if len(specs) > maxRanges {
+		return nil, errors.New("range: too many ranges")
+	}
+
+	ranges := []httpRange{}
+	empty := true
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		empty = false
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errors.New("range: invalid spec")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r httpRange
+		if first == "" {
+			// Suffix range: the last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("range: invalid suffix length")
+			}
+			if n == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = httpRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("range: invalid start")
+			}
+			if start >= size {
+				// Unsatisfiable, but the other ranges may still be fine
+				continue
+			}
+
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errors.New("range: invalid end")
+				}
+				end = min(end, size-1)
+			}
+			r = httpRange{start: start, length: end - start + 1}
+		}
+
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	// "bytes=" (or "bytes= , ,") asks for nothing at all, that's a syntax error and not a 416
+	if empty {
+		return nil, errors.New("range: no ranges")
+	}
+	if len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+
+	return ranges, nil
+}
+
+// Asking for more bytes than the whole content (lots of overlapping ranges) is either
+// silly or an attack; either way the whole content is the better answer.
+func sumRanges(ranges []httpRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
 )
@@ -10,91 +11,179 @@ type Headers map[string]string
 // Mutate the Headers by adding newly parsed key-value pairs
 // Return n (the number of bytes consumed), done (whether or not it has finished parsing headers), and err (if it encountered an error)
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	// Look for a CRLF, if it doesn't find one, assume you haven't been given enough data yet.
-	// Consume no data, return false for done, and nil for err.
-	if !strings.Contains(string(data), "\r\n") {
-		return 0, false, nil
+	name, value, n, done, err := ParseLine(data)
+	if err != nil || done || n == 0 {
+		return n, done, err
 	}
 
-	// If you do find a CRLF, but it's at the start of the data, you've found the end of the headers,
+	h.AddField(name, value)
+
+	// It's important to understand that this function will be called over and over
+	// until all the headers are parsed, and it can only parse one key/value pair at a time.
+	return n, false, nil
+}
+
+// ParseLine parses the field line at the start of data, without adding it anywhere,
+// for parsers that want the fields one by one. It returns the name (lowercase)
+// and the value, and the bytes it used, CRLF included: 0 if there isn't a whole
+// line yet. done means data starts with the empty line that ends the fields.
+func ParseLine(data []byte) (name, value string, n int, done bool, err error) {
+	// Look for the end of the line, if it doesn't find one, assume you haven't been given enough data yet.
+	// Consume no data, return false for done, and nil for err.
+	// If it's at the start of the data, you've found the end of the headers,
 	// so return the proper values immediately.
 	// Note: The Parse function should only return done=true when the data starts with a CRLF,
 	// which can't happen when it finds a new key/value pair.
-	i := strings.Index(string(data), "\r\n")
+	i := bytes.IndexByte(data, '\n')
 	if i == -1 {
-		return 0, false, nil // Wait for more data!
+		return "", "", 0, false, nil // Wait for more data!
 	}
 
-	fieldLine := string(data[:i])
+	// A bare LF could end the line for somebody else (RFC 9112, 2.2)
+	if i == 0 || data[i-1] != '\r' {
+		return "", "", 0, false, fmt.Errorf("invalid character in field line")
+	}
+
+	fieldLine := data[:i-1]
 
 	// Si es el final dels headers trobarem \r\n\r\n i l'element sera en blanc, sortim
-	if fieldLine == "" {
-		return 2, true, nil // consume just the \r\n
+	if len(fieldLine) == 0 {
+		return "", "", 2, true, nil // consume just the \r\n
 	}
 
-	// En aquest punt ja tenim una linia sencera
-	consumed := 0
-
 	// Busquem el primer ":" per dividir
-	i = strings.Index(fieldLine, ":")
-	if i < 0 {
-		return 0, false, fmt.Errorf("malformed header line [:]")
+	colon := bytes.IndexByte(fieldLine, ':')
+	if colon < 0 {
+		return "", "", 0, false, fmt.Errorf("malformed header line [:]")
 	}
 
-	key := fieldLine[:i]     // field-name
-	value := fieldLine[i+1:] // field-value
+	key := fieldLine[:colon]        // field-name
+	rawValue := fieldLine[colon+1:] // field-value
 
 	// L'ultim caracter de la primera part (la clau) no pot ser espai
 	// ("ensure there are no spaces between the colon and the key")
-	lastChar := key[len(key)-1:]
-	if lastChar == " " {
-		return 0, false, fmt.Errorf("malformed header line")
+	if len(key) == 0 || key[len(key)-1] == ' ' {
+		return "", "", 0, false, fmt.Errorf("malformed header line")
 	}
 
 	// Remove any extra whitespace from the key and value
-	key = strings.ToLower(strings.TrimSpace(key))
-	value = strings.TrimSpace(value)
+	key = bytes.TrimSpace(key)
+	rawValue = bytes.TrimSpace(rawValue)
+	if len(key) == 0 {
+		return "", "", 0, false, fmt.Errorf("malformed header line")
+	}
 
 	// Return an error if the key contains an invalid character.
 	// Valid: A-Z, a-z, 0-9 i "!, #, $, %, &, ', *, +, -, ., ^, _, `, |, ~"
-	validChars := "!#$%&'*+-.^_`|~"
 	for _, c := range key {
-		isUpper := c >= 'A' && c <= 'Z'
-		isLower := c >= 'a' && c <= 'z'
-		isDigit := c >= '0' && c <= '9'
-		isSpecial := strings.Contains(validChars, string(c))
-
-		if !isUpper && !isLower && !isDigit && !isSpecial {
-			return 0, false, fmt.Errorf("invalid character in field name")
+		if !tokenChars[c] {
+			return "", "", 0, false, fmt.Errorf("invalid character in field name")
 		}
 	}
 
-	// Assuming the format was valid (if it isn't return an error),
-	// add the key/value pair to the Headers map
-	// If a header key already exists in the map before inserting one,
-	// append the new value to the existing value, separated by a comma.
-	current, ok := h[key]
-	if ok {
-		h[key] = fmt.Sprintf("%s, %s", current, value)
-	} else {
-		h[key] = value
+	// A CR inside a value could end the line for somebody else too (RFC 9110, 5.5)
+	for _, c := range rawValue {
+		if c == '\r' || c == '\n' || c == 0 {
+			return "", "", 0, false, fmt.Errorf("invalid character in field value")
+		}
 	}
 
 	// Return the number of bytes consumed
-	consumed += len(fieldLine) + 2 // +2 per CRLF
-
-	// It's important to understand that this function will be called over and over
-	// until all the headers are parsed, and it can only parse one key/value pair at a time.
+	return lowerName(key), internValue(rawValue), i + 1, false, nil
+}
 
-	return consumed, false, nil
+// AddField adds a parsed field the way Parse does. name is used as it is (it's
+// lowercase coming from ParseLine).
+func (h Headers) AddField(name, value string) {
+	// If a header key already exists in the map before inserting one,
+	// append the new value to the existing value, separated by a comma.
+	// Empty values add nothing to a list (and a separator with nothing after it
+	// wouldn't survive being written and parsed again)
+	current, ok := h[name]
+	switch {
+	case !ok || current == "":
+		h[name] = value
+	case value != "":
+		h[name] = current + separator(name) + value
+	}
 }
 
 // Add a new .Get method to the Headers struct, it should take a key
 // and return the value for that key, keeping case insensitivity in mind.
 // No diu res de tornar error, aixi que de moment no ho fem.
+// Parsed headers have lowercase keys, but the ones we build for responses
+// usually don't ("Content-Type"), so fall back to comparing without case.
 func (h Headers) Get(key string) (value string) {
-	key = strings.ToLower(key)
-	return h[key]
+	value, _ = h.get(key)
+	return value
+}
+
+func (h Headers) get(key string) (string, bool) {
+	value, ok := h[strings.ToLower(key)]
+	if ok {
+		return value, true
+	}
+
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// Sets the header to value, replacing it whatever the case of the existing key.
+func (h Headers) Set(key, value string) {
+	h.Del(key)
+	h[key] = value
+}
+
+// Removes the header, whatever the case of its key.
+func (h Headers) Del(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
+
+// Adds value to the header, after the values it already has.
+func (h Headers) Add(key, value string) {
+	for k, current := range h {
+		if strings.EqualFold(k, key) {
+			h[k] = current + separator(key) + value
+			return
+		}
+	}
+	h[key] = value
+}
+
+// Values returns the values of the header one by one. Only Set-Cookie keeps its
+// values apart (see separator), for anything else there's just the one.
+func (h Headers) Values(key string) []string {
+	value, ok := h.get(key)
+	if !ok {
+		return nil
+	}
+	if strings.EqualFold(key, "Set-Cookie") {
+		return strings.Split(value, "\n")
+	}
+	return []string{value}
+}
+
+// How the values of a repeated header are joined.
+// Most lists use commas, but the Cookie header uses semicolons, and Set-Cookie can't
+// be joined at all (its Expires has a comma in it), so its values go one per line,
+// and WriteHeaders sends a header line for each.
+func separator(key string) string {
+	switch strings.ToLower(key) {
+	case "set-cookie":
+		return "\n"
+	case "cookie":
+		return "; "
+	}
+	return ", "
 }
 
 // Aquesta funcio s'utilitza als test pero no explica com ha de ser. A veure...
@@ -105,3 +194,14 @@ func NewHeaders() Headers {
 func OverwriteHeader(h Headers, key, value string) {
 	h[key] = value
 }
+
+// Reports whether the comma separated list in the header contains the token,
+// ignoring case. Useful for headers like "Connection: keep-alive, Upgrade".
+func (h Headers) HasToken(key, token string) bool {
+	for _, t := range strings.Split(h.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -87,3 +87,92 @@ func TestHeadersParse(t *testing.T) {
 	assert.False(t, done)
 
 }
+
+func TestHeadersGetSet(t *testing.T) {
+	// Test: Get works with parsed (lowercase) and built (any case) keys
+	h := Headers{"host": "localhost", "Content-Type": "text/html"}
+	assert.Equal(t, "localhost", h.Get("Host"))
+	assert.Equal(t, "text/html", h.Get("content-type"))
+	assert.Equal(t, "", h.Get("Accept"))
+
+	// Test: Set replaces the existing key whatever its case
+	h.Set("content-type", "application/json")
+	assert.Equal(t, Headers{"host": "localhost", "content-type": "application/json"}, h)
+
+	// Test: Del
+	h.Del("HOST")
+	assert.Equal(t, Headers{"content-type": "application/json"}, h)
+
+	// Test: HasToken
+	h = Headers{"connection": "keep-alive, Upgrade"}
+	assert.True(t, h.HasToken("Connection", "upgrade"))
+	assert.False(t, h.HasToken("Connection", "close"))
+}
+
+func TestHeadersAdd(t *testing.T) {
+	// Test: Add joins with commas, whatever the case of the key
+	h := Headers{"Vary": "Origin"}
+	h.Add("vary", "Accept-Encoding")
+	assert.Equal(t, Headers{"Vary": "Origin, Accept-Encoding"}, h)
+	assert.Equal(t, []string{"Origin, Accept-Encoding"}, h.Values("Vary"))
+
+	// Test: Set-Cookie values stay apart, commas and all
+	h.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Add("Set-Cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, h.Values("set-cookie"))
+	assert.Nil(t, h.Values("Accept"))
+
+	// Test: Repeated headers in a request
+	h = NewHeaders()
+	data := []byte("Set-Cookie: a=1, b\r\nSet-Cookie: c=3\r\nCookie: x=1\r\nCookie: y=2\r\nAccept: a\r\nAccept: b\r\n\r\n")
+	for {
+		n, done, err := h.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a=1, b", "c=3"}, h.Values("Set-Cookie"))
+	assert.Equal(t, "x=1; y=2", h.Get("Cookie"))
+	assert.Equal(t, "a, b", h.Get("Accept"))
+}
+
+func TestParseLine(t *testing.T) {
+	// Test: A field line, without adding it anywhere
+	name, value, n, done, err := ParseLine([]byte("Content-Type:  text/plain \r\nHost: x\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "content-type", name)
+	assert.Equal(t, "text/plain", value)
+	assert.Equal(t, 28, n)
+	assert.False(t, done)
+
+	// Test: Half a line is nothing yet
+	_, _, n, done, err = ParseLine([]byte("Host: loc"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: The empty line ends the fields
+	_, _, n, done, err = ParseLine([]byte("\r\nbody"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, done)
+
+	// Test: Invalid lines are errors
+	_, _, _, _, err = ParseLine([]byte("H@st: x\r\n"))
+	assert.Error(t, err)
+
+	// Test: A bare LF doesn't end a line
+	_, _, _, _, err = ParseLine([]byte("Host: x\nEvil: y\r\n"))
+	assert.Error(t, err)
+
+	// Test: Common names and values are interned, other ones are lowercased
+	data := []byte("CONTENT-TYPE: application/json\r\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		ParseLine(data)
+	})
+	assert.Equal(t, 0.0, allocs)
+	name, _, _, _, _ = ParseLine([]byte("X-Mine: 1\r\n"))
+	assert.Equal(t, "x-mine", name)
+}
@@ -0,0 +1,88 @@
+package headers
+
+// Parsing makes a new string for every name and value it finds, unless it's
+// one of these: most requests only have common names, and a few common values.
+
+// Which bytes can be in a token, like a field name (RFC 9110, 5.6.2):
+// A-Z, a-z, 0-9 and "!#$%&'*+-.^_`|~"
+var tokenChars = func() [256]bool {
+	var t [256]bool
+	for c := 'a'; c <= 'z'; c++ {
+		t[c] = true
+		t[c-'a'+'A'] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		t[c] = true
+	}
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		t[c] = true
+	}
+	return t
+}()
+
+var commonNames = internTable(
+	"accept", "accept-charset", "accept-encoding", "accept-language", "authorization",
+	"cache-control", "connection", "content-encoding", "content-length", "content-type",
+	"cookie", "date", "dnt", "expect", "forwarded", "host", "if-match", "if-modified-since",
+	"if-none-match", "if-range", "if-unmodified-since", "keep-alive", "origin", "pragma",
+	"priority", "range", "referer", "sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform",
+	"sec-fetch-dest", "sec-fetch-mode", "sec-fetch-site", "sec-fetch-user",
+	"sec-websocket-extensions", "sec-websocket-key", "sec-websocket-protocol",
+	"sec-websocket-version", "te", "trailer", "transfer-encoding", "upgrade",
+	"upgrade-insecure-requests", "user-agent", "via", "x-forwarded-for",
+	"x-forwarded-host", "x-forwarded-proto", "x-request-id",
+)
+
+var commonValues = internTable(
+	"", "*/*", "0", "1", "100-continue", "chunked", "close", "deflate", "gzip",
+	"gzip, deflate", "gzip, deflate, br", "gzip, deflate, br, zstd", "identity",
+	"keep-alive", "max-age=0", "no-cache", "trailers", "Upgrade", "websocket", "13",
+	"application/json", "application/x-www-form-urlencoded", "text/plain", "text/html",
+	"en-US,en;q=0.9", "?0", "?1", "document", "navigate", "none", "same-origin", "cors",
+)
+
+func internTable(values ...string) map[string]string {
+	t := make(map[string]string, len(values))
+	for _, v := range values {
+		t[v] = v
+	}
+	return t
+}
+
+// Longest name that's lowercased on the stack before looking it up
+const maxCommonName = 32
+
+// The name (all token chars) in lowercase, without allocating if it's a common one
+func lowerName(b []byte) string {
+	if len(b) <= maxCommonName {
+		var buf [maxCommonName]byte
+		lower := buf[:len(b)]
+		for i, c := range b {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			lower[i] = c
+		}
+		// Looking up string(bytes) in a map doesn't allocate
+		if s, ok := commonNames[string(lower)]; ok {
+			return s
+		}
+		return string(lower)
+	}
+
+	lower := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return string(lower)
+}
+
+func internValue(b []byte) string {
+	if s, ok := commonValues[string(b)]; ok {
+		return s
+	}
+	return string(b)
+}
@@ -0,0 +1,326 @@
+// Package httpadapter connects our handlers with net/http's, in both directions:
+// ToHTTPHandler runs a server.HandlerFunc under net/http, and FromHTTPHandler
+// runs an http.Handler (and all the middleware written for net/http) on our server.
+package httpadapter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// Size of the buffer the body is copied with on its way to net/http
+const copyBufferSize = 32 * 1024
+
+// ToHTTPHandler returns an http.Handler that runs h.
+//
+// h writes its response as it would on our server, into a pipe, and what comes
+// out of the other end is parsed and handed to net/http as it arrives, so
+// streamed bodies stay streamed and trailers stay trailers. A handler that
+// returns without writing a response, or leaves it half done, aborts the
+// response like a dropped connection would.
+// Handlers can hijack the connection too, if the http.ResponseWriter supports it.
+func ToHTTPHandler(h server.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		req, err := FromHTTPRequest(r)
+		if err != nil {
+			http.Error(rw, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		handlerEnd, ourEnd := net.Pipe()
+		defer ourEnd.Close()
+
+		// Hijack waits for the real connection, see splice
+		hijacked := make(chan struct{})
+		handOver := make(chan []byte)
+		defer close(handOver)
+
+		w := response.NewWriter(handlerEnd)
+		w.BeforeHijack(func() []byte {
+			// Gets the reader out of the way, whatever it's waiting for
+			ourEnd.SetReadDeadline(time.Unix(1, 0))
+			close(hijacked)
+			return <-handOver
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer req.Finish()
+
+			h(w, req)
+			if !w.Hijacked() {
+				handlerEnd.Close()
+			}
+		}()
+
+		forward(rw, r.Method, ourEnd, hijacked, done, handOver)
+	})
+}
+
+// Reads the response the handler writes to conn and passes it on to rw.
+func forward(rw http.ResponseWriter, method string, conn net.Conn, hijacked, done <-chan struct{}, handOver chan<- []byte) {
+	rr := response.NewResponseReader(conn)
+	rr.Method = method
+
+	res, err := rr.ReadHeader()
+	if err != nil {
+		select {
+		case <-hijacked:
+			// Taken over before writing anything, the connection is all theirs
+			splice(rw, conn, rr.Buffered(), handOver)
+			return
+		default:
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	// The switch happens on the real connection, with the 101 written to it as it came
+	if res.StatusLine.StatusCode == response.StatusSwitchingProtocols {
+		select {
+		case <-hijacked:
+		case <-done:
+			panic(http.ErrAbortHandler)
+		}
+		splice(rw, conn, append(headerBlock(res), rr.Buffered()...), handOver)
+		return
+	}
+
+	for _, interim := range res.Interim {
+		copyHeaders(rw.Header(), interim.Headers)
+		rw.WriteHeader(int(interim.StatusLine.StatusCode))
+		for key := range interim.Headers {
+			rw.Header().Del(key)
+		}
+	}
+
+	copyHeaders(rw.Header(), res.Headers)
+	rw.WriteHeader(int(res.StatusLine.StatusCode))
+
+	// Every write of the handler gets to the client right away, like on our server
+	flusher, _ := rw.(http.Flusher)
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := rr.Read(buf)
+		if n > 0 {
+			_, werr := rw.Write(buf[:n])
+			if werr != nil {
+				// The client is gone. Closing the pipe tells the handler
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	for key, value := range res.Trailers {
+		rw.Header().Set(http.TrailerPrefix+key, value)
+	}
+
+	// Anything it writes after its response has nowhere to go
+	conn.Close()
+	<-done
+}
+
+// Hijacks rw's connection and connects it to conn, the handler's end of the pipe
+// then talks straight to the client. prefix goes to the client first.
+func splice(rw http.ResponseWriter, conn net.Conn, prefix []byte, handOver chan<- []byte) {
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	netConn, brw, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	defer netConn.Close()
+
+	// What net/http read past the request goes to the handler, like the bytes our server buffers
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	handOver <- bytes.Clone(buffered)
+	conn.SetReadDeadline(time.Time{})
+
+	_, err = netConn.Write(prefix)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		io.Copy(conn, netConn)
+		conn.Close()
+	}()
+	io.Copy(netConn, conn)
+}
+
+// The status line and headers of res, as they were on the wire
+func headerBlock(res *response.Response) []byte {
+	block := fmt.Appendf(nil, "HTTP/%s %d %s\r\n", res.StatusLine.HttpVersion, res.StatusLine.StatusCode, res.StatusLine.ReasonPhrase)
+	for key := range res.Headers {
+		for _, value := range res.Headers.Values(key) {
+			block = fmt.Appendf(block, "%s: %s\r\n", key, value)
+		}
+	}
+	return append(block, "\r\n"...)
+}
+
+// Copies the headers of a response, except the framing, that's net/http's job now.
+func copyHeaders(dst http.Header, src headers.Headers) {
+	for key := range src {
+		switch strings.ToLower(key) {
+		case "transfer-encoding", "keep-alive":
+			continue
+		}
+		for _, value := range src.Values(key) {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// FromHTTPRequest turns r into one of our requests, the way the parser would
+// have produced it: lowercase header names, the whole body read, and the
+// trailers after it. The context is r's.
+func FromHTTPRequest(r *http.Request) (*request.Request, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+	version := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	if r.ProtoMajor == 0 {
+		version = "1.1"
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        r.Method,
+			RequestTarget: target,
+			HttpVersion:   version,
+		},
+		Headers:    headers.Headers{},
+		Body:       body,
+		Trailers:   headers.Headers{},
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	// net/http keeps these two out of Header
+	if r.Host != "" {
+		req.Headers["host"] = r.Host
+	}
+	if len(r.TransferEncoding) > 0 {
+		req.Headers["transfer-encoding"] = strings.Join(r.TransferEncoding, ", ")
+	}
+
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Headers.Add(strings.ToLower(key), value)
+		}
+	}
+	for key, values := range r.Trailer {
+		for _, value := range values {
+			req.Trailers.Add(strings.ToLower(key), value)
+		}
+	}
+
+	return req.WithContext(r.Context()), nil
+}
+
+// ToHTTPRequest turns req into an *http.Request like the ones net/http's server
+// makes: Host and Transfer-Encoding out of Header, and the body ready to read.
+// The context is req's.
+func ToHTTPRequest(req *request.Request) (*http.Request, error) {
+	target := req.RequestLine.RequestTarget
+
+	var u *url.URL
+	if target == "*" {
+		u = &url.URL{Path: "*"}
+	} else {
+		var err error
+		u, err = url.ParseRequestURI(target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	version := req.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion("HTTP/" + version)
+	if !ok {
+		return nil, fmt.Errorf("invalid http version %q", version)
+	}
+
+	r := &http.Request{
+		Method:        req.RequestLine.Method,
+		URL:           u,
+		Proto:         "HTTP/" + version,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        http.Header{},
+		Body:          http.NoBody,
+		ContentLength: int64(len(req.Body)),
+		Host:          req.Headers.Get("Host"),
+		RemoteAddr:    req.RemoteAddr,
+		RequestURI:    target,
+	}
+	if r.Host == "" {
+		r.Host = u.Host
+	}
+	if len(req.Body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(req.Body))
+	}
+
+	for key := range req.Headers {
+		switch strings.ToLower(key) {
+		case "host":
+			continue
+		case "transfer-encoding":
+			r.TransferEncoding = strings.Split(strings.ToLower(strings.ReplaceAll(req.Headers[key], " ", "")), ",")
+			continue
+		}
+		for _, value := range req.Headers.Values(key) {
+			r.Header.Add(key, value)
+		}
+	}
+
+	// That's how net/http says the length wasn't known up front
+	if slices.Contains(r.TransferEncoding, "chunked") {
+		r.ContentLength = -1
+	}
+
+	if len(req.Trailers) > 0 {
+		r.Trailer = http.Header{}
+		for key, value := range req.Trailers {
+			r.Trailer.Add(key, value)
+		}
+	}
+
+	return r.WithContext(req.Context()), nil
+}
@@ -0,0 +1,176 @@
+package httpadapter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToHTTPHandler(t *testing.T) {
+	next := make(chan struct{})
+
+	ts := httptest.NewServer(ToHTTPHandler(func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/echo?x=1":
+			body := req.RequestLine.Method + " " + req.Headers.Get("X-Test") + " " + string(req.Body)
+			w.WriteStatusLine(response.StatusCreated)
+			h := response.GetDefaultHeaders(len(body))
+			h.Add("Set-Cookie", "a=1")
+			h.Add("Set-Cookie", "b=2")
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(body))
+
+		case "/stream":
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Sum"})
+			w.WriteChunkedBody([]byte("first,"))
+			<-next
+			w.WriteChunkedBody([]byte("second"))
+			w.WriteChunkedBodyDone(headers.Headers{"X-Sum": "abc"})
+
+		case "/upgrade":
+			w.WriteStatusLine(response.StatusSwitchingProtocols)
+			w.WriteHeaders(headers.Headers{"Upgrade": "echo", "Connection": "Upgrade"})
+			conn, buffered, err := w.Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(io.MultiReader(strings.NewReader(string(buffered)), conn)).ReadString('\n')
+			conn.Write([]byte("echo: " + line))
+
+		default:
+			// Nothing at all
+		}
+	}))
+	defer ts.Close()
+
+	// Test: The request gets through, and the response comes back as it was
+	res, err := http.Post(ts.URL+"/echo?x=1", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "POST  hello", string(body))
+	assert.Equal(t, []string{"a=1", "b=2"}, res.Header.Values("Set-Cookie"))
+
+	// Test: Streamed, a piece at a time, with the trailers at the end
+	res, err = http.Get(ts.URL + "/stream")
+	require.NoError(t, err)
+	first := make([]byte, len("first,"))
+	_, err = io.ReadFull(res.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first,", string(first))
+	close(next)
+	rest, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "second", string(rest))
+	assert.Equal(t, "abc", res.Trailer.Get("X-Sum"))
+
+	// Test: No response is no response
+	_, err = http.Get(ts.URL + "/nothing")
+	assert.Error(t, err)
+
+	// Test: Hijacking, with the bytes that came along with the request
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhi there\n")
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "HTTP/1.1 101 Switching Protocols\r\n"), string(data))
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\necho: hi there\n"), string(data))
+}
+
+func TestFromHTTPHandler(t *testing.T) {
+	next := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s %d", r.Host, r.URL.Query().Get("x"), r.Header.Get("X-Test"), body, r.ContentLength)
+	})
+	mux.HandleFunc("GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		w.Write([]byte("first,"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("second"))
+		w.Header().Set("X-Sum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "yes")
+	})
+	mux.HandleFunc("GET /empty", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		_, err := w.Write([]byte("nope"))
+		assert.ErrorIs(t, err, http.ErrBodyNotAllowed)
+	})
+	mux.HandleFunc("GET /hijack", func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		line, _ := brw.ReadString('\n')
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(line), line)
+	})
+
+	s := servertest.NewServer(FromHTTPHandler(mux))
+	defer s.Close()
+	url := s.URL
+
+	// Test: The request gets through, and a short body gets a length and a type
+	req, err := http.NewRequest("POST", url+"/echo?x=1", strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Header.Set("X-Test", "yes")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, s.Addr()+" 1 yes hello 5", string(body))
+	assert.Equal(t, int64(len(body)), res.ContentLength)
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: Flushed, so streamed and chunked, with both kinds of trailers
+	res, err = http.Get(url + "/stream")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	first := make([]byte, len("first,"))
+	_, err = io.ReadFull(res.Body, first)
+	require.NoError(t, err)
+	close(next)
+	rest, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "second", string(rest))
+	assert.Equal(t, "abc", res.Trailer.Get("X-Sum"))
+	assert.Equal(t, "yes", res.Trailer.Get("X-Late"))
+
+	// Test: No body where there can't be one
+	res, err = http.Get(url + "/empty")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	// Test: Hijacking, with the bytes our server read past the request
+	conn, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\nearly line\n")
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nConnection: close\r\n\r\nearly line\n", string(data))
+}
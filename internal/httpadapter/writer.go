@@ -0,0 +1,276 @@
+package httpadapter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// How much of the body is held back before the headers go out, the same as
+// net/http. A handler that's done by then gets a Content-Length, otherwise
+// the body goes out chunked.
+const bufferSize = 2048
+
+// FromHTTPHandler returns a handler that runs h on our server.
+//
+// The http.ResponseWriter it gets behaves like net/http's: headers are sent on
+// the first Write or Flush (or when the first 2KB of body are in), the
+// Content-Type is sniffed if there isn't one, trailers can be declared with a
+// Trailer header or set with http.TrailerPrefix, and it's an http.Flusher and
+// an http.Hijacker. Interim 1xx responses other than 101 are dropped, our
+// server has read the whole request by the time h runs anyway.
+func FromHTTPHandler(h http.Handler) server.HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		r, err := ToHTTPRequest(req)
+		if err != nil {
+			body := "400 Bad Request\n"
+			w.WriteStatusLine(response.StatusBadRequest)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+			return
+		}
+
+		rw := &responseWriter{
+			w:             w,
+			method:        r.Method,
+			header:        http.Header{},
+			contentLength: -1,
+		}
+		h.ServeHTTP(rw, r)
+		rw.finish()
+	}
+}
+
+// The http.ResponseWriter for FromHTTPHandler, on top of a response.Writer
+type responseWriter struct {
+	w      *response.Writer
+	method string
+	header http.Header
+
+	// The status, and the headers as they were when it was set
+	status   int
+	snapshot http.Header
+
+	// Whether the headers went out, and how the body is framed
+	sent    bool
+	chunked bool
+
+	// The start of the body, until the headers go out
+	buf []byte
+
+	// From the handler's Content-Length (-1 if it didn't set one), and how much it has written
+	contentLength int64
+	written       int64
+
+	hijacked bool
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.hijacked || rw.status != 0 {
+		return
+	}
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		return
+	}
+
+	rw.status = code
+	// Like net/http, changes to the headers after this don't count (except for trailers)
+	rw.snapshot = rw.header.Clone()
+
+	if cl := rw.snapshot.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err == nil && n >= 0 {
+			rw.contentLength = n
+		}
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(rw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if rw.contentLength >= 0 && rw.written+int64(len(p)) > rw.contentLength {
+		return 0, http.ErrContentLength
+	}
+	rw.written += int64(len(p))
+
+	if rw.sent {
+		return len(p), rw.writeBody(p)
+	}
+
+	rw.buf = append(rw.buf, p...)
+	if len(rw.buf) < bufferSize {
+		return len(p), nil
+	}
+	return len(p), rw.sendHeaders(false)
+}
+
+// Flush sends the headers, if they haven't gone out yet, and whatever body is held back.
+func (rw *responseWriter) Flush() {
+	if rw.hijacked {
+		return
+	}
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.sent {
+		rw.sendHeaders(false)
+	}
+}
+
+// Hijack hands over the connection. The bufio.Reader has the bytes our server
+// read past the end of the request in front of the connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+
+	// A response that was started goes out before the connection does
+	if rw.status != 0 && !rw.sent {
+		rw.sendHeaders(false)
+	}
+
+	conn, buffered, err := rw.w.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.hijacked = true
+
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	return conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil
+}
+
+// Sends the headers, and the body held back so far. final means the handler is
+// done, so the length of the body is known.
+func (rw *responseWriter) sendHeaders(final bool) error {
+	h := headers.Headers{}
+	for key, values := range rw.snapshot {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		for _, value := range values {
+			h.Add(key, value)
+		}
+	}
+
+	body := bodyAllowed(rw.status)
+
+	// nil means no Content-Type at all
+	if _, ok := rw.snapshot["Content-Type"]; !ok && body && len(rw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(rw.buf))
+	}
+
+	switch {
+	case !body || rw.contentLength >= 0:
+	case final && !rw.hasTrailers():
+		// Nothing was written to a HEAD, it doesn't mean the body is empty
+		if rw.method != "HEAD" || rw.written > 0 {
+			h.Set("Content-Length", strconv.FormatInt(rw.written, 10))
+		}
+	case rw.method != "HEAD":
+		h.Set("Transfer-Encoding", "chunked")
+		rw.chunked = true
+	}
+
+	err := rw.w.WriteStatusLine(response.StatusCode(rw.status))
+	if err != nil {
+		return err
+	}
+	err = rw.w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	rw.sent = true
+
+	buf := rw.buf
+	rw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	return rw.writeBody(buf)
+}
+
+func (rw *responseWriter) writeBody(p []byte) error {
+	if rw.method == "HEAD" {
+		return nil
+	}
+	var err error
+	if rw.chunked {
+		_, err = rw.w.WriteChunkedBody(p)
+	} else {
+		_, err = rw.w.WriteBody(p)
+	}
+	return err
+}
+
+// Ends the response once the handler returns.
+func (rw *responseWriter) finish() {
+	if rw.hijacked {
+		return
+	}
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.sent {
+		rw.sendHeaders(true)
+	}
+	if rw.chunked {
+		rw.w.WriteChunkedBodyDone(rw.trailers())
+	}
+}
+
+// Whether the handler declared trailers, or set some with http.TrailerPrefix
+func (rw *responseWriter) hasTrailers() bool {
+	if rw.snapshot.Get("Trailer") != "" {
+		return true
+	}
+	for key := range rw.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The trailers as they are now that the handler is done
+func (rw *responseWriter) trailers() headers.Headers {
+	t := headers.Headers{}
+	for _, names := range rw.snapshot.Values("Trailer") {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if value := strings.Join(rw.header.Values(name), ", "); name != "" && value != "" {
+				t.Set(http.CanonicalHeaderKey(name), value)
+			}
+		}
+	}
+	for key, values := range rw.header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			t.Set(name, strings.Join(values, ", "))
+		}
+	}
+	return t
+}
+
+// 1xx, 204 and 304 responses never have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,149 @@
+// Package jsonhttp has helpers for JSON APIs: decoding request bodies into
+// structs, writing JSON responses, and reporting errors as problem details
+// (RFC 9457, application/problem+json).
+package jsonhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+// Decoder uses this when MaxSize is 0
+const DefaultMaxSize = 1 << 20
+
+// A Decoder reads JSON request bodies. The zero value is ready to use, and is what Decode uses.
+type Decoder struct {
+	// Bodies bigger than this are refused with a 413 (DefaultMaxSize if 0)
+	MaxSize int64
+
+	// Fields in the body that aren't in the struct are a 400, unless this is set
+	AllowUnknownFields bool
+}
+
+// A Validator is a type that can check itself once it's decoded.
+// Decode calls Validate, and an error becomes a 422.
+type Validator interface {
+	Validate() error
+}
+
+// Decode reads the JSON body of req into v with the default Decoder.
+func Decode(req *request.Request, v any) error {
+	return Decoder{}.Decode(req, v)
+}
+
+// Decode reads the JSON body of req into v. Any error is a *Problem with the
+// status that fits, ready for WriteError:
+//   - 415 if the Content-Type isn't JSON,
+//   - 413 if the body is too big,
+//   - 400 if it isn't valid JSON, doesn't fit v, or has unknown fields,
+//   - 422 if v is a Validator and doesn't validate.
+func (d Decoder) Decode(req *request.Request, v any) error {
+	if !isJSON(req.Headers.Get("Content-Type")) {
+		return NewProblem(response.StatusUnsupportedMediaType, "Content-Type must be application/json")
+	}
+
+	maxSize := d.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if int64(len(req.Body)) > maxSize {
+		return NewProblem(response.StatusContentTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxSize))
+	}
+
+	if len(bytes.TrimSpace(req.Body)) == 0 {
+		return NewProblem(response.StatusBadRequest, "body must not be empty")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(req.Body))
+	if !d.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+	if err != nil {
+		return NewProblem(response.StatusBadRequest, describe(err))
+	}
+
+	// Exactly one value, "{} {}" or "{} junk" are mistakes
+	if dec.InputOffset() < int64(len(bytes.TrimRight(req.Body, " \t\r\n"))) {
+		return NewProblem(response.StatusBadRequest, "body must contain a single JSON value")
+	}
+
+	if validator, ok := v.(Validator); ok {
+		err = validator.Validate()
+		if err != nil {
+			return validationProblem(err)
+		}
+	}
+
+	return nil
+}
+
+// application/json, or any type with the +json suffix
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// Turns the decoder's errors into something a client can act on
+func describe(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at position %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "malformed JSON: unexpected end of body"
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Sprintf("field %q must be of type %s", typeErr.Field, typeErr.Type)
+		}
+		return fmt.Sprintf("body must be of type %s", typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The decoder doesn't have a type for this one
+		return "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	return "malformed JSON: " + err.Error()
+}
+
+// Write sends v as a JSON response with the given status.
+func Write(w *response.Writer, status response.StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	return writeBody(w, status, "application/json", body)
+}
+
+func writeBody(w *response.Writer, status response.StatusCode, contentType string, body []byte) error {
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", "no-store")
+	// Keeps browsers from guessing it's HTML
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	err := w.WriteStatusLine(status)
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteBody(body)
+	return err
+}
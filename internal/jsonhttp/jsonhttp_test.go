@@ -0,0 +1,182 @@
+package jsonhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type user struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (u *user) Validate() error {
+	var errs ValidationErrors
+	if u.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "is required"})
+	}
+	if u.Age < 0 {
+		errs = append(errs, FieldError{Field: "age", Message: "must not be negative"})
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func newRequest(contentType, body string) *request.Request {
+	return &request.Request{
+		Headers: headers.Headers{"content-type": contentType},
+		Body:    []byte(body),
+	}
+}
+
+func status(err error) response.StatusCode {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p.Status
+	}
+	return 0
+}
+
+func TestDecode(t *testing.T) {
+	// Test: A good body
+	var u user
+	err := Decode(newRequest("application/json; charset=utf-8", `{"name":"jo","age":30}`), &u)
+	require.NoError(t, err)
+	assert.Equal(t, user{Name: "jo", Age: 30}, u)
+
+	// Test: +json types are JSON too
+	err = Decode(newRequest("application/vnd.api+json", `{"name":"jo"} `), &user{})
+	assert.NoError(t, err)
+
+	// Test: Not JSON
+	err = Decode(newRequest("text/plain", `{"name":"jo"}`), &user{})
+	assert.Equal(t, response.StatusUnsupportedMediaType, status(err))
+	err = Decode(newRequest("", `{"name":"jo"}`), &user{})
+	assert.Equal(t, response.StatusUnsupportedMediaType, status(err))
+
+	// Test: Too big
+	err = Decoder{MaxSize: 10}.Decode(newRequest("application/json", `{"name":"jonathan"}`), &user{})
+	assert.Equal(t, response.StatusContentTooLarge, status(err))
+
+	// Test: Bad bodies
+	for _, body := range []string{``, `  `, `{"name":`, `{"name":"jo",}`, `{"name":1}`, `[]`, `{"name":"jo","admin":true}`, `{"name":"jo"} {}`, `{"name":"jo"}}`} {
+		err = Decode(newRequest("application/json", body), &user{})
+		assert.Equal(t, response.StatusBadRequest, status(err), body)
+	}
+	err = Decode(newRequest("application/json", `{"name":1}`), &user{})
+	assert.Contains(t, err.Error(), `field "name" must be of type string`)
+	err = Decode(newRequest("application/json", `{"name":"jo","admin":true}`), &user{})
+	assert.Contains(t, err.Error(), `unknown field "admin"`)
+
+	// Test: Unknown fields can be allowed
+	err = Decoder{AllowUnknownFields: true}.Decode(newRequest("application/json", `{"name":"jo","admin":true}`), &user{})
+	assert.NoError(t, err)
+
+	// Test: Validation
+	err = Decode(newRequest("application/json", `{"age":-1}`), &user{})
+	assert.Equal(t, response.StatusUnprocessableContent, status(err))
+	var p *Problem
+	require.ErrorAs(t, err, &p)
+	assert.Equal(t, ValidationErrors{{"name", "is required"}, {"age", "must not be negative"}}, p.Extensions["errors"])
+}
+
+func testHandler(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/users":
+		var u user
+		err := Decode(req, &u)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		Write(w, response.StatusCreated, u)
+
+	case "/fail":
+		WriteError(w, errors.New("database password is hunter2"))
+
+	case "/custom":
+		WriteProblem(w, &Problem{
+			Type:       "https://example.com/probs/out-of-credit",
+			Title:      "You do not have enough credit.",
+			Status:     response.StatusForbidden,
+			Detail:     "Your current balance is 30, but that costs 50.",
+			Instance:   "/account/12345/msgs/abc",
+			Extensions: map[string]any{"balance": 30},
+		})
+	}
+}
+
+var client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+func post(t *testing.T, url, body string) (*http.Response, map[string]any) {
+	res, err := client.Post(url, "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	var v map[string]any
+	require.NoError(t, json.Unmarshal(data, &v), string(data))
+	return res, v
+}
+
+func TestWrite(t *testing.T) {
+	s := servertest.NewServer(testHandler)
+	defer s.Close()
+	base := s.URL
+
+	// Test: A JSON response
+	res, v := post(t, base+"/users", `{"name":"jo","age":30}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+	assert.Equal(t, map[string]any{"name": "jo", "age": 30.0}, v)
+
+	// Test: Decode errors are problems with their status
+	res, v = post(t, base+"/users", `{"name":`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "application/problem+json", res.Header.Get("Content-Type"))
+	assert.Equal(t, "about:blank", v["type"])
+	assert.Equal(t, "Bad Request", v["title"])
+	assert.Equal(t, 400.0, v["status"])
+	assert.NotEmpty(t, v["detail"])
+
+	// Test: Validation errors list the fields
+	res, v = post(t, base+"/users", `{"age":-1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal(t, []any{
+		map[string]any{"field": "name", "message": "is required"},
+		map[string]any{"field": "age", "message": "must not be negative"},
+	}, v["errors"])
+
+	// Test: Other errors are a 500 that doesn't tell
+	res, v = post(t, base+"/fail", `{}`)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.NotContains(t, v, "detail")
+	assert.Equal(t, "Internal Server Error", v["title"])
+
+	// Test: Every member of a custom problem, extensions at the top level
+	res, v = post(t, base+"/custom", `{}`)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, map[string]any{
+		"type":     "https://example.com/probs/out-of-credit",
+		"title":    "You do not have enough credit.",
+		"status":   403.0,
+		"detail":   "Your current balance is 30, but that costs 50.",
+		"instance": "/account/12345/msgs/abc",
+		"balance":  30.0,
+	}, v)
+}
@@ -0,0 +1,144 @@
+package jsonhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+// A Problem is an error that can be sent to the client as problem details
+// (RFC 9457). Decode returns them, and WriteError sends them.
+type Problem struct {
+	// A URI for the kind of problem. "about:blank" if empty, which means the
+	// status says it all.
+	Type string
+	// Short, the same for every problem of this Type. The status text if empty.
+	Title  string
+	Status response.StatusCode
+	// What went wrong this time
+	Detail string
+	// A URI for this occurrence, if there's one
+	Instance string
+
+	// Anything else, sent as members of the object next to the standard ones
+	Extensions map[string]any
+}
+
+// NewProblem returns a Problem with status and detail.
+func NewProblem(status response.StatusCode, detail string) *Problem {
+	return &Problem{Status: status, Detail: detail}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.title() + ": " + p.Detail
+	}
+	return p.title()
+}
+
+func (p *Problem) title() string {
+	if p.Title != "" {
+		return p.Title
+	}
+	return response.StatusText(p.Status)
+}
+
+// MarshalJSON puts the extensions at the top level, as the RFC wants.
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(p.Extensions)+5)
+	maps.Copy(m, p.Extensions)
+
+	m["type"] = p.Type
+	if p.Type == "" {
+		m["type"] = "about:blank"
+	}
+	m["title"] = p.title()
+	m["status"] = int(p.Status)
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+
+	return json.Marshal(m)
+}
+
+// A FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors is what a Validate method can return to report several fields
+// at once. Each of them is listed under "errors" in the problem.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	if len(e) == 0 {
+		return "validation failed"
+	}
+	msg := e[0].Error()
+	if len(e) > 1 {
+		msg += " (and more)"
+	}
+	return msg
+}
+
+// A 422 for an error from Validate, listing the fields if it says which
+func validationProblem(err error) *Problem {
+	p := NewProblem(response.StatusUnprocessableContent, err.Error())
+
+	var fields ValidationErrors
+	var field FieldError
+	switch {
+	case errors.As(err, &fields):
+		p.Detail = "the request has invalid fields"
+		p.Extensions = map[string]any{"errors": fields}
+	case errors.As(err, &field):
+		p.Extensions = map[string]any{"errors": ValidationErrors{field}}
+	}
+
+	return p
+}
+
+// WriteProblem sends p as an application/problem+json response with its status
+// (500 if it has none).
+func WriteProblem(w *response.Writer, p *Problem) error {
+	if p.Status == 0 {
+		p.Status = response.StatusInternalServerError
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	return writeBody(w, p.Status, "application/problem+json", body)
+}
+
+// WriteError sends err as a problem. A *Problem goes as it is, validation
+// errors are a 422 with the fields, and anything else is a 500 that doesn't
+// say more, so nothing internal leaks to the client.
+func WriteError(w *response.Writer, err error) error {
+	var p *Problem
+	var fields ValidationErrors
+	var field FieldError
+
+	switch {
+	case errors.As(err, &p):
+	case errors.As(err, &fields), errors.As(err, &field):
+		p = validationProblem(err)
+	default:
+		p = NewProblem(response.StatusInternalServerError, "")
+	}
+
+	return WriteProblem(w, p)
+}
@@ -0,0 +1,33 @@
+package request
+
+import "context"
+
+// Unexported key type so nobody outside the package can collide with our context values
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	userKey
+)
+
+// Returns a copy of ctx carrying the request ID.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// Returns the request ID stored in ctx, or "" if there isn't one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Returns a copy of ctx carrying the authenticated user.
+// What a "user" is is up to the authentication middleware.
+func ContextWithUser(ctx context.Context, user any) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// Returns the user stored in ctx, or nil.
+func UserFromContext(ctx context.Context) any {
+	return ctx.Value(userKey)
+}
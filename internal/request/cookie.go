@@ -0,0 +1,19 @@
+package request
+
+import "github.com/neixir/httpfromtcp/internal/cookie"
+
+// Cookies returns the cookies sent in the Cookie header.
+func (r *Request) Cookies() []*cookie.Cookie {
+	return cookie.Parse(r.Headers.Get("Cookie"))
+}
+
+// Cookie returns the cookie with that name, or cookie.ErrNoCookie.
+// If it was sent more than once, the first one wins, which is the one with the longest path.
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, cookie.ErrNoCookie
+}
@@ -0,0 +1,114 @@
+package request
+
+import (
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ParseForm fills r.Form and r.PostForm.
+// PostForm has the values of an application/x-www-form-urlencoded body, for POST,
+// PUT and PATCH requests. Form has those plus the ones in the query string, body
+// values first. It's safe to call more than once, only the first call does anything.
+// On a malformed query or body the error is returned, but the values that could be
+// parsed are still there.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+
+	var err error
+
+	if r.PostForm == nil {
+		r.PostForm = url.Values{}
+		if hasFormBody(r.RequestLine.Method) && mediaType(r.Headers.Get("Content-Type")) == "application/x-www-form-urlencoded" {
+			var values url.Values
+			values, err = url.ParseQuery(string(r.Body))
+			copyValues(r.PostForm, values)
+		}
+	}
+
+	r.Form = url.Values{}
+	copyValues(r.Form, r.PostForm)
+
+	if _, query, found := strings.Cut(r.RequestLine.RequestTarget, "?"); found {
+		values, qerr := url.ParseQuery(query)
+		copyValues(r.Form, values)
+		if err == nil {
+			err = qerr
+		}
+	}
+
+	return err
+}
+
+// FormValue returns the first value for key in the query string or the body,
+// parsing them if needed (multipart bodies too). Errors are ignored, call
+// ParseForm or ParseMultipartForm first if they matter.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		if mediaType(r.Headers.Get("Content-Type")) == "multipart/form-data" {
+			r.ParseMultipartForm(MultipartLimits{})
+		}
+		r.ParseForm()
+	}
+	return r.Form.Get(key)
+}
+
+// Only these methods have their body parsed as a form
+func hasFormBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+// The media type of a Content-Type, without parameters and in lowercase
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+func copyValues(dst, src url.Values) {
+	for key, values := range src {
+		dst[key] = append(dst[key], values...)
+	}
+}
+
+// Functions to run once the request has been answered. It's a pointer in Request
+// so the copies made by WithContext and middleware all share it.
+type finishers struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+// OnFinish registers fn to run once the response has been sent, to clean up
+// after the request (temporary files, for example). The server takes care of
+// calling Finish.
+func (r *Request) OnFinish(fn func()) {
+	if r.finish == nil {
+		r.finish = &finishers{}
+	}
+
+	r.finish.mu.Lock()
+	defer r.finish.mu.Unlock()
+	r.finish.fns = append(r.finish.fns, fn)
+}
+
+// Finish runs the functions registered with OnFinish, last registered first.
+// Each one only runs once, even if Finish is called again.
+func (r *Request) Finish() {
+	if r.finish == nil {
+		return
+	}
+
+	r.finish.mu.Lock()
+	fns := r.finish.fns
+	r.finish.fns = nil
+	r.finish.mu.Unlock()
+
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
+}
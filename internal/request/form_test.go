@@ -0,0 +1,197 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(method, target, contentType string, body []byte) *Request {
+	h := headers.Headers{"content-length": fmt.Sprint(len(body))}
+	if contentType != "" {
+		h["content-type"] = contentType
+	}
+	return &Request{
+		RequestLine: RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        body,
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: Query string only
+	r := formRequest("GET", "/search?q=go&q=http&page=2", "", nil)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, url.Values{"q": {"go", "http"}, "page": {"2"}}, r.Form)
+	assert.Empty(t, r.PostForm)
+
+	// Test: urlencoded body, body values first in Form
+	r = formRequest("POST", "/submit?q=query", "application/x-www-form-urlencoded; charset=utf-8", []byte("q=body&name=Jo%20Bloggs"))
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, url.Values{"q": {"body"}, "name": {"Jo Bloggs"}}, r.PostForm)
+	assert.Equal(t, []string{"body", "query"}, r.Form["q"])
+	assert.Equal(t, "Jo Bloggs", r.FormValue("name"))
+
+	// Test: GET bodies and other content types aren't forms
+	r = formRequest("GET", "/", "application/x-www-form-urlencoded", []byte("a=1"))
+	require.NoError(t, r.ParseForm())
+	assert.Empty(t, r.Form)
+	r = formRequest("POST", "/", "text/plain", []byte("a=1"))
+	require.NoError(t, r.ParseForm())
+	assert.Empty(t, r.Form)
+
+	// Test: Malformed, the error is returned with what could be parsed
+	r = formRequest("POST", "/", "application/x-www-form-urlencoded", []byte("a=1&b=%zz"))
+	assert.Error(t, r.ParseForm())
+	assert.Equal(t, "1", r.Form.Get("a"))
+}
+
+// Builds a multipart/form-data body with a field and two files of the given sizes
+func multipartBody(t *testing.T, small, big int) (string, []byte) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	require.NoError(t, mw.WriteField("title", "holiday pics"))
+	require.NoError(t, mw.WriteField("tag", "beach"))
+	require.NoError(t, mw.WriteField("tag", "sun"))
+
+	fw, err := mw.CreateFormFile("photo", "small.jpg")
+	require.NoError(t, err)
+	fw.Write(bytes.Repeat([]byte("s"), small))
+
+	fw, err = mw.CreateFormFile("photo", `C:\Users\jo\big.jpg`)
+	require.NoError(t, err)
+	fw.Write(bytes.Repeat([]byte("b"), big))
+
+	require.NoError(t, mw.Close())
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestMultipartReader(t *testing.T) {
+	// Test: Parts come out one by one, even reading the body a byte at a time
+	var buf bytes.Buffer
+	buf.WriteString("This is the preamble, ignore it\r\n")
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("a", "first")
+	// Data that looks almost like a boundary must be left alone
+	mw.WriteField("b", "\r\n--"+mw.Boundary()[:10]+"\r\n")
+	mw.WriteField("empty", "")
+	mw.Close()
+	buf.WriteString("\r\nand an epilogue")
+
+	mr := NewMultipartReader(iotest.OneByteReader(&buf), mw.Boundary())
+	got := map[string]string{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Contains(t, p.Header.Get("Content-Disposition"), "form-data")
+		data, err := io.ReadAll(p)
+		require.NoError(t, err)
+		got[p.FormName()] = string(data)
+	}
+	assert.Equal(t, map[string]string{"a": "first", "b": "\r\n--" + mw.Boundary()[:10] + "\r\n", "empty": ""}, got)
+
+	// Test: Parts left unread are skipped
+	contentType, body := multipartBody(t, 10, 10000)
+	r := formRequest("POST", "/", contentType, body)
+	mr, err := r.MultipartReader()
+	require.NoError(t, err)
+	names := []string{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, p.FormName())
+	}
+	assert.Equal(t, []string{"title", "tag", "tag", "photo", "photo"}, names)
+
+	// Test: No closing boundary
+	mr = NewMultipartReader(strings.NewReader("--xyz\r\nContent-Disposition: form-data; name=a\r\n\r\nabc"), "xyz")
+	p, err := mr.NextPart()
+	require.NoError(t, err)
+	_, err = io.ReadAll(p)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Not multipart
+	r = formRequest("POST", "/", "text/plain", nil)
+	_, err = r.MultipartReader()
+	assert.ErrorIs(t, err, ErrNotMultipart)
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	// Test: Values, a file in memory and one spooled to disk
+	contentType, body := multipartBody(t, 100, 5000)
+	r := formRequest("POST", "/upload?album=2024", contentType, body)
+	require.NoError(t, r.ParseMultipartForm(MultipartLimits{MaxMemory: 1000}))
+
+	form := r.MultipartForm
+	assert.Equal(t, []string{"holiday pics"}, form.Value["title"])
+	assert.Equal(t, []string{"beach", "sun"}, form.Value["tag"])
+	assert.Equal(t, "sun", r.PostForm["tag"][1])
+	assert.Equal(t, "2024", r.FormValue("album"))
+	assert.Equal(t, "holiday pics", r.FormValue("title"))
+
+	files := form.File["photo"]
+	require.Len(t, files, 2)
+	assert.Equal(t, "small.jpg", files[0].Filename)
+	assert.Equal(t, int64(100), files[0].Size)
+	assert.Empty(t, files[0].tmpfile)
+	assert.Equal(t, "big.jpg", files[1].Filename)
+	assert.Equal(t, int64(5000), files[1].Size)
+	require.NotEmpty(t, files[1].tmpfile)
+
+	for i, fh := range files {
+		f, err := fh.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		f.Close()
+		require.NoError(t, err)
+		assert.Equal(t, int(fh.Size), len(data))
+		assert.Equal(t, []byte("sb")[i], data[0])
+	}
+
+	// Test: The temporary file is gone once the request finishes
+	tmpfile := files[1].tmpfile
+	_, err := os.Stat(tmpfile)
+	require.NoError(t, err)
+	r.Finish()
+	_, err = os.Stat(tmpfile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: A copy of the request shares the cleanup
+	r = formRequest("POST", "/", contentType, body)
+	r2 := r.WithContext(t.Context())
+	require.NoError(t, r2.ParseMultipartForm(MultipartLimits{MaxMemory: 1000}))
+	tmpfile = r2.MultipartForm.File["photo"][1].tmpfile
+	r.Finish()
+	_, err = os.Stat(tmpfile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Limits
+	r = formRequest("POST", "/", contentType, body)
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxPartSize: 4999}), ErrFormTooLarge)
+	r = formRequest("POST", "/", contentType, body)
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxMemory: 10, MaxPartSize: 4999}), ErrFormTooLarge)
+	r = formRequest("POST", "/", contentType, body)
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxTotalSize: 5100}), ErrFormTooLarge)
+	r = formRequest("POST", "/", contentType, body)
+	assert.ErrorIs(t, r.ParseMultipartForm(MultipartLimits{MaxParts: 4}), ErrTooManyParts)
+	r = formRequest("POST", "/", contentType, body)
+	assert.NoError(t, r.ParseMultipartForm(MultipartLimits{MaxParts: 5}))
+	r.Finish()
+}
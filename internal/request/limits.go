@@ -0,0 +1,61 @@
+package request
+
+import "fmt"
+
+// Limits bounds how big a request can get, so a client can't make the parser
+// wait (and buffer) forever. A field that is zero or negative means no limit.
+type Limits struct {
+	// Bytes in the request line, CRLF not included (414 URI Too Long)
+	MaxRequestLine int
+
+	// Bytes in all the header lines together, CRLFs included, and how many
+	// there can be. Trailers count with the headers. (431)
+	MaxHeaderBytes int
+	MaxHeaderCount int
+
+	// Bytes in any one header or trailer line, CRLF not included (431)
+	MaxFieldSize int
+
+	// Bytes in the body. A Content-Length over it is refused before reading any
+	// of the body, a chunked body as soon as its chunks add up to more. (413)
+	MaxBodySize int64
+}
+
+// The limits the server uses for the ones that aren't set in its Config
+var DefaultLimits = Limits{
+	MaxRequestLine: 8 << 10,
+	MaxHeaderBytes: 1 << 20,
+	MaxHeaderCount: 100,
+	MaxFieldSize:   64 << 10,
+	MaxBodySize:    32 << 20,
+}
+
+// A LimitError is what the parser returns for a request that goes over one of
+// its Limits.
+type LimitError struct {
+	// The status to answer with: 413, 414 or 431
+	Status int
+
+	// What went over, and the limit
+	What  string
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s is over the limit of %d", e.What, e.Limit)
+}
+
+const (
+	statusContentTooLarge             = 413
+	statusURITooLong                  = 414
+	statusRequestHeaderFieldsTooLarge = 431
+)
+
+// Chunk size lines don't have a limit of their own, extensions and all they
+// shouldn't get anywhere near this
+const maxChunkSizeLine = 4096
+
+// Whether n is over limit, when there is one
+func overLimit[T int | int64](n, limit T) bool {
+	return limit > 0 && n > limit
+}
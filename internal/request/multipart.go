@@ -0,0 +1,472 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+)
+
+const (
+	// How much of the body the multipart reader looks at at once. It has to hold a whole boundary.
+	multipartBufferSize = 4096
+
+	// Part headers are small, anything bigger than this is up to no good
+	maxPartHeaderSize = 8 << 10
+)
+
+var (
+	// Returned when a part, or the whole form, is bigger than the limits allow
+	ErrFormTooLarge = errors.New("multipart: form too large")
+
+	// Returned when the form has more parts than the limits allow
+	ErrTooManyParts = errors.New("multipart: too many parts")
+
+	// Returned for bodies that don't follow the multipart format
+	ErrMalformedMultipart = errors.New("multipart: malformed body")
+
+	// Returned by MultipartReader when the request isn't multipart/form-data
+	ErrNotMultipart = errors.New("request Content-Type isn't multipart/form-data")
+)
+
+// MultipartReader reads a multipart body part by part. It only buffers a few KB
+// of what it reads, so over a stream (NewMultipartReader) the parts can be
+// bigger than memory.
+type MultipartReader struct {
+	br             *bufio.Reader
+	dashBoundary   []byte // "--boundary"
+	nlDashBoundary []byte // "\r\n--boundary", what ends the data of a part
+	current        *Part
+	partsRead      int
+	done           bool
+}
+
+// A Part is one of the parts of a multipart body. Its data is read with Read,
+// up to the next boundary.
+type Part struct {
+	// Part headers, with lowercase keys like the request's
+	Header headers.Headers
+
+	mr  *MultipartReader
+	eof bool
+}
+
+// NewMultipartReader reads the multipart parts in r, separated by boundary.
+func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+	return &MultipartReader{
+		br:             bufio.NewReaderSize(r, multipartBufferSize),
+		dashBoundary:   []byte("--" + boundary),
+		nlDashBoundary: []byte("\r\n--" + boundary),
+	}
+}
+
+// MultipartReader returns a reader for the parts of a multipart/form-data body,
+// with the boundary from the Content-Type.
+//
+// It reads r.Body, which the server has already read in full: this splits the
+// body into parts, it doesn't save any memory. The request's MaxBodySize is
+// what bounds that.
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	mt, params, err := mime.ParseMediaType(r.Headers.Get("Content-Type"))
+	if err != nil || mt != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+
+	// RFC 2046 allows up to 70 characters
+	boundary := params["boundary"]
+	if boundary == "" || len(boundary) > 70 {
+		return nil, fmt.Errorf("%w: missing or invalid boundary", ErrMalformedMultipart)
+	}
+
+	return NewMultipartReader(bytes.NewReader(r.Body), boundary), nil
+}
+
+// NextPart returns the next part, or io.EOF after the last one.
+// Whatever was left unread of the previous part is skipped.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	if mr.current != nil {
+		_, err := io.Copy(io.Discard, mr.current)
+		if err != nil {
+			return nil, err
+		}
+		mr.current = nil
+
+		// The part stopped right before the CRLF that comes with the boundary
+		_, err = mr.br.Discard(2)
+		if err != nil {
+			return nil, ErrMalformedMultipart
+		}
+	}
+
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, ErrMalformedMultipart
+		}
+
+		// Trailing whitespace after the boundary is allowed
+		line = bytes.TrimRight(line, " \t\r\n")
+
+		if bytes.Equal(line, mr.dashBoundary) {
+			break
+		}
+		if len(line) == len(mr.dashBoundary)+2 && bytes.HasPrefix(line, mr.dashBoundary) && bytes.HasSuffix(line, []byte("--")) {
+			// The closing boundary, anything after it is epilogue
+			mr.done = true
+			return nil, io.EOF
+		}
+
+		// Before the first boundary there may be a preamble, after that there must be a boundary
+		if mr.partsRead > 0 {
+			return nil, ErrMalformedMultipart
+		}
+	}
+
+	h, err := mr.readPartHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	mr.partsRead++
+	mr.current = &Part{Header: h, mr: mr}
+
+	return mr.current, nil
+}
+
+// Reads a line, which has to fit in the buffer
+func (mr *MultipartReader) readLine() ([]byte, error) {
+	line, err := mr.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrMalformedMultipart
+	}
+	return line, err
+}
+
+func (mr *MultipartReader) readPartHeaders() (headers.Headers, error) {
+	h := headers.Headers{}
+	size := 0
+
+	for {
+		line, err := mr.readLine()
+		if err != nil {
+			return nil, ErrMalformedMultipart
+		}
+
+		size += len(line)
+		if size > maxPartHeaderSize {
+			return nil, fmt.Errorf("%w: part headers too long", ErrMalformedMultipart)
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			return h, nil
+		}
+
+		key, value, found := strings.Cut(string(line), ":")
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%w: invalid part header", ErrMalformedMultipart)
+		}
+
+		key = strings.ToLower(key)
+		value = strings.TrimSpace(value)
+		if prev, ok := h[key]; ok {
+			value = prev + ", " + value
+		}
+		h[key] = value
+	}
+}
+
+// Read reads the data of the part, and returns io.EOF when it gets to the boundary.
+func (p *Part) Read(b []byte) (int, error) {
+	if p.eof {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	mr := p.mr
+	peek, err := mr.br.Peek(multipartBufferSize)
+
+	if i := bytes.Index(peek, mr.nlDashBoundary); i >= 0 {
+		if i == 0 {
+			p.eof = true
+			return 0, io.EOF
+		}
+		n := copy(b, peek[:i])
+		mr.br.Discard(n)
+		return n, nil
+	}
+
+	if err == io.EOF {
+		// The body ended without a closing boundary
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// No boundary in sight, but it could start in the last few bytes
+	safe := len(peek) - (len(mr.nlDashBoundary) - 1)
+	n := copy(b, peek[:safe])
+	mr.br.Discard(n)
+	return n, nil
+}
+
+// The name of the form field, from Content-Disposition
+func (p *Part) FormName() string {
+	_, params := p.disposition()
+	return params["name"]
+}
+
+// The name of the uploaded file, or "" if the part isn't a file.
+// Only the last element of the path is kept, so it's safe to use as a file name.
+func (p *Part) FileName() string {
+	_, params := p.disposition()
+	filename := params["filename"]
+	if filename == "" {
+		return ""
+	}
+	return filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+}
+
+func (p *Part) disposition() (string, map[string]string) {
+	d, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || d != "form-data" {
+		return "", map[string]string{}
+	}
+	return d, params
+}
+
+// Limits for ParseMultipartForm. Zero fields get the defaults.
+//
+// The request body is already in memory when they're checked, so they bound
+// the form, not the body: that's the server's MaxBodySize.
+type MultipartLimits struct {
+	// Files are copied into memory up to this many bytes in total, the rest are
+	// copied to temporary files (1MB). That second copy doesn't free the body,
+	// it only keeps the form itself from doubling what's in memory.
+	MaxMemory int64
+
+	// No part can be bigger than this (10MB)
+	MaxPartSize int64
+
+	// Nor all of them together (32MB)
+	MaxTotalSize int64
+
+	// Nor can there be more parts than this (1000)
+	MaxParts int
+}
+
+func (l MultipartLimits) withDefaults() MultipartLimits {
+	if l.MaxMemory <= 0 {
+		l.MaxMemory = 1 << 20
+	}
+	if l.MaxPartSize <= 0 {
+		l.MaxPartSize = 10 << 20
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = 32 << 20
+	}
+	if l.MaxParts <= 0 {
+		l.MaxParts = 1000
+	}
+	return l
+}
+
+// MultipartForm is a parsed multipart/form-data body
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// A FileHeader describes an uploaded file, whose content is either in memory or in a temporary file.
+type FileHeader struct {
+	Filename string
+	Header   headers.Headers
+	Size     int64
+
+	content []byte
+	tmpfile string
+}
+
+// Open returns the content of the file.
+func (fh *FileHeader) Open() (io.ReadSeekCloser, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return nopCloser{bytes.NewReader(fh.content)}, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// RemoveAll deletes the temporary files of the form.
+func (f *MultipartForm) RemoveAll() error {
+	var err error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpfile == "" {
+				continue
+			}
+			rerr := os.Remove(fh.tmpfile)
+			if rerr != nil && !errors.Is(rerr, os.ErrNotExist) && err == nil {
+				err = rerr
+			}
+			fh.tmpfile = ""
+		}
+	}
+	return err
+}
+
+// ParseMultipartForm reads a multipart/form-data body into r.MultipartForm.
+// Plain values also end up in r.PostForm and r.Form, like ParseForm does with
+// urlencoded bodies. Temporary files are removed when the request finishes.
+//
+// The body is read from memory, see MultipartReader and MultipartLimits.
+func (r *Request) ParseMultipartForm(limits MultipartLimits) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	form, err := readForm(mr, limits.withDefaults())
+	if err != nil {
+		return err
+	}
+
+	r.MultipartForm = form
+	r.OnFinish(func() { form.RemoveAll() })
+
+	if r.PostForm == nil {
+		r.PostForm = url.Values{}
+	}
+	copyValues(r.PostForm, form.Value)
+	r.Form = nil
+
+	return r.ParseForm()
+}
+
+func readForm(mr *MultipartReader, limits MultipartLimits) (_ *MultipartForm, err error) {
+	form := &MultipartForm{
+		Value: map[string][]string{},
+		File:  map[string][]*FileHeader{},
+	}
+
+	// Don't leave temporary files behind if we give up halfway
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+		}
+	}()
+
+	memoryLeft := limits.MaxMemory
+	totalLeft := limits.MaxTotalSize
+
+	for parts := 0; ; parts++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if parts == limits.MaxParts {
+			return nil, ErrTooManyParts
+		}
+
+		name := p.FormName()
+		if name == "" {
+			continue
+		}
+
+		// Read one byte past what's allowed, to notice when there's too much
+		maxSize := min(limits.MaxPartSize, totalLeft)
+		lr := io.LimitReader(p, maxSize+1)
+
+		filename := p.FileName()
+		if filename == "" {
+			var buf bytes.Buffer
+			n, err := buf.ReadFrom(lr)
+			if err != nil {
+				return nil, err
+			}
+			if n > maxSize {
+				return nil, ErrFormTooLarge
+			}
+			totalLeft -= n
+			form.Value[name] = append(form.Value[name], buf.String())
+			continue
+		}
+
+		fh := &FileHeader{Filename: filename, Header: p.Header}
+		// Added right away, so RemoveAll finds its temporary file if something goes wrong
+		form.File[name] = append(form.File[name], fh)
+
+		// Into memory while it fits
+		var buf bytes.Buffer
+		n, err := buf.ReadFrom(io.LimitReader(lr, memoryLeft+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if n <= memoryLeft {
+			if n > maxSize {
+				return nil, ErrFormTooLarge
+			}
+			fh.content = buf.Bytes()
+			fh.Size = n
+			memoryLeft -= n
+			totalLeft -= n
+			continue
+		}
+
+		// Too big for memory: what we have and the rest go to a temporary file
+		size, err := spool(fh, io.MultiReader(&buf, lr))
+		if err != nil {
+			return nil, err
+		}
+		if size > maxSize {
+			return nil, ErrFormTooLarge
+		}
+		fh.Size = size
+		totalLeft -= size
+	}
+}
+
+// Writes r to a new temporary file for fh.
+func spool(fh *FileHeader, r io.Reader) (int64, error) {
+	f, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return 0, err
+	}
+	fh.tmpfile = f.Name()
+
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
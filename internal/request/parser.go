@@ -0,0 +1,465 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+)
+
+// Where a Parser is in the request
+type ParserState int
+
+const (
+	StateInitialized ParserState = iota
+	StateDone
+	StateParsingHeaders
+	StateParsingBody
+	StateParsingChunkSize
+	StateParsingChunkData
+	StateParsingChunkEnd
+	StateParsingTrailers
+)
+
+func (s ParserState) String() string {
+	switch s {
+	case StateInitialized:
+		return "initialized"
+	case StateDone:
+		return "done"
+	case StateParsingHeaders:
+		return "parsing headers"
+	case StateParsingBody:
+		return "parsing body"
+	case StateParsingChunkSize:
+		return "parsing chunk size"
+	case StateParsingChunkData:
+		return "parsing chunk data"
+	case StateParsingChunkEnd:
+		return "parsing chunk end"
+	case StateParsingTrailers:
+		return "parsing trailers"
+	default:
+		return "ParserState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// What an Event is about
+type EventKind int
+
+const (
+	// The request line, in Event.RequestLine
+	EventRequestLine EventKind = iota + 1
+	// A header field, in Event.Name and Event.Value
+	EventHeader
+	// The empty line after the headers
+	EventHeadersDone
+	// Part of the body (dechunked), in Event.Data
+	EventBody
+	// A trailer field after a chunked body, in Event.Name and Event.Value
+	EventTrailer
+	// The end of the request
+	EventDone
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventRequestLine:
+		return "request line"
+	case EventHeader:
+		return "header"
+	case EventHeadersDone:
+		return "headers done"
+	case EventBody:
+		return "body"
+	case EventTrailer:
+		return "trailer"
+	case EventDone:
+		return "done"
+	default:
+		return "EventKind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// Something the Parser found in the data it was fed
+type Event struct {
+	Kind EventKind
+
+	RequestLine RequestLine
+
+	// The field name is lowercase, like in Headers
+	Name  string
+	Value string
+
+	// Points into the slice given to Feed, copy it to keep it
+	Data []byte
+}
+
+// A Parser parses one request out of the bytes it's fed, as they come, and says
+// what it found as events. It doesn't keep the request: RequestFromReader builds
+// a Request out of the events, other callers can do what they want with them.
+//
+// The zero value is ready to use, without limits. Once it's done, Reset gets it
+// ready for the next request.
+type Parser struct {
+	// What the request can't go over, checked as it comes. Going over is a *LimitError.
+	Limits Limits
+
+	state ParserState
+
+	// The header and trailer lines so far, and their bytes
+	fieldCount int
+	fieldBytes int
+
+	// The body so far, for chunked ones
+	bodySize int64
+
+	// The headers that say how the body is framed, joined like in Headers
+	contentLength    string
+	hasContentLength bool
+	transferEncoding string
+
+	// What's left of the body, or of the current chunk of a chunked body
+	bodyLeft int64
+
+	// Reused by every Feed
+	events []Event
+}
+
+// NewParser returns a Parser waiting for a request line.
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// State returns where the parser is in the request.
+func (p *Parser) State() ParserState {
+	return p.state
+}
+
+// Reset gets the parser ready for the next request.
+func (p *Parser) Reset() {
+	p.state = StateInitialized
+	p.fieldCount = 0
+	p.fieldBytes = 0
+	p.bodySize = 0
+	p.contentLength = ""
+	p.hasContentLength = false
+	p.transferEncoding = ""
+	p.bodyLeft = 0
+}
+
+// Feed parses as much of data as it can. It returns how many bytes it used, and
+// what it found in them. The bytes it didn't use have to be fed again, with more
+// after them: a line is only used once it's whole.
+//
+// The events are only valid until the next call to Feed. Once the request is
+// done Feed uses nothing, what's left belongs to whatever comes next.
+func (p *Parser) Feed(data []byte) (consumed int, events []Event, err error) {
+	p.events = p.events[:0]
+
+	for p.state != StateDone {
+		before := p.state
+		n, err := p.feedSingle(data[consumed:])
+		consumed += n
+		if err != nil {
+			return consumed, p.events, err
+		}
+
+		// Some states move on without using anything (an empty body), that's progress too
+		if n == 0 && p.state == before {
+			break
+		}
+	}
+
+	return consumed, p.events, nil
+}
+
+func (p *Parser) emit(ev Event) {
+	p.events = append(p.events, ev)
+}
+
+func (p *Parser) finish() {
+	p.state = StateDone
+	p.emit(Event{Kind: EventDone})
+}
+
+func (p *Parser) feedSingle(data []byte) (int, error) {
+	switch p.state {
+	case StateInitialized:
+		// Empty lines before a request are ignored (RFC 9112, section 2.2),
+		// some clients send an extra CRLF after a body
+		if len(data) >= 2 && data[0] == '\r' && data[1] == '\n' {
+			return 2, nil
+		}
+
+		// If zero bytes are parsed, but no error is returned, it needs more data.
+		rl, n, err := parseRequestLine(data)
+		if n == 0 && err == nil {
+			// Not the whole line yet, but maybe more than it can be already (the last byte could be the CR)
+			if overLimit(len(data)-1, p.Limits.MaxRequestLine) {
+				return 0, p.requestLineTooLong()
+			}
+			return 0, nil
+		}
+		if overLimit(n, p.Limits.MaxRequestLine) {
+			return 0, p.requestLineTooLong()
+		}
+		if err != nil {
+			return n, err
+		}
+
+		p.emit(Event{Kind: EventRequestLine, RequestLine: rl})
+		p.state = StateParsingHeaders
+
+		return n + 2, nil // +2 per CRLF
+
+	case StateParsingHeaders:
+		totalParsed := 0
+		for {
+			name, value, n, done, err := headers.ParseLine(data[totalParsed:])
+			if err != nil {
+				return totalParsed + n, err
+			}
+			if n == 0 {
+				return totalParsed, p.checkPartialField(len(data) - totalParsed)
+			}
+			totalParsed += n
+
+			if done {
+				p.emit(Event{Kind: EventHeadersDone})
+				return totalParsed, p.startBody()
+			}
+
+			if err := p.countField(n); err != nil {
+				return totalParsed - n, err
+			}
+
+			switch name {
+			case "content-length":
+				p.contentLength = joinField(p.contentLength, value, p.hasContentLength)
+				p.hasContentLength = true
+			case "transfer-encoding":
+				p.transferEncoding = joinField(p.transferEncoding, value, p.transferEncoding != "")
+			}
+			p.emit(Event{Kind: EventHeader, Name: name, Value: value})
+		}
+
+	case StateParsingBody:
+		// If there's more data than you need, only take as much as you need to hit Content-Length.
+		toCopy := data
+		if int64(len(data)) > p.bodyLeft {
+			toCopy = data[:p.bodyLeft]
+		}
+		if len(toCopy) > 0 {
+			p.emit(Event{Kind: EventBody, Data: toCopy})
+		}
+		p.bodyLeft -= int64(len(toCopy))
+
+		if p.bodyLeft == 0 {
+			p.finish()
+		}
+		return len(toCopy), nil
+
+	case StateParsingChunkSize:
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(data) > maxChunkSizeLine {
+				return 0, fmt.Errorf("malformed chunk size")
+			}
+			return 0, nil
+		}
+		if i == 0 || data[i-1] != '\r' {
+			return i, fmt.Errorf("malformed chunk size")
+		}
+
+		// Chunk extensions (";name=value") are allowed, and ignored
+		sizeText, _, _ := bytes.Cut(data[:i-1], []byte(";"))
+		size, ok := parseHex(bytes.TrimSpace(sizeText))
+		if !ok {
+			return i, fmt.Errorf("malformed chunk size")
+		}
+
+		p.bodySize += size
+		if overLimit(p.bodySize, p.Limits.MaxBodySize) {
+			return 0, &LimitError{Status: statusContentTooLarge, What: "body", Limit: p.Limits.MaxBodySize}
+		}
+
+		if size == 0 {
+			p.state = StateParsingTrailers
+		} else {
+			p.bodyLeft = size
+			p.state = StateParsingChunkData
+		}
+		return i + 1, nil
+
+	case StateParsingChunkData:
+		toCopy := data
+		if int64(len(data)) > p.bodyLeft {
+			toCopy = data[:p.bodyLeft]
+		}
+		if len(toCopy) > 0 {
+			p.emit(Event{Kind: EventBody, Data: toCopy})
+		}
+		p.bodyLeft -= int64(len(toCopy))
+
+		if p.bodyLeft == 0 {
+			p.state = StateParsingChunkEnd
+		}
+		return len(toCopy), nil
+
+	case StateParsingChunkEnd:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, fmt.Errorf("chunk data is longer than its size")
+		}
+		p.state = StateParsingChunkSize
+		return 2, nil
+
+	case StateParsingTrailers:
+		totalParsed := 0
+		for {
+			name, value, n, done, err := headers.ParseLine(data[totalParsed:])
+			if err != nil {
+				return totalParsed + n, err
+			}
+			if n == 0 {
+				return totalParsed, p.checkPartialField(len(data) - totalParsed)
+			}
+			totalParsed += n
+
+			if done {
+				p.finish()
+				return totalParsed, nil
+			}
+			if err := p.countField(n); err != nil {
+				return totalParsed - n, err
+			}
+			p.emit(Event{Kind: EventTrailer, Name: name, Value: value})
+		}
+
+	case StateDone:
+		return 0, fmt.Errorf("trying to read data in a done state")
+
+	default:
+		return 0, fmt.Errorf("unknown state")
+	}
+}
+
+// Decides how the body is framed, once the headers are in
+func (p *Parser) startBody() error {
+	if p.transferEncoding != "" {
+		// Both at once is how requests get smuggled past proxies,
+		// and a request body can only be chunked (RFC 9112, 6.1 and 6.3)
+		if p.hasContentLength {
+			return fmt.Errorf("both Transfer-Encoding and Content-Length")
+		}
+		if !chunkedCoding(p.transferEncoding) {
+			return fmt.Errorf("unsupported Transfer-Encoding")
+		}
+		p.state = StateParsingChunkSize
+		return nil
+	}
+
+	// Without a Content-Length there's no body
+	// (an empty one is a broken one, not a missing one)
+	if !p.hasContentLength {
+		p.finish()
+		return nil
+	}
+
+	length, err := strconv.ParseInt(p.contentLength, 10, 64)
+	if err != nil || length < 0 {
+		return fmt.Errorf("invalid Content-Length")
+	}
+	if overLimit(length, p.Limits.MaxBodySize) {
+		return &LimitError{Status: statusContentTooLarge, What: "body", Limit: p.Limits.MaxBodySize}
+	}
+	if length == 0 {
+		p.finish()
+		return nil
+	}
+
+	p.bodyLeft = length
+	p.state = StateParsingBody
+	return nil
+}
+
+func (p *Parser) requestLineTooLong() error {
+	return &LimitError{Status: statusURITooLong, What: "request line", Limit: int64(p.Limits.MaxRequestLine)}
+}
+
+// Counts a whole header or trailer line of n bytes, CRLF included, against the limits
+func (p *Parser) countField(n int) error {
+	if overLimit(n-2, p.Limits.MaxFieldSize) {
+		return &LimitError{Status: statusRequestHeaderFieldsTooLarge, What: "header field", Limit: int64(p.Limits.MaxFieldSize)}
+	}
+	p.fieldCount++
+	p.fieldBytes += n
+	if overLimit(p.fieldCount, p.Limits.MaxHeaderCount) {
+		return &LimitError{Status: statusRequestHeaderFieldsTooLarge, What: "number of header fields", Limit: int64(p.Limits.MaxHeaderCount)}
+	}
+	if overLimit(p.fieldBytes, p.Limits.MaxHeaderBytes) {
+		return &LimitError{Status: statusRequestHeaderFieldsTooLarge, What: "header section", Limit: int64(p.Limits.MaxHeaderBytes)}
+	}
+	return nil
+}
+
+// Whether waiting for the rest of a line that has n bytes so far could still
+// fit in the limits. The last of them could be the CR.
+func (p *Parser) checkPartialField(n int) error {
+	if overLimit(n-1, p.Limits.MaxFieldSize) {
+		return &LimitError{Status: statusRequestHeaderFieldsTooLarge, What: "header field", Limit: int64(p.Limits.MaxFieldSize)}
+	}
+	if overLimit(p.fieldBytes+n, p.Limits.MaxHeaderBytes) {
+		return &LimitError{Status: statusRequestHeaderFieldsTooLarge, What: "header section", Limit: int64(p.Limits.MaxHeaderBytes)}
+	}
+	return nil
+}
+
+// Adds a value to a list the way Headers.AddField does, seen says if there was one already
+func joinField(current, value string, seen bool) string {
+	switch {
+	case !seen || current == "":
+		return value
+	case value != "":
+		return current + ", " + value
+	}
+	return current
+}
+
+// Like strconv.ParseInt(s, 16, 32), without making a string
+func parseHex(b []byte) (int64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		var d byte
+		switch {
+		case '0' <= c && c <= '9':
+			d = c - '0'
+		case 'a' <= c && c <= 'f':
+			d = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			d = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | int64(d)
+		if n > math.MaxInt32 {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// Whether te ends with chunked, which has to be the last transfer coding
+func chunkedCoding(te string) bool {
+	last := te[strings.LastIndexByte(te, ',')+1:]
+	return strings.EqualFold(strings.TrimSpace(last), "chunked")
+}
@@ -0,0 +1,212 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Feeds data to p n bytes at a time, like a reader would, and collects the
+// events (with copies of their data)
+func feedAll(t *testing.T, p *Parser, data string, n int) []Event {
+	t.Helper()
+	var all []Event
+	buf := []byte{}
+	for i := 0; i < len(data) || len(buf) > 0; i += n {
+		end := min(i+n, len(data))
+		if i < len(data) {
+			buf = append(buf, data[i:end]...)
+		}
+		consumed, events, err := p.Feed(buf)
+		require.NoError(t, err)
+		for _, ev := range events {
+			ev.Data = append([]byte(nil), ev.Data...)
+			all = append(all, ev)
+		}
+		buf = buf[consumed:]
+		if i >= len(data) {
+			break
+		}
+	}
+	return all
+}
+
+func TestParser(t *testing.T) {
+	// Test: The events of a chunked request, byte by byte
+	raw := "POST /up HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\nX-Sum: abc\r\n\r\n"
+	p := NewParser()
+	assert.Equal(t, StateInitialized, p.State())
+	events := feedAll(t, p, raw, 1)
+	assert.Equal(t, StateDone, p.State())
+
+	var kinds []EventKind
+	body := ""
+	for _, ev := range events {
+		if ev.Kind == EventBody {
+			body += string(ev.Data)
+			continue
+		}
+		kinds = append(kinds, ev.Kind)
+	}
+	assert.Equal(t, []EventKind{EventRequestLine, EventHeader, EventHeader, EventHeadersDone, EventTrailer, EventDone}, kinds)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "POST", events[0].RequestLine.Method)
+	assert.Equal(t, "transfer-encoding", events[2].Name)
+	assert.Equal(t, "chunked", events[2].Value)
+
+	// Test: All at once, with a body, the next request left alone
+	p = NewParser()
+	data := []byte("PUT / HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET / HTTP/1.1\r\n\r\n")
+	n, events, err := p.Feed(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data)-len("GET / HTTP/1.1\r\n\r\n"), n)
+	require.Len(t, events, 5)
+	assert.Equal(t, EventBody, events[3].Kind)
+	assert.Equal(t, "abc", string(events[3].Data))
+	assert.Equal(t, EventDone, events[4].Kind)
+
+	// Test: Nothing more until Reset, then the next one
+	n, events, err = p.Feed(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, events)
+	p.Reset()
+	_, events, err = p.Feed([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, EventDone, events[len(events)-1].Kind)
+
+	// Test: The state says where it stopped
+	p = NewParser()
+	_, _, err = p.Feed([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	assert.Equal(t, StateParsingBody, p.State())
+	assert.Equal(t, "parsing body", p.State().String())
+
+	// Test: Errors come with the events found before them
+	p = NewParser()
+	_, events, err = p.Feed([]byte("GET / HTTP/1.1\r\nHost: x\r\nContent-Length: x\r\n\r\n"))
+	assert.Error(t, err)
+	assert.Equal(t, EventRequestLine, events[0].Kind)
+}
+
+// What a browser sends, more or less
+const smallRequest = "GET /index.html HTTP/1.1\r\n" +
+	"Host: localhost:42069\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64)\r\n" +
+	"Accept: */*\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n"
+
+// Lots of headers and a 64KB body
+var largeRequest = func() string {
+	var b strings.Builder
+	b.WriteString("POST /upload?name=data.bin HTTP/1.1\r\nHost: localhost:42069\r\n")
+	for i := range 40 {
+		fmt.Fprintf(&b, "X-Custom-Header-%d: %s\r\n", i, strings.Repeat("v", 60))
+	}
+	body := strings.Repeat("x", 64<<10)
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return b.String()
+}()
+
+func TestParserAllocs(t *testing.T) {
+	// Test: Common names and values cost nothing, the target and the other
+	// values one string each
+	p := NewParser()
+	data := []byte(smallRequest)
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Reset()
+		_, _, err := p.Feed(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.LessOrEqual(t, allocs, 3.0)
+
+	// Test: The body isn't copied
+	data = []byte(largeRequest)
+	allocs = testing.AllocsPerRun(100, func() {
+		p.Reset()
+		p.Feed(data)
+	})
+	assert.LessOrEqual(t, allocs, 3+40*2.0)
+
+	// Test: A whole Request, maps and all
+	allocs = testing.AllocsPerRun(100, func() {
+		RequestFromReader(strings.NewReader(smallRequest))
+	})
+	assert.LessOrEqual(t, allocs, 14.0)
+}
+
+func benchmarkParser(b *testing.B, raw string) {
+	data := []byte(raw)
+	p := NewParser()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		p.Reset()
+		if _, _, err := p.Feed(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParserSmall(b *testing.B) { benchmarkParser(b, smallRequest) }
+func BenchmarkParserLarge(b *testing.B) { benchmarkParser(b, largeRequest) }
+
+func benchmarkRequestFromReader(b *testing.B, raw string) {
+	r := strings.NewReader(raw)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset(raw)
+		if _, err := RequestFromReader(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRequestFromReaderSmall(b *testing.B) { benchmarkRequestFromReader(b, smallRequest) }
+func BenchmarkRequestFromReaderLarge(b *testing.B) { benchmarkRequestFromReader(b, largeRequest) }
+
+func TestParserLimits(t *testing.T) {
+	limits := Limits{MaxRequestLine: 20, MaxHeaderBytes: 64, MaxHeaderCount: 3, MaxFieldSize: 30, MaxBodySize: 8}
+	status := func(data string) int {
+		p := Parser{Limits: limits}
+		_, _, err := p.Feed([]byte(data))
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			return 0
+		}
+		return limitErr.Status
+	}
+
+	// Test: Right at the limits is fine
+	assert.Equal(t, 0, status("GET /12345 HTTP/1.1\r\nA: "+strings.Repeat("1", 27)+"\r\n\r\n"))
+	assert.Equal(t, 0, status("POST / HTTP/1.1\r\nContent-Length: 8\r\n\r\n12345678"))
+
+	// Test: A request line, or a field, that's too long before it even ends
+	assert.Equal(t, 414, status("GET /1234567890123456789"))
+	assert.Equal(t, 431, status("GET / HTTP/1.1\r\nA: "+strings.Repeat("1", 30)))
+
+	// Test: Too many fields, or too many bytes of them, trailers included
+	assert.Equal(t, 431, status("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n"))
+	assert.Equal(t, 431, status("GET / HTTP/1.1\r\nA: 12345678901234567\r\nB: 12345678901234567\r\nC: 12345678901234567\r\n"))
+	assert.Equal(t, 431, status("POST / HTTP/1.1\r\nA: 1\r\nB: 2\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nC: 3\r\n\r\n"))
+
+	// Test: A body that's too big, by its Content-Length or its chunks
+	assert.Equal(t, 413, status("POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n"))
+	assert.Equal(t, 413, status("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n4\r\n"))
+
+	// Test: RequestFromReader stops reading too
+	_, err := RequestFromReaderWithLimits(strings.NewReader("GET / HTTP/1.1\r\nX: "+strings.Repeat("a", 1<<20)), limits)
+	var limitErr *LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "header field is over the limit of 30", limitErr.Error())
+}
@@ -1,29 +1,61 @@
 package request
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/neixir/httpfromtcp/internal/headers"
 )
 
-// type ParserState int
-const bufferSize = 8
+// Size of the read buffers, enough for the headers of most requests. Bigger
+// requests get a bigger buffer, twice the size each time it's full.
+const bufferSize = 4096
 
-const (
-	requestStateInitialized int = iota
-	requestStateDone
-	requestStateParsingHeaders
-	requestStateParsingBody
-)
+var readBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+// Bodies with a Content-Length get room for all of it up front, up to this
+const maxBodyPrealloc = 1 << 20
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	State       int
+	State       ParserState
+
+	// The trailer fields after a chunked body
+	Trailers headers.Headers
+
+	// Network address of the client, set by the server
+	RemoteAddr string
+
+	// Filled by ParseForm and ParseMultipartForm
+	Form          url.Values
+	PostForm      url.Values
+	MultipartForm *MultipartForm
+
+	// Bytes read from the reader past the end of the request
+	buffered []byte
+
+	// The header names in the order they came, for WriteTo
+	headerOrder []string
+
+	// Does the parsing, parse applies what it finds
+	parser Parser
+
+	ctx context.Context
+
+	// Run by Finish, see OnFinish
+	finish *finishers
 }
 
 type RequestLine struct {
@@ -32,25 +64,42 @@ type RequestLine struct {
 	Method        string
 }
 
+// RequestFromReader reads one request from reader. It returns io.EOF if the
+// reader ends before the request even starts. There's no limit to how big the
+// request can be, see RequestFromReaderWithLimits.
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return RequestFromReaderWithLimits(reader, Limits{})
+}
+
+// RequestFromReaderWithLimits is like RequestFromReader, but the request can't
+// go over limits: it returns a *LimitError as soon as it does.
+func RequestFromReaderWithLimits(reader io.Reader, limits Limits) (*Request, error) {
 	// Instead of reading all the bytes, and then parsing the request line,
 	// it should use a loop to continually read from the reader
 	// and parse new chunks using the parse method.
 
 	// The loop should continue until the parser is in the "done" state.
-	buf := make([]byte, bufferSize)
+	bufp := readBufferPool.Get().(*[]byte)
+	defer readBufferPool.Put(bufp)
+	buf := *bufp
 
 	// This will keep track of how much data we've read from the io.Reader into the buffer.
 	readToIndex := 0
 
 	// Create a new Request struct and set the state to "initialized".
 	r := Request{
-		State:   requestStateInitialized,
-		Headers: headers.Headers{},
+		State:    StateInitialized,
+		Headers:  headers.Headers{},
+		Trailers: headers.Headers{},
+		finish:   &finishers{},
+
+		// Room for the headers of a typical request, instead of growing a few times
+		headerOrder: make([]string, 0, 16),
 	}
+	r.parser.Limits = limits
 
 	// While the state of the parser is not "done":
-	for r.State != requestStateDone {
+	for r.State != StateDone {
 
 		// If the buffer is full (we've read data into the entire buffer), grow it.
 		// Create a new slice that's twice the size and copy the old data into the new slice.
@@ -62,16 +111,21 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 
 		// Read from the io.Reader into the buffer starting at readToIndex.
 		n, err := reader.Read(buf[readToIndex:])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
 
 		// If you hit the end of the reader (io.EOF) set the state to "done" and break out of the loop.
 		// No ha resultat ser tan facil...
 		if err == io.EOF {
 			// First let the parser process anything left in the buffer
 			if readToIndex > 0 {
-				_, err = r.parse(buf[:readToIndex])
+				parsedBytes, err := r.parse(buf[:readToIndex])
 				if err != nil {
 					return nil, err
 				}
+				copy(buf, buf[parsedBytes:])
+				readToIndex -= parsedBytes
 			}
 
 			// FINAL call, with truly empty data and truly at end
@@ -80,7 +134,20 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 				return nil, err
 			}
 
+			// Nothing at all, the connection was closed between requests
+			if r.State == StateInitialized && readToIndex == 0 {
+				return nil, io.EOF
+			}
+
+			// A request line or headers that never ended
+			if r.State == StateParsingHeaders || (r.State == StateInitialized && readToIndex > 0) {
+				return nil, fmt.Errorf("request ended before the end of the headers")
+			}
+
 			// Only now do we check for an incomplete body!
+			if r.chunked() && r.State != StateDone {
+				return nil, fmt.Errorf("chunked body ended early")
+			}
 			contentLength := r.Headers.Get("Content-Length")
 			if contentLength != "" {
 				length, _ := strconv.Atoi(contentLength)
@@ -90,7 +157,7 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 				}
 			}
 
-			r.State = requestStateDone
+			r.State = StateDone
 			break
 		}
 
@@ -112,169 +179,153 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		readToIndex -= parsedBytes
 	}
 
+	// Whatever is left in the buffer belongs to the next thing on the wire
+	// (a pipelined request, or the first bytes of an upgraded protocol).
+	if readToIndex > 0 {
+		r.buffered = make([]byte, readToIndex)
+		copy(r.buffered, buf[:readToIndex])
+	}
+
 	return &r, nil
 
 }
 
+// Context returns the request's context. It is never nil, requests that were not
+// given one get context.Background().
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of the request with its context changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	// The copy must share the cleanup with the original
+	if r.finish == nil {
+		r.finish = &finishers{}
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// Buffered returns the bytes that were read from the reader past the end of the request.
+func (r *Request) Buffered() []byte {
+	return r.buffered
+}
+
 func parseRequestLine(data []byte) (RequestLine, int, error) {
 	// If it can't find an \r\n (this is important!) it should return 0 and no error.
 	// This just means that it needs more data before it can parse the request line.
-	if !strings.Contains(string(data), "\r\n") {
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
 		return RequestLine{}, 0, nil
 	}
 
-	// Agafem fins el primer CRLF que trobem
-	i := strings.Index(string(data), "\r\n")
-	line := string(data[:i])
-
 	rl := RequestLine{}
-	numBytes := len(line)
-	parts := strings.Split(line, " ")
+	numBytes := i - 1
+	if i == 0 || data[i-1] != '\r' {
+		return rl, max(numBytes, 0), fmt.Errorf("malformed request line")
+	}
 
-	if len(parts) != 3 {
+	// Agafem fins el primer CRLF que trobem, i el tallem pels dos espais
+	line := data[:numBytes]
+	method, rest, ok1 := bytes.Cut(line, []byte(" "))
+	target, version, ok2 := bytes.Cut(rest, []byte(" "))
+	if !ok1 || !ok2 || bytes.IndexByte(version, ' ') >= 0 {
 		return rl, numBytes, fmt.Errorf("malformed request line")
 	}
 
 	// Verify that the "method" part only contains capital alphabetic characters.
-	method := parts[0]
+	if len(method) == 0 {
+		return rl, numBytes, fmt.Errorf("missing method")
+	}
 	for _, c := range method {
 		if c < 'A' || c > 'Z' {
 			return rl, numBytes, fmt.Errorf("method is not uppercase")
 		}
 	}
 
-	partsHttp := strings.Split(parts[2], "/")
-	httpVersion := partsHttp[1]
+	// The target must be something we can write back as it is
+	if len(target) == 0 || bytes.ContainsFunc(target, isCTL) {
+		return rl, numBytes, fmt.Errorf("malformed request target")
+	}
+
+	httpName, httpVersion, found := bytes.Cut(version, []byte("/"))
+	if !found || string(httpName) != "HTTP" {
+		return rl, numBytes, fmt.Errorf("malformed http version")
+	}
 
 	// Verify that the http version part is 1.1, extracted from the literal HTTP/1.1 format, as we only support HTTP/1.1 for now.
-	// TODO Tambe podriem comprovar que partsHttp[0] sigui HTTP
-	if httpVersion != "1.1" {
+	if string(httpVersion) != "1.1" {
 		return rl, numBytes, fmt.Errorf("unsupported http version")
 	}
 
-	rl.Method = method
-	rl.HttpVersion = httpVersion
-	rl.RequestTarget = parts[1]
+	rl.Method = internMethod(method)
+	rl.HttpVersion = "1.1"
+	rl.RequestTarget = string(target)
 
 	return rl, numBytes, nil
 
 }
 
-func (r *Request) parse(data []byte) (int, error) {
-	// It accepts the next slice of bytes that needs to be parsed into the Request struct
-	// It updates the "state" of the parser, and the parsed RequestLine field.
-	// It returns the number of bytes it consumed (meaning successfully parsed) and an error if it encountered one.
-	totalBytesParsed := 0
-	for r.State != requestStateDone {
-		n, err := r.parseSingle(data[totalBytesParsed:])
-
-		if err != nil {
-			return n, err
+// The method, without allocating if it's a known one
+func internMethod(b []byte) string {
+	for _, m := range knownMethods {
+		if string(b) == m {
+			return m
 		}
-
-		if n == 0 {
-			return totalBytesParsed, nil
-		}
-
-		totalBytesParsed += n
 	}
-
-	return totalBytesParsed, nil
-
+	return string(b)
 }
 
-func (r *Request) parseSingle(data []byte) (int, error) {
-	switch r.State {
-	case requestStateInitialized:
-		// If the state of the parser is "initialized", it should call qquestLine.
-		rl, n, err := parseRequestLine(data)
-
-		// If there is an error, it should just return the error.
-		if err != nil {
-			return n, err
-		}
-
-		// If zero bytes are parsed, but no error is returned, it should return 0 and nil: it needs more data.
-		if n == 0 {
-			return 0, nil
-		}
-
-		// If bytes are consumed successfully, it should update the .RequestLine field
-		r.RequestLine = rl
-		r.State = requestStateParsingHeaders
-
-		return n + 2, nil // +2 per CRLF
-
-	case requestStateParsingHeaders:
-		totalParsed := 0
-		for {
-			n, done, err := r.Headers.Parse(data[totalParsed:])
-			totalParsed += n
-
-			if err != nil {
-				return totalParsed, err
-			}
-
-			if done {
-				r.State = requestStateParsingBody
-				return totalParsed, nil
-			}
+var knownMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
 
-			if n == 0 {
-				return totalParsed, nil
+func (r *Request) parse(data []byte) (int, error) {
+	// It accepts the next slice of bytes that needs to be parsed into the Request struct,
+	// feeds it to the parser and applies what it found.
+	// It returns the number of bytes it consumed (meaning successfully parsed) and an error if it encountered one.
+	n, events, err := r.parser.Feed(data)
+	for _, ev := range events {
+		switch ev.Kind {
+		case EventRequestLine:
+			r.RequestLine = ev.RequestLine
+		case EventHeader:
+			r.Headers.AddField(ev.Name, ev.Value)
+			r.rememberOrder(ev.Name)
+		case EventBody:
+			if r.Body == nil && r.parser.state == StateParsingBody {
+				r.Body = make([]byte, 0, min(int64(len(ev.Data))+r.parser.bodyLeft, maxBodyPrealloc))
 			}
+			r.Body = append(r.Body, ev.Data...)
+		case EventTrailer:
+			r.Trailers.AddField(ev.Name, ev.Value)
 		}
+	}
+	r.State = r.parser.State()
 
-	case requestStateParsingBody:
-		// If there isn't a Content-Length header, move to the done state, nothing to parse
-		contentLength := r.Headers.Get("Content-Length")
-		if contentLength == "" {
-			r.State = requestStateDone
-			return 0, nil
-		}
-
-		length, err := strconv.Atoi(contentLength)
-		if err != nil {
-			// r.State = requestStateDone
-			return 0, fmt.Errorf("invalid Content-Length")
-		}
-
-		// Figure out how many bytes you still need
-		remaining := length - len(r.Body)
-
-		// If there's more data than you need, only take as much as you need to hit Content-Length.
-		toCopy := data
-		if len(data) > remaining {
-			toCopy = data[:remaining]
-		}
-
-		// Append the right number of bytes from data onto r.Body.
-		r.Body = append(r.Body, toCopy...)
-
-		// If you grabbed extra bytes from data, remember to return the right number (so the rest can be processed next).
+	return n, err
+}
 
-		// After appending, if len(r.Body) is equal to length, you’re done!
-		if len(r.Body) == length {
-			r.State = requestStateDone
-			return len(toCopy), nil
-		}
+// Whether the body is chunked, which has to be the last transfer coding
+func (r *Request) chunked() bool {
+	return chunkedCoding(r.Headers.Get("Transfer-Encoding"))
+}
 
-		// If len(r.Body) is more than length, that’s an error.
-		if len(r.Body) > length {
-			return len(toCopy), fmt.Errorf("actual length is greater than Content-Length (%d > %d)\nBody: [%s]",
-				len(r.Body), length, string(r.Body))
+// Notes the name of a header, the first time it shows up
+func (r *Request) rememberOrder(name string) {
+	for _, seen := range r.headerOrder {
+		if seen == name {
+			return
 		}
-
-		// If less, you need to wait for more data.
-		return len(toCopy), nil
-
-	case requestStateDone:
-		// If the state of the parser is "done", it should return an error that says something like "error: trying to read data in a done state"
-		return 0, fmt.Errorf("trying to read data in a done state")
-
-	default:
-		// If the state is anything else, it should return an error that says something like "error: unknown state"
-		return 0, fmt.Errorf("unknown state")
 	}
+	r.headerOrder = append(r.headerOrder, name)
+}
 
+func isCTL(c rune) bool {
+	return c < 0x20 || c == 0x7F
 }
@@ -1,9 +1,11 @@
 package request
 
 import (
+	"context"
 	"io"
 	"testing"
 
+	"github.com/neixir/httpfromtcp/internal/cookie"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -156,6 +158,75 @@ func TestBodyParse(t *testing.T) {
 
 }
 
+func TestBufferedParse(t *testing.T) {
+	// Test: Bytes past the end of the request are kept
+	reader := &chunkReader{
+		data:            "GET /chat HTTP/1.1\r\nHost: localhost:42069\r\nUpgrade: websocket\r\n\r\n\x81\x85hello",
+		numBytesPerRead: 1024,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/chat", r.RequestLine.RequestTarget)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "\x81\x85hello", string(r.Buffered())+string(rest))
+
+	// Test: Nothing buffered when the request ends with the data
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Empty(t, r.Buffered())
+
+	// Test: Body bytes are not counted as buffered
+	// (the parser only buffers what it happened to read, the rest is still in the reader)
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"helloGET / HTTP/1.1\r\n",
+		numBytesPerRead: 1024,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	rest, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(r.Buffered())+string(rest))
+}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Parsed requests get a background context
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), r.Context())
+
+	// Test: WithContext doesn't modify the original request
+	ctx := ContextWithUser(ContextWithRequestID(context.Background(), "req-1"), "lane")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, context.Background(), r.Context())
+	assert.Equal(t, "req-1", RequestIDFromContext(r2.Context()))
+	assert.Equal(t, "lane", UserFromContext(r2.Context()))
+	assert.Equal(t, r.RequestLine, r2.RequestLine)
+
+	// Test: Missing values
+	assert.Equal(t, "", RequestIDFromContext(r.Context()))
+	assert.Nil(t, UserFromContext(r.Context()))
+}
+
 // Read reads up to len(p) or numBytesPerRead bytes from the string per call
 // its useful for simulating reading a variable number of bytes per chunk from a network connection
 func (cr *chunkReader) Read(p []byte) (n int, err error) {
@@ -174,3 +245,25 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+func TestRequestCookies(t *testing.T) {
+	// Test: Cookies from one or more Cookie headers
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nCookie: session=abc; theme=\"dark\"\r\nCookie: lang=ca\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+
+	assert.Len(t, r.Cookies(), 3)
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", c.Value)
+	c, err = r.Cookie("lang")
+	require.NoError(t, err)
+	assert.Equal(t, "ca", c.Value)
+
+	// Test: Missing
+	_, err = r.Cookie("nope")
+	assert.ErrorIs(t, err, cookie.ErrNoCookie)
+}
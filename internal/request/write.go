@@ -0,0 +1,183 @@
+package request
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+)
+
+// WriteTo writes the request to w the way it goes on the wire: the request line,
+// the headers in the order they were parsed (the ones added later go after them,
+// Host first and the rest sorted), and the body.
+//
+// The body is framed by the headers: chunked, with the Trailers after it, if
+// Transfer-Encoding says so, and with a Content-Length matching Body otherwise.
+// Parsing what WriteTo writes gives back the same request.
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	err := r.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	method := r.RequestLine.Method
+	if method == "" {
+		method = "GET"
+	}
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/%s\r\n", method, r.RequestLine.RequestTarget, version)
+
+	chunked := r.chunked()
+	wroteLength := false
+
+	for _, key := range r.orderedKeys() {
+		value := r.Headers[key]
+
+		if strings.EqualFold(key, "Content-Length") {
+			// Chunks and a length don't go together, and the length is the body's
+			if chunked {
+				continue
+			}
+			if n, err := strconv.Atoi(value); err != nil || n != len(r.Body) {
+				value = strconv.Itoa(len(r.Body))
+			}
+			wroteLength = true
+		}
+
+		writeField(bw, key, value)
+	}
+
+	if !chunked && !wroteLength && len(r.Body) > 0 {
+		writeField(bw, "Content-Length", strconv.Itoa(len(r.Body)))
+	}
+	bw.WriteString("\r\n")
+
+	if chunked {
+		if len(r.Body) > 0 {
+			fmt.Fprintf(bw, "%x\r\n", len(r.Body))
+			bw.Write(r.Body)
+			bw.WriteString("\r\n")
+		}
+		bw.WriteString("0\r\n")
+		for _, key := range slices.Sorted(maps.Keys(r.Trailers)) {
+			writeField(bw, key, r.Trailers[key])
+		}
+		bw.WriteString("\r\n")
+	} else {
+		bw.Write(r.Body)
+	}
+
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// Checks there's nothing that would come out as something else on the wire
+func (r *Request) validate() error {
+	for _, c := range r.RequestLine.Method {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("invalid method %q", r.RequestLine.Method)
+		}
+	}
+
+	target := r.RequestLine.RequestTarget
+	if target == "" || strings.ContainsFunc(target, func(c rune) bool { return c == ' ' || isCTL(c) }) {
+		return fmt.Errorf("invalid request target %q", target)
+	}
+
+	if v := r.RequestLine.HttpVersion; v != "" && v != "1.1" {
+		return fmt.Errorf("unsupported http version %q", v)
+	}
+
+	err := validateFields(r.Headers)
+	if err != nil {
+		return err
+	}
+	err = validateFields(r.Trailers)
+	if err != nil {
+		return err
+	}
+
+	if len(r.Trailers) > 0 && !r.chunked() {
+		return errors.New("trailers need a chunked body")
+	}
+
+	return nil
+}
+
+func validateFields(h headers.Headers) error {
+	for key, value := range h {
+		if key == "" || strings.ContainsFunc(key, func(c rune) bool { return c <= ' ' || c == ':' || c == 0x7F }) {
+			return fmt.Errorf("invalid header name %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("invalid value for header %q", key)
+		}
+	}
+	return nil
+}
+
+// The header keys in the order they were parsed, then the rest sorted
+func (r *Request) orderedKeys() []string {
+	keys := make([]string, 0, len(r.Headers))
+	done := make(map[string]bool, len(r.Headers))
+
+	// Keys may have changed case since they were parsed (Set("Host", ...))
+	for _, name := range r.headerOrder {
+		for key := range r.Headers {
+			if !done[key] && strings.EqualFold(key, name) {
+				keys = append(keys, key)
+				done[key] = true
+			}
+		}
+	}
+
+	var rest []string
+	for key := range r.Headers {
+		if !done[key] {
+			rest = append(rest, key)
+		}
+	}
+	// Host goes first, where everybody expects it
+	slices.SortFunc(rest, func(a, b string) int {
+		aHost, bHost := strings.EqualFold(a, "Host"), strings.EqualFold(b, "Host")
+		switch {
+		case aHost && !bHost:
+			return -1
+		case bHost && !aHost:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	return append(keys, rest...)
+}
+
+func writeField(w *bufio.Writer, key, value string) {
+	w.WriteString(key)
+	w.WriteString(": ")
+	w.WriteString(value)
+	w.WriteString("\r\n")
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
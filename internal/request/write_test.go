@@ -0,0 +1,145 @@
+package request
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunks, with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7;name=value\r\n, world\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers.Get("X-Checksum"))
+	assert.Empty(t, r.Buffered())
+
+	// Test: Cut short
+	for _, data := range []string{
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+	} {
+		_, err = RequestFromReader(&chunkReader{data: data, numBytesPerRead: 4})
+		assert.Error(t, err, data)
+	}
+
+	// Test: Malformed
+	for _, data := range []string{
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+	} {
+		_, err = RequestFromReader(&chunkReader{data: data, numBytesPerRead: 4})
+		assert.Error(t, err, data)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	// Test: Headers come out in the order they went in
+	data := "POST /submit?x=1 HTTP/1.1\r\n" +
+		"host: localhost:42069\r\n" +
+		"user-agent: curl/7.81.0\r\n" +
+		"accept: */*\r\n" +
+		"content-type: text/plain\r\n" +
+		"content-length: 5\r\n" +
+		"\r\n" +
+		"hello"
+	r, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: 7})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf.String())
+	assert.Equal(t, int64(len(data)), n)
+
+	// Test: Changed headers keep their place, added ones go last, and the length follows the body
+	r.Headers.Set("X-Added", "1")
+	r.Headers.Set("Host", "example.com")
+	r.Body = []byte("hi")
+	buf.Reset()
+	_, err = r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /submit?x=1 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"user-agent: curl/7.81.0\r\n"+
+		"accept: */*\r\n"+
+		"content-type: text/plain\r\n"+
+		"content-length: 2\r\n"+
+		"X-Added: 1\r\n"+
+		"\r\n"+
+		"hi", buf.String())
+
+	// Test: Chunked, with trailers
+	r = &Request{
+		RequestLine: RequestLine{Method: "PUT", RequestTarget: "/file", HttpVersion: "1.1"},
+		Headers:     headers.Headers{"Transfer-Encoding": "chunked"},
+		Trailers:    headers.Headers{"X-Checksum": "abc"},
+		Body:        []byte("some data"),
+	}
+	buf.Reset()
+	_, err = r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /file HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n9\r\nsome data\r\n0\r\nX-Checksum: abc\r\n\r\n", buf.String())
+
+	// Test: Nothing that would change the meaning on the wire
+	bad := []*Request{
+		{RequestLine: RequestLine{Method: "get", RequestTarget: "/"}},
+		{RequestLine: RequestLine{Method: "GET", RequestTarget: "/a b"}},
+		{RequestLine: RequestLine{Method: "GET", RequestTarget: ""}},
+		{RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Headers: headers.Headers{"X-Evil": "a\r\nInjected: 1"}},
+		{RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Headers: headers.Headers{"Bad Name": "1"}},
+		{RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Trailers: headers.Headers{"X-Sum": "1"}},
+	}
+	for _, r := range bad {
+		_, err = r.WriteTo(&buf)
+		assert.Error(t, err, r.RequestLine)
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
+	f.Add("POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Length: 13\r\n\r\nhello world!\n")
+	f.Add("POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7;x=y\r\n, world\r\n0\r\nX-Sum: abc\r\n\r\n")
+	f.Add("GET /x HTTP/1.1\r\nCookie: a=1\r\nCookie: b=2\r\nAccept: a\r\nAccept: b\r\n\r\n")
+	f.Add("GET / HTTP/1.1\r\nX-Empty:\r\nContent-Length: +0\r\n\r\n")
+
+	// parse(write(r)) must be r, for every r the parser accepts
+	f.Fuzz(func(t *testing.T, data string) {
+		r, err := RequestFromReader(strings.NewReader(data))
+		// No request line at all is no request
+		if err != nil || r.RequestLine.Method == "" {
+			return
+		}
+
+		var buf bytes.Buffer
+		_, err = r.WriteTo(&buf)
+		require.NoError(t, err)
+
+		r2, err := RequestFromReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err, buf.String())
+
+		assert.Equal(t, r.RequestLine, r2.RequestLine)
+		assert.Equal(t, r.Headers, r2.Headers)
+		assert.Equal(t, string(r.Body), string(r2.Body))
+		assert.Equal(t, r.Trailers, r2.Trailers)
+		assert.Equal(t, r.headerOrder, r2.headerOrder)
+	})
+}
@@ -0,0 +1,123 @@
+package response
+
+import (
+	"io"
+	"maps"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+)
+
+// A Filter gets to look at a response right before its headers go out, which is how
+// middleware changes responses it didn't write (compression, cookies...).
+// It receives the status and the headers, which it may modify. If it wants to
+// transform the body too, it returns a WriteCloser that wraps next: the body is
+// written to it, what it writes to next goes on towards the client, and it's
+// closed when the body is over. Returning nil leaves the body alone.
+type Filter func(status StatusCode, h headers.Headers, next io.Writer) io.WriteCloser
+
+// AddFilter registers a filter for this response. While there are filters the
+// status line is held back until WriteHeaders, so they can see both together.
+// Filters added later are closer to the handler, like nested middleware: they see
+// its headers first, and its body goes through them first.
+func (w *Writer) AddFilter(f Filter) {
+	w.filters = append(w.filters, f)
+}
+
+// Finish ends a body that went through a filter, for handlers that don't say how
+// long their body is and just return. Middleware that adds a body filter should
+// call it once the handler is done. It does nothing if there's nothing to finish.
+func (w *Writer) Finish() error {
+	if w.body == nil {
+		return nil
+	}
+	return w.endBody(nil)
+}
+
+// Runs the filters over a copy of h (the handler may still be using its map) and
+// returns the headers to send. If any filter wraps the body, w.body becomes the
+// start of the chain.
+func (w *Writer) applyFilters(h headers.Headers) headers.Headers {
+	out := maps.Clone(h)
+	if out == nil {
+		out = headers.Headers{}
+	}
+
+	// Each filter gets a forwarder as next, bound once we know what comes after it
+	entry := &forwarder{}
+	last := entry
+	var closers []io.Closer
+
+	for i := len(w.filters) - 1; i >= 0; i-- {
+		next := &forwarder{}
+		wc := w.filters[i](w.status, out, next)
+		if wc == nil {
+			continue
+		}
+		last.w = wc
+		last = next
+		closers = append(closers, wc)
+	}
+
+	if len(closers) == 0 {
+		return out
+	}
+
+	last.w = wireWriter{w}
+	w.body = entry
+	w.closers = closers
+	w.wireChunked = out.HasToken("Transfer-Encoding", "chunked")
+
+	return out
+}
+
+// Closes the filters, from the handler's side to the wire's, and ends the chunked body.
+func (w *Writer) endBody(trailer headers.Headers) error {
+	var err error
+	for _, c := range w.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if w.wireChunked && err == nil {
+		_, err = w.dst.Write(lastChunk(trailer))
+	}
+
+	w.body = nil
+	w.closers = nil
+	w.isChunked = false
+	w.writerStatus = writerStateReadyForStatus
+	w.complete = err == nil
+
+	return err
+}
+
+type forwarder struct {
+	w io.Writer
+}
+
+func (f *forwarder) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+// The end of the filter chain: frames what comes out of the filters the way the
+// final headers say and writes it out.
+type wireWriter struct {
+	w *Writer
+}
+
+func (ww wireWriter) Write(p []byte) (int, error) {
+	if !ww.w.wireChunked {
+		return ww.w.dst.Write(p)
+	}
+
+	// An empty chunk would end the body
+	if len(p) == 0 {
+		return 0, nil
+	}
+	err := writeChunk(ww.w.dst, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,500 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+)
+
+// The same idea as the request parser, with a few more states for the body
+const (
+	responseStateInitialized int = iota
+	responseStateDone
+	responseStateParsingHeaders
+	responseStateParsingBody
+	responseStateParsingChunkSize
+	responseStateParsingChunkData
+	responseStateParsingChunkEnd
+	responseStateParsingTrailers
+)
+
+// Where a ResponseReader starts, enough for the headers of most responses
+const readBufferSize = 4096
+
+// A Response is what a client gets back, the other end of Writer.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+	State      int
+
+	// The fields of the trailer section of a chunked body. It's filled when the
+	// end of the body is parsed, empty until then.
+	Trailers headers.Headers
+
+	// The 1xx responses (100 Continue, 103 Early Hints...) that came before this
+	// one, with their status lines and headers. 101 Switching Protocols isn't one
+	// of them, it's a final response.
+	Interim []*Response
+
+	// The method of the request this answers, HEAD responses have no body
+	method string
+
+	// How the body is framed, worked out once the headers are in.
+	// bodyLength is -1 when the body goes on until the connection is closed.
+	bodyLength int64
+	bodyRead   int64
+	chunkLeft  int64
+
+	// Bytes read from the reader past the end of the response
+	buffered []byte
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// ResponseFromReader reads a whole response, body included, from reader.
+// It takes it for the answer to a GET, use a ResponseReader with its Method set
+// for a HEAD.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return NewResponseReader(reader).ReadResponse()
+}
+
+// Buffered returns the bytes that were read from the reader past the end of the response.
+func (r *Response) Buffered() []byte {
+	return r.buffered
+}
+
+// CloseDelimited reports whether the body ends when the connection is closed,
+// so that the connection can't be used for anything else afterwards.
+func (r *Response) CloseDelimited() bool {
+	return r.bodyLength < 0
+}
+
+// A ResponseReader reads a response a bit at a time, for when the body is too
+// big, or too slow, to wait for all of it: ReadHeader parses the status line and
+// the headers, and then Read returns the body as it arrives, without its framing.
+type ResponseReader struct {
+	// The method of the request, if it matters: the response to a HEAD has
+	// no body, whatever its headers say. Set it before reading.
+	Method string
+
+	reader io.Reader
+	res    *Response
+
+	// Read but not parsed yet: buf[start:end]
+	buf        []byte
+	start, end int
+
+	// How much of res.Body Read has returned already
+	bodyOff int
+
+	// From the reader, kept until the buffered data runs out
+	readErr error
+	// From the parser, once there's one nothing else works
+	err error
+}
+
+// NewResponseReader returns a ResponseReader for the response in reader.
+func NewResponseReader(reader io.Reader) *ResponseReader {
+	return &ResponseReader{
+		reader: reader,
+		res: &Response{
+			State:    responseStateInitialized,
+			Headers:  headers.Headers{},
+			Trailers: headers.Headers{},
+		},
+		buf: make([]byte, readBufferSize),
+	}
+}
+
+// ReadHeader reads up to the end of the headers and returns the response, with
+// an empty Body. Read the body with Read.
+func (rr *ResponseReader) ReadHeader() (*Response, error) {
+	for rr.res.State == responseStateInitialized || rr.res.State == responseStateParsingHeaders {
+		err := rr.step()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rr.res, nil
+}
+
+// ReadResponse reads the rest of the response, and returns it with the whole body.
+func (rr *ResponseReader) ReadResponse() (*Response, error) {
+	for rr.res.State != responseStateDone {
+		err := rr.step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// What's left is copied, the buffer isn't ours to give away
+	if leftover := rr.Buffered(); len(leftover) > 0 {
+		rr.res.buffered = append([]byte(nil), leftover...)
+	}
+
+	return rr.res, nil
+}
+
+// Read reads the body, dechunked if it was chunked. It returns io.EOF at the end
+// of the body, and io.ErrUnexpectedEOF if the connection ends before that.
+func (rr *ResponseReader) Read(p []byte) (int, error) {
+	for rr.bodyOff == len(rr.res.Body) {
+		// Everything returned, so the space can be used again
+		rr.res.Body = rr.res.Body[:0]
+		rr.bodyOff = 0
+
+		if rr.res.State == responseStateDone {
+			return 0, io.EOF
+		}
+
+		err := rr.step()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, rr.res.Body[rr.bodyOff:])
+	rr.bodyOff += n
+	return n, nil
+}
+
+// Done reports whether the whole response has been read.
+func (rr *ResponseReader) Done() bool {
+	return rr.res.State == responseStateDone
+}
+
+// Buffered returns what was read from the reader but isn't part of the response
+// so far. Once the response is done, that's the start of whatever comes next.
+func (rr *ResponseReader) Buffered() []byte {
+	return rr.buf[rr.start:rr.end]
+}
+
+// Parses what's in the buffer and, if that doesn't get anywhere, reads some more.
+func (rr *ResponseReader) step() error {
+	if rr.err != nil {
+		return rr.err
+	}
+	rr.res.method = rr.Method
+
+	n, err := rr.res.parse(rr.buf[rr.start:rr.end])
+	rr.start += n
+	if err != nil {
+		rr.err = err
+		return err
+	}
+	if n > 0 || rr.res.State == responseStateDone {
+		return nil
+	}
+
+	// Needs more data. Move what's left to the front, and grow the buffer if
+	// it's full of a single line.
+	if rr.start > 0 {
+		copy(rr.buf, rr.buf[rr.start:rr.end])
+		rr.end -= rr.start
+		rr.start = 0
+	}
+	if rr.end == len(rr.buf) {
+		newbuf := make([]byte, len(rr.buf)*2)
+		copy(newbuf, rr.buf)
+		rr.buf = newbuf
+	}
+
+	if rr.readErr != nil {
+		return rr.eof(rr.readErr)
+	}
+
+	m, err := rr.reader.Read(rr.buf[rr.end:])
+	rr.end += m
+	if err != nil {
+		// Whatever came with the error gets parsed first
+		if m > 0 {
+			rr.readErr = err
+			return nil
+		}
+		return rr.eof(err)
+	}
+
+	return nil
+}
+
+// The reader has nothing more. That's the end of a body that lasts until the
+// connection is closed, and a mistake anywhere else.
+func (rr *ResponseReader) eof(err error) error {
+	if err == io.EOF {
+		if rr.res.State == responseStateParsingBody && rr.res.bodyLength < 0 {
+			rr.res.State = responseStateDone
+			return nil
+		}
+		err = io.ErrUnexpectedEOF
+	}
+	rr.err = err
+	return err
+}
+
+// Returns the bytes it used, CRLF included, or 0 if there isn't a whole line yet.
+func parseStatusLine(data []byte) (StatusLine, int, error) {
+	i := strings.Index(string(data), "\r\n")
+	if i < 0 {
+		return StatusLine{}, 0, nil
+	}
+	line := string(data[:i])
+
+	sl := StatusLine{}
+
+	// The reason phrase can have spaces in it, or not be there at all
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return sl, i, fmt.Errorf("malformed status line")
+	}
+
+	switch parts[0] {
+	case "HTTP/1.1":
+		sl.HttpVersion = "1.1"
+	case "HTTP/1.0":
+		sl.HttpVersion = "1.0"
+	default:
+		return sl, i, fmt.Errorf("unsupported http version")
+	}
+
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 3 || code < 100 {
+		return sl, i, fmt.Errorf("malformed status code")
+	}
+	sl.StatusCode = StatusCode(code)
+
+	if len(parts) == 3 {
+		sl.ReasonPhrase = parts[2]
+	}
+
+	return sl, i + 2, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.State != responseStateDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return totalBytesParsed + n, err
+		}
+
+		if n == 0 {
+			return totalBytesParsed, nil
+		}
+
+		totalBytesParsed += n
+	}
+
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.State {
+	case responseStateInitialized:
+		sl, n, err := parseStatusLine(data)
+		if err != nil {
+			return n, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+
+		r.StatusLine = sl
+		r.State = responseStateParsingHeaders
+		return n, nil
+
+	case responseStateParsingHeaders:
+		totalParsed := 0
+		for {
+			n, done, err := r.Headers.Parse(data[totalParsed:])
+			totalParsed += n
+			if err != nil {
+				return totalParsed, err
+			}
+
+			if done {
+				err = r.startBody()
+				return totalParsed, err
+			}
+
+			if n == 0 {
+				return totalParsed, nil
+			}
+		}
+
+	case responseStateParsingBody:
+		if len(data) == 0 {
+			return 0, nil
+		}
+
+		// Until the connection is closed, take everything
+		if r.bodyLength < 0 {
+			r.Body = append(r.Body, data...)
+			r.bodyRead += int64(len(data))
+			return len(data), nil
+		}
+
+		toCopy := data
+		if remaining := r.bodyLength - r.bodyRead; int64(len(data)) > remaining {
+			toCopy = data[:remaining]
+		}
+		r.Body = append(r.Body, toCopy...)
+		r.bodyRead += int64(len(toCopy))
+
+		if r.bodyRead == r.bodyLength {
+			r.State = responseStateDone
+		}
+		return len(toCopy), nil
+
+	case responseStateParsingChunkSize:
+		i := strings.Index(string(data), "\r\n")
+		if i < 0 {
+			return 0, nil
+		}
+
+		// Chunk extensions (";name=value") are allowed, and ignored
+		sizeText, _, _ := strings.Cut(string(data[:i]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return i, fmt.Errorf("malformed chunk size")
+		}
+
+		if size == 0 {
+			r.State = responseStateParsingTrailers
+		} else {
+			r.chunkLeft = size
+			r.State = responseStateParsingChunkData
+		}
+		return i + 2, nil
+
+	case responseStateParsingChunkData:
+		if len(data) == 0 {
+			return 0, nil
+		}
+
+		toCopy := data
+		if int64(len(data)) > r.chunkLeft {
+			toCopy = data[:r.chunkLeft]
+		}
+		r.Body = append(r.Body, toCopy...)
+		r.bodyRead += int64(len(toCopy))
+		r.chunkLeft -= int64(len(toCopy))
+
+		if r.chunkLeft == 0 {
+			r.State = responseStateParsingChunkEnd
+		}
+		return len(toCopy), nil
+
+	case responseStateParsingChunkEnd:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, fmt.Errorf("chunk data is longer than its size")
+		}
+		r.State = responseStateParsingChunkSize
+		return 2, nil
+
+	case responseStateParsingTrailers:
+		totalParsed := 0
+		for {
+			n, done, err := r.Trailers.Parse(data[totalParsed:])
+			totalParsed += n
+			if err != nil {
+				return totalParsed, err
+			}
+
+			if done {
+				r.State = responseStateDone
+				return totalParsed, nil
+			}
+
+			if n == 0 {
+				return totalParsed, nil
+			}
+		}
+
+	case responseStateDone:
+		return 0, fmt.Errorf("trying to read data in a done state")
+
+	default:
+		return 0, fmt.Errorf("unknown state")
+	}
+}
+
+// Works out how the body is framed (RFC 9112, section 6.3) and moves on to it.
+func (r *Response) startBody() error {
+	code := r.StatusLine.StatusCode
+
+	// An interim response, the real one comes after it
+	if code >= 100 && code < 200 && code != StatusSwitchingProtocols {
+		r.Interim = append(r.Interim, &Response{StatusLine: r.StatusLine, Headers: r.Headers})
+		r.StatusLine = StatusLine{}
+		r.Headers = headers.Headers{}
+		r.State = responseStateInitialized
+		return nil
+	}
+
+	// These never have a body, even with a Content-Length: for a HEAD it's the
+	// length the GET would have had, and for a 304 the length of what's cached.
+	// After a 101 the connection speaks another protocol.
+	if r.method == "HEAD" || code == StatusSwitchingProtocols || code == StatusNoContent || code == StatusNotModified {
+		r.State = responseStateDone
+		return nil
+	}
+
+	te := r.Headers.Get("Transfer-Encoding")
+	if te != "" {
+		// Chunked has to be the last coding, anything else lasts until the close
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.State = responseStateParsingChunkSize
+			return nil
+		}
+		r.bodyLength = -1
+		r.State = responseStateParsingBody
+		return nil
+	}
+
+	cl := r.Headers.Get("Content-Length")
+	if cl == "" {
+		r.bodyLength = -1
+		r.State = responseStateParsingBody
+		return nil
+	}
+
+	length, err := parseContentLength(cl)
+	if err != nil {
+		return err
+	}
+
+	r.bodyLength = length
+	if length == 0 {
+		r.State = responseStateDone
+	} else {
+		r.State = responseStateParsingBody
+	}
+	return nil
+}
+
+// Repeated Content-Length headers end up joined with commas, and that's fine
+// as long as they all say the same.
+func parseContentLength(value string) (int64, error) {
+	var length int64 = -1
+	for _, v := range strings.Split(value, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || n < 0 || (length >= 0 && n != length) {
+			return 0, errors.New("invalid Content-Length")
+		}
+		length = n
+	}
+	return length, nil
+}
@@ -0,0 +1,175 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call
+// its useful for simulating reading a variable number of bytes per chunk from a network connection
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Content-Length, a byte at a time
+	r, err := ResponseFromReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 13\r\nContent-Type: text/plain\r\n\r\nhello, world!",
+		numBytesPerRead: 1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StatusLine{HttpVersion: "1.1", StatusCode: StatusOk, ReasonPhrase: "OK"}, r.StatusLine)
+	assert.Equal(t, "text/plain", r.Headers.Get("Content-Type"))
+	assert.Equal(t, "hello, world!", string(r.Body))
+
+	// Test: Reason phrases with spaces, or none at all
+	r, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", numBytesPerRead: 7})
+	require.NoError(t, err)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+	r, err = ResponseFromReader(&chunkReader{data: "HTTP/1.0 599\r\nContent-Length: 0\r\n\r\n", numBytesPerRead: 7})
+	require.NoError(t, err)
+	assert.Equal(t, StatusLine{HttpVersion: "1.0", StatusCode: 599}, r.StatusLine)
+
+	// Test: Chunked, with extensions and trailers
+	r, err = ResponseFromReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\nX-Sum: abc\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers.Get("X-Sum"))
+	assert.Empty(t, r.Headers.Get("X-Sum"))
+
+	// Test: Until the connection closes
+	r, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\n\r\nall of this", numBytesPerRead: 4})
+	require.NoError(t, err)
+	assert.Equal(t, "all of this", string(r.Body))
+
+	// Test: Whatever comes after the response is kept
+	r, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1", numBytesPerRead: 100})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+	assert.Equal(t, "HTTP/1.1", string(r.Buffered()))
+
+	// Test: Cut short
+	_, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nshort", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-", numBytesPerRead: 3})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Malformed
+	for _, data := range []string{
+		"HTTP/2 200 OK\r\n\r\n",
+		"HTTP/1.1 20 OK\r\n\r\n",
+		"HTTP/1.1 abc OK\r\n\r\n",
+		"HTTP/1.1\r\n\r\n",
+		"\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n",
+	} {
+		_, err = ResponseFromReader(&chunkReader{data: data, numBytesPerRead: 5})
+		assert.Error(t, err, data)
+	}
+}
+
+func TestResponseNoBody(t *testing.T) {
+	// Test: 204 and 304 have no body, whatever the headers say
+	for _, status := range []string{"204 No Content", "304 Not Modified"} {
+		r, err := ResponseFromReader(&chunkReader{
+			data:            "HTTP/1.1 " + status + "\r\nContent-Length: 100\r\n\r\nHTTP/1.1 200 OK\r\n",
+			numBytesPerRead: 6,
+		})
+		require.NoError(t, err, status)
+		assert.Empty(t, r.Body, status)
+		assert.False(t, r.CloseDelimited(), status)
+	}
+
+	// Test: Neither has the answer to a HEAD, and what follows is the next response
+	rr := NewResponseReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\nHTTP/1.1 200 OK\r\n"))
+	rr.Method = "HEAD"
+	r, err := rr.ReadResponse()
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", string(r.Buffered()))
+
+	// Test: The same for a GET does have a body
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Interim responses come before the real one
+	r, err = ResponseFromReader(&chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 9,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StatusOk, r.StatusLine.StatusCode)
+	assert.Equal(t, "ok", string(r.Body))
+	require.Len(t, r.Interim, 2)
+	assert.Equal(t, StatusCode(100), r.Interim[0].StatusLine.StatusCode)
+	assert.Equal(t, "</style.css>; rel=preload", r.Interim[1].Headers.Get("Link"))
+	assert.Empty(t, r.Headers.Get("Link"))
+
+	// Test: 101 is the end, the rest belongs to the new protocol
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x00"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusSwitchingProtocols, r.StatusLine.StatusCode)
+	assert.Empty(t, r.Interim)
+	assert.Equal(t, "\x81\x00", string(r.Buffered()))
+}
+
+func TestResponseReader(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n" + "1\r\n \r\n" + "5\r\nworld\r\n" + "0\r\n\r\n"
+	rr := NewResponseReader(&chunkReader{data: data, numBytesPerRead: 4})
+
+	// Test: Headers first, without any of the body
+	r, err := rr.ReadHeader()
+	require.NoError(t, err)
+	assert.Equal(t, StatusOk, r.StatusLine.StatusCode)
+	assert.Equal(t, "chunked", r.Headers.Get("Transfer-Encoding"))
+	assert.Empty(t, r.Body)
+	assert.False(t, rr.Done())
+
+	// Test: Then the body, in small reads
+	var got strings.Builder
+	buf := make([]byte, 3)
+	for {
+		n, err := rr.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "hello world", got.String())
+	assert.True(t, rr.Done())
+
+	// Test: A body that's cut short is an error, not a short body
+	rr = NewResponseReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc"))
+	_, err = rr.ReadHeader()
+	require.NoError(t, err)
+	_, err = io.ReadAll(rr)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
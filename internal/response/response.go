@@ -1,10 +1,13 @@
 package response
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/neixir/httpfromtcp/internal/headers"
 )
@@ -13,11 +16,75 @@ import (
 type StatusCode int
 
 const (
-	StatusOk                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOk                          StatusCode = 200
+	StatusCreated                     StatusCode = 201
+	StatusNoContent                   StatusCode = 204
+	StatusPartialContent              StatusCode = 206
+	StatusMovedPermanently            StatusCode = 301
+	StatusFound                       StatusCode = 302
+	StatusSeeOther                    StatusCode = 303
+	StatusNotModified                 StatusCode = 304
+	StatusTemporaryRedirect           StatusCode = 307
+	StatusPermanentRedirect           StatusCode = 308
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusPreconditionFailed          StatusCode = 412
+	StatusContentTooLarge             StatusCode = 413
+	StatusURITooLong                  StatusCode = 414
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusRangeNotSatisfiable         StatusCode = 416
+	StatusTeapot                      StatusCode = 418
+	StatusUnprocessableContent        StatusCode = 422
+	StatusUpgradeRequired             StatusCode = 426
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
 
+// Reason phrases for the status line. Codes that aren't here get a blank reason.
+var statusText = map[StatusCode]string{
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOk:                          "OK",
+	StatusCreated:                     "Created",
+	StatusNoContent:                   "No Content",
+	StatusPartialContent:              "Partial Content",
+	StatusMovedPermanently:            "Moved Permanently",
+	StatusFound:                       "Found",
+	StatusSeeOther:                    "See Other",
+	StatusNotModified:                 "Not Modified",
+	StatusTemporaryRedirect:           "Temporary Redirect",
+	StatusPermanentRedirect:           "Permanent Redirect",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusPreconditionFailed:          "Precondition Failed",
+	StatusContentTooLarge:             "Content Too Large",
+	StatusURITooLong:                  "URI Too Long",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusRangeNotSatisfiable:         "Range Not Satisfiable",
+	StatusTeapot:                      "I'm a teapot",
+	StatusUnprocessableContent:        "Unprocessable Content",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+}
+
+// Returns the reason phrase for the code, or "" if we don't know it.
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
+
 type WriterStatus int
 
 const (
@@ -26,112 +93,329 @@ const (
 	writerStateReadyForBody
 )
 
+// Returned by the Writer methods once the handler has taken over the connection.
+var ErrHijacked = errors.New("connection has been hijacked")
+
+// Returned when what the Writer writes to can't do what was asked (Hijack, SetWriteDeadline).
+var ErrNotSupported = errors.New("not supported by the underlying writer")
+
+// A Writer writes to any io.Writer. These are the extras it looks for in it:
+
+// A Flusher holds on to what's written until Flush, like a bufio.Writer.
+type Flusher interface {
+	Flush() error
+}
+
+// A DeadlineSetter can give up on writes that take too long, like a net.Conn.
+type DeadlineSetter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// A Hijacker can hand over the connection it writes to, for writers that wrap
+// one. A net.Conn is its own connection, it doesn't need to be a Hijacker.
+type Hijacker interface {
+	Hijack() (net.Conn, error)
+}
+
 type Writer struct {
-	conn         net.Conn
+	// Where the response goes, usually the connection
+	dst          io.Writer
 	writerStatus WriterStatus
 	isChunked    bool
+
+	// From the Content-Length header (-1 if there isn't one), and how much of it has been written
+	contentLength int64
+	bodyWritten   int64
+
+	// Whether any body bytes went out at all, chunked or not
+	wroteBody bool
+
+	// Bytes the request parser read past the end of the request,
+	// handed over together with the connection on Hijack.
+	buffered []byte
+	hijacked bool
+
+	// Called right before the connection is handed over on Hijack
+	beforeHijack func() []byte
+
+	// Filters, and the status line they hold back until the headers are written
+	filters []Filter
+	status  StatusCode
+
+	// Where the response is at, for KeepAlive
+	sentHeaders bool
+	complete    bool
+	closeAfter  bool
+
+	// When a filter takes over the body, the handler's writes go into body, and
+	// come out of the filters framed as wireChunked says
+	body        io.Writer
+	closers     []io.Closer
+	wireChunked bool
 }
 
-// In the response package
-func NewWriter(conn net.Conn) *Writer {
+// NewWriter returns a Writer that writes the response to dst: a connection, or
+// anything else, like a buffer, a file or a wrapper around the connection.
+func NewWriter(dst io.Writer) *Writer {
 	return &Writer{
-		conn:         conn,
-		writerStatus: writerStateReadyForStatus,
+		dst:           dst,
+		writerStatus:  writerStateReadyForStatus,
+		contentLength: -1,
+	}
+}
+
+// Like NewWriter, but remembers the bytes that were already read from the connection
+// past the end of the request, so Hijack can return them.
+func NewWriterWithBuffered(dst io.Writer, buffered []byte) *Writer {
+	w := NewWriter(dst)
+	w.buffered = buffered
+	return w
+}
+
+// Hijack lets the handler take over the connection, for example to switch to another protocol.
+// It returns the underlying connection and any bytes that were read past the end of the request,
+// which must be processed before reading from the connection again.
+// After a call to Hijack the server won't write to or close the connection; that's up to the caller.
+// It fails with ErrNotSupported if the Writer doesn't write to a net.Conn or a Hijacker.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+
+	// What was written before the hijack goes first
+	err := w.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conn net.Conn
+	switch dst := w.dst.(type) {
+	case Hijacker:
+		conn, err = dst.Hijack()
+		if err != nil {
+			return nil, nil, err
+		}
+	case net.Conn:
+		conn = dst
+	default:
+		return nil, nil, ErrNotSupported
+	}
+
+	w.hijacked = true
+	if w.beforeHijack != nil {
+		w.buffered = append(w.buffered, w.beforeHijack()...)
+	}
+	buffered := w.buffered
+	w.buffered = nil
+
+	return conn, buffered, nil
+}
+
+// Flush sends what the underlying writer is holding on to, if it's a Flusher.
+// Otherwise everything has gone out already and there's nothing to do.
+func (w *Writer) Flush() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if f, ok := w.dst.(Flusher); ok {
+		return f.Flush()
 	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for the writes of the response, if the
+// underlying writer is a DeadlineSetter (net.Conns are). The zero time means no deadline.
+func (w *Writer) SetWriteDeadline(t time.Time) error {
+	if ds, ok := w.dst.(DeadlineSetter); ok {
+		return ds.SetWriteDeadline(t)
+	}
+	return ErrNotSupported
+}
+
+// BeforeHijack registers a function that runs when the handler hijacks the connection,
+// before the connection is returned. The server uses it to stop reading from the
+// connection in the background; any bytes it returns are added to the buffered ones.
+func (w *Writer) BeforeHijack(fn func() []byte) {
+	w.beforeHijack = fn
+}
+
+// Reports whether Hijack has been called.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
 }
 
 // it should set the following headers that we always want to include in our responses:
 // Content-Length (Set to the given size)
-// Connection (Set to close because we're not doing keep-alive's yet)
 // Content-Type (Set to text/plain)
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.Headers{}
 
 	h["Content-Length"] = strconv.Itoa(contentLen)
-	h["Connection"] = "close"
 	h["Content-Type"] = "text/plain"
 
 	return h
 }
 
 // CH7 L7
-// It should map the given status code to the correct reason phrase, if it's one of the 3 that we support:
+// It should map the given status code to the correct reason phrase, if it's one we know about:
 // 200 should return HTTP/1.1 200 OK
 // 400 should return HTTP/1.1 400 Bad Request
 // 500 should return HTTP/1.1 500 Internal Server Error
 // Any other code should just leave the reason phrase blank.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	var err error = nil
-
-	if w.writerStatus == writerStateReadyForStatus {
-		switch statusCode {
-		case StatusOk:
-			_, err = w.conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		case StatusBadRequest:
-			_, err = w.conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		case StatusInternalServerError:
-			_, err = w.conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		default:
-			_, err = w.conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d \r\n", statusCode)))
-		}
-
-		w.writerStatus = writerStateReadyForHeaders
+	if w.hijacked {
+		return ErrHijacked
+	}
 
-	} else {
+	if w.writerStatus != writerStateReadyForStatus {
 		return fmt.Errorf("response status line already sent")
 	}
 
+	w.writerStatus = writerStateReadyForHeaders
+	w.status = statusCode
+	w.sentHeaders = false
+	w.complete = false
+
+	// The filters get to see it together with the headers
+	if len(w.filters) > 0 {
+		return nil
+	}
+
+	_, err := w.dst.Write(statusLine(statusCode))
+
 	return err
+}
 
+func statusLine(statusCode StatusCode) []byte {
+	return fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode))
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if w.writerStatus == writerStateReadyForHeaders {
-		for key, value := range headers {
-
-			_, err := w.conn.Write([]byte(
-				fmt.Sprintf("%s: %s\r\n", key, value),
-			))
-			if err != nil {
-				return err
-			}
+	if w.hijacked {
+		return ErrHijacked
+	}
 
-			if strings.ToLower(key) == "transfer-encoding" &&
-				strings.ToLower(value) == "chunked" {
+	if w.writerStatus != writerStateReadyForHeaders {
+		return fmt.Errorf("response headers already sent")
+	}
+
+	// How the handler is going to write its body
+	for key, value := range headers {
+		switch strings.ToLower(key) {
+		case "transfer-encoding":
+			if strings.ToLower(value) == "chunked" {
 				w.isChunked = true
 			}
-
+		case "content-length":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && n >= 0 {
+				w.contentLength = n
+			}
 		}
+	}
 
-		_, err := w.conn.Write([]byte("\r\n"))
-		if err != nil {
-			return err
+	// All the header lines go out in a single write, after the status line if it was held back
+	var block []byte
+	if len(w.filters) > 0 {
+		block = statusLine(w.status)
+		headers = w.applyFilters(headers)
+	}
+	for key, value := range headers {
+		// Each cookie gets its own line, see headers.Values
+		if strings.EqualFold(key, "Set-Cookie") {
+			for _, line := range strings.Split(value, "\n") {
+				block = fmt.Appendf(block, "%s: %s\r\n", key, line)
+			}
+			continue
 		}
-		w.writerStatus = writerStateReadyForBody
+		block = fmt.Appendf(block, "%s: %s\r\n", key, value)
+	}
+	block = append(block, "\r\n"...)
 
-	} else {
-		return fmt.Errorf("response headers already sent")
+	_, err := w.dst.Write(block)
+	if err != nil {
+		return err
 	}
+	w.writerStatus = writerStateReadyForBody
+	w.sentHeaders = true
+	w.closeAfter = headers.HasToken("Connection", "close")
 
 	return nil
 }
 
+// Writes p as (part of) the body. It can be called several times; once the
+// number of bytes in Content-Length has been written the body is complete.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	if w.writerStatus == writerStateReadyForBody {
-		w.conn.Write(p)
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 
-		if !w.isChunked {
-			w.writerStatus = writerStateReadyForStatus
-		}
+	if w.writerStatus != writerStateReadyForBody {
+		return 0, fmt.Errorf("response body already sent")
+	}
 
+	if len(p) > 0 {
+		w.wroteBody = true
+	}
+
+	var n int
+	var err error
+	if w.body != nil {
+		n, err = w.body.Write(p)
 	} else {
-		return 0, fmt.Errorf("response body already sent")
+		n, err = w.dst.Write(p)
 	}
+	if err != nil {
+		return n, err
+	}
+
+	if !w.isChunked {
+		err = w.bodyDone(int64(n))
+	}
+
+	return len(p), err
+}
+
+// Counts n more bytes of a Content-Length body, and closes the body once they're all there.
+func (w *Writer) bodyDone(n int64) error {
+	w.bodyWritten += n
+	if w.contentLength < 0 || w.bodyWritten < w.contentLength {
+		return nil
+	}
+
+	if w.body != nil {
+		return w.endBody(nil)
+	}
+	w.writerStatus = writerStateReadyForStatus
+	w.complete = true
+	return nil
+}
 
-	return len(p), nil
+// KeepAlive reports whether the connection can carry another response after
+// this one: the whole response has been written, framed so that the client can
+// tell where it ends, and its headers didn't say Connection: close.
+// method is the request's: the answer to a HEAD never has a body, so if the
+// handler wrote one anyway the client can't tell where the next response starts.
+func (w *Writer) KeepAlive(method string) bool {
+	if w.hijacked || !w.sentHeaders || w.closeAfter || w.body != nil {
+		return false
+	}
+	if method == "HEAD" {
+		return !w.wroteBody
+	}
+	if w.complete || w.status == StatusNoContent || w.status == StatusNotModified {
+		return true
+	}
+	// A Content-Length of 0, with no WriteBody at all
+	return !w.isChunked && w.contentLength >= 0 && w.bodyWritten >= w.contentLength
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	// The filters decide how the body is framed
+	if w.body != nil {
+		return w.WriteBody(p)
+	}
+
 	body := fmt.Sprintf("%X\r\n%v\r\n", len(p), string(p))
 
 	n, err := w.WriteBody([]byte(body))
@@ -144,24 +428,38 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone(trailer headers.Headers) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 
-	trailerLines := ""
-	for key, value := range trailer {
-		trailerLines += fmt.Sprintf("%s: %s\r\n", key, value)
+	w.wroteBody = true
+
+	if w.body != nil {
+		return 0, w.endBody(trailer)
 	}
 
-	body := fmt.Sprintf("0\r\n%s\r\n", trailerLines)
+	body := lastChunk(trailer)
 
-	n, err := w.WriteBody([]byte(body))
+	n, err := w.WriteBody(body)
 	if err != nil {
 		return n, err
 	}
 
 	w.isChunked = false
+	w.complete = true
 
 	return len(body), nil
 }
 
+// The zero-size chunk that ends a chunked body, with the trailers
+func lastChunk(trailer headers.Headers) []byte {
+	body := []byte("0\r\n")
+	for key, value := range trailer {
+		body = fmt.Appendf(body, "%s: %s\r\n", key, value)
+	}
+	return append(body, "\r\n"...)
+}
+
 // Add a new method to your response package that does what you'd expect
 // based on your knowledge of trailers.
 func (w *Writer) WriteTrailers(h headers.Headers) error {
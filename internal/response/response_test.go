@@ -0,0 +1,75 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Buffers what's written and gives up the connection under it
+type hijackableBuffer struct {
+	*bufio.Writer
+	conn net.Conn
+}
+
+func (hb hijackableBuffer) Hijack() (net.Conn, error) {
+	return hb.conn, nil
+}
+
+func TestWriterSinks(t *testing.T) {
+	// Test: Any io.Writer takes a response, chunks and trailers included
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone(headers.Headers{"X-Sum": "abc"})
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Sum: abc\r\n\r\n", buf.String())
+
+	// Test: What a plain writer can't do, it says so
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrNotSupported)
+	assert.False(t, w.Hijacked())
+	assert.ErrorIs(t, w.SetWriteDeadline(time.Now()), ErrNotSupported)
+	assert.NoError(t, w.Flush())
+
+	// Test: A buffered writer holds on to it until Flush
+	buf.Reset()
+	w = NewWriter(bufio.NewWriter(&buf))
+	w.WriteStatusLine(StatusNoContent)
+	w.WriteHeaders(headers.Headers{})
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+
+	// Test: A wrapper can hand over its connection, after what it was holding on to
+	server, client := net.Pipe()
+	defer client.Close()
+	w = NewWriter(hijackableBuffer{bufio.NewWriter(server), server})
+	w.WriteStatusLine(StatusSwitchingProtocols)
+	w.WriteHeaders(headers.Headers{"Upgrade": "test"})
+
+	got := make(chan string)
+	go func() {
+		data := make([]byte, 256)
+		n, _ := client.Read(data)
+		got <- string(data[:n])
+	}()
+
+	conn, _, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\n\r\n", <-got)
+	assert.True(t, w.Hijacked())
+
+	// Test: A connection has deadlines
+	assert.NoError(t, NewWriter(server).SetWriteDeadline(time.Time{}))
+}
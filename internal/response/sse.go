@@ -0,0 +1,184 @@
+package response
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+)
+
+// An Event is one message of a Server-Sent Events stream.
+// Only Data is required, the other fields are left out when empty.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// EventStream writes a text/event-stream response.
+// Events go out as chunks straight to the connection, nothing is held back,
+// and it's safe to send from several goroutines.
+type EventStream struct {
+	w           *Writer
+	mu          sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	lastEventID string
+	closed      bool
+}
+
+// NewEventStream writes the status line and headers of an event stream.
+// If keepAlive is positive, a comment line is sent every keepAlive so proxies
+// don't drop the idle connection.
+// The stream's context is derived from the request's, and is also cancelled as
+// soon as a write fails, which is how we notice that the client went away.
+func NewEventStream(w *Writer, req *request.Request, keepAlive time.Duration) (*EventStream, error) {
+	err := w.WriteStatusLine(StatusOk)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.WriteHeaders(headers.Headers{
+		"Content-Type":      "text/event-stream",
+		"Cache-Control":     "no-cache",
+		"Connection":        "close",
+		"Transfer-Encoding": "chunked",
+		// Ask reverse proxies (nginx) not to buffer the stream
+		"X-Accel-Buffering": "no",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	es := &EventStream{
+		w:           w,
+		ctx:         ctx,
+		cancel:      cancel,
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+	}
+
+	if keepAlive > 0 {
+		go es.keepAlive(keepAlive)
+	}
+
+	return es, nil
+}
+
+// The value of the Last-Event-ID request header, so a reconnecting client
+// can be sent the events it missed.
+func (es *EventStream) LastEventID() string {
+	return es.lastEventID
+}
+
+// Done when the request context is, or when the client disconnected.
+func (es *EventStream) Context() context.Context {
+	return es.ctx
+}
+
+// Send writes a single event.
+func (es *EventStream) Send(ev Event) error {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return errors.New("sse: event id can't contain newlines or NUL")
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return errors.New("sse: event name can't contain newlines")
+	}
+
+	var sb strings.Builder
+	if ev.ID != "" {
+		fmt.Fprintf(&sb, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&sb, "event: %s\n", ev.Event)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&sb, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+
+	// Every line of the data gets its own data: field, the client joins them back with \n
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&sb, "data: %s\n", line)
+	}
+	sb.WriteString("\n")
+
+	return es.write(sb.String())
+}
+
+// Comment writes a line that clients ignore (starts with a colon).
+func (es *EventStream) Comment(text string) error {
+	var sb strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(&sb, ": %s\n", strings.TrimRight(line, "\r"))
+	}
+	sb.WriteString("\n")
+
+	return es.write(sb.String())
+}
+
+// Close stops the keep-alives and ends the chunked body.
+func (es *EventStream) Close() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.closed {
+		return nil
+	}
+	es.closed = true
+	es.cancel()
+
+	_, err := es.w.WriteChunkedBodyDone(nil)
+	if err != nil {
+		return err
+	}
+	return es.w.Flush()
+}
+
+func (es *EventStream) write(s string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.closed {
+		return errors.New("sse: stream closed")
+	}
+
+	if err := es.ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := es.w.WriteChunkedBody([]byte(s))
+	if err == nil {
+		// An event that sits in a buffer is no use to anybody
+		err = es.w.Flush()
+	}
+	if err != nil {
+		// Most likely the client hung up
+		es.cancel()
+	}
+
+	return err
+}
+
+func (es *EventStream) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-es.ctx.Done():
+			return
+		case <-ticker.C:
+			if es.Comment("keep-alive") != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package response
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Reads the response head and then returns a reader for the raw (still chunked) body.
+func readHead(t *testing.T, conn net.Conn) (string, *bufio.Reader) {
+	br := bufio.NewReader(conn)
+	head := ""
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+		if line == "\r\n" {
+			return head, br
+		}
+	}
+}
+
+// Reads one chunk and returns its data.
+func readChunk(t *testing.T, br *bufio.Reader) string {
+	size, err := br.ReadString('\n')
+	require.NoError(t, err)
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	require.NoError(t, err)
+	data := make([]byte, n+2)
+	_, err = io.ReadFull(br, data)
+	require.NoError(t, err)
+	return string(data[:n])
+}
+
+func TestEventStream(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	req := &request.Request{Headers: headers.Headers{"last-event-id": "41"}}
+	w := NewWriter(server)
+
+	streamCh := make(chan *EventStream)
+	go func() {
+		es, err := NewEventStream(w, req, 0)
+		assert.NoError(t, err)
+		streamCh <- es
+	}()
+
+	head, br := readHead(t, client)
+	es := <-streamCh
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, head, "Content-Type: text/event-stream\r\n")
+	assert.Contains(t, head, "Cache-Control: no-cache\r\n")
+	assert.Equal(t, "41", es.LastEventID())
+
+	// Test: Event with every field and multi-line data
+	go es.Send(Event{ID: "42", Event: "update", Data: "line one\nline two", Retry: 3 * time.Second})
+	assert.Equal(t, "id: 42\nevent: update\nretry: 3000\ndata: line one\ndata: line two\n\n", readChunk(t, br))
+
+	// Test: Only data
+	go es.Send(Event{Data: "hola"})
+	assert.Equal(t, "data: hola\n\n", readChunk(t, br))
+
+	// Test: Newlines are not allowed in the id
+	assert.Error(t, es.Send(Event{ID: "4\n2", Data: "x"}))
+
+	// Test: Close ends the chunked body
+	go es.Close()
+	assert.Equal(t, "0\r\n", mustReadLine(t, br))
+	assert.Equal(t, "\r\n", mustReadLine(t, br))
+}
+
+func TestEventStreamKeepAliveAndDisconnect(t *testing.T) {
+	server, client := net.Pipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := (&request.Request{Headers: headers.Headers{}}).WithContext(ctx)
+
+	streamCh := make(chan *EventStream)
+	go func() {
+		es, err := NewEventStream(NewWriter(server), req, 10*time.Millisecond)
+		assert.NoError(t, err)
+		streamCh <- es
+	}()
+
+	_, br := readHead(t, client)
+	es := <-streamCh
+
+	// Test: Keep-alive comments arrive on their own
+	assert.Equal(t, ": keep-alive\n\n", readChunk(t, br))
+
+	// Test: Client hangs up, the stream's context is cancelled
+	client.Close()
+	select {
+	case <-es.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream context not cancelled after disconnect")
+	}
+	assert.Error(t, es.Send(Event{Data: "nobody listening"}))
+
+	// Test: Cancelling the request context also ends the stream
+	server2, client2 := net.Pipe()
+	defer client2.Close()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	req2 := req.WithContext(ctx2)
+	go func() {
+		es, _ := NewEventStream(NewWriter(server2), req2, 0)
+		streamCh <- es
+	}()
+	readHead(t, client2)
+	es2 := <-streamCh
+	cancel2()
+	<-es2.Context().Done()
+	assert.ErrorIs(t, es2.Send(Event{Data: "too late"}), context.Canceled)
+}
+
+func mustReadLine(t *testing.T, br *bufio.Reader) string {
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
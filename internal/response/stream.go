@@ -0,0 +1,161 @@
+package response
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Size of the buffers used to copy bodies when the fast path isn't available
+const copyBufferSize = 32 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// WriteBodyFrom streams the body from r until EOF (or until Content-Length bytes
+// have been sent), without ever holding the whole body in memory.
+//
+// When r is an *os.File (or an io.LimitedReader around one) and the connection
+// is TCP, the copy is left to the connection's ReadFrom, which uses sendfile(2)
+// on Linux, so the data never even passes through user space.
+// Otherwise the data is copied through pooled buffers, and chunked responses
+// get one chunk per buffer.
+func (w *Writer) WriteBodyFrom(r io.Reader) (int64, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+
+	if w.writerStatus != writerStateReadyForBody {
+		return 0, fmt.Errorf("response body already sent")
+	}
+
+	n, err := w.copyBody(r)
+	if n > 0 {
+		w.wroteBody = true
+	}
+	return n, err
+}
+
+func (w *Writer) copyBody(r io.Reader) (int64, error) {
+	if w.body != nil {
+		return w.copyFiltered(r)
+	}
+
+	if w.isChunked {
+		return w.copyChunked(r)
+	}
+
+	// Never send more than we announced
+	if w.contentLength >= 0 {
+		r = limitReader(r, w.contentLength-w.bodyWritten)
+	}
+
+	var n int64
+	var err error
+
+	if rf, ok := w.dst.(io.ReaderFrom); ok && isFile(r) {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = copyBuffered(w.dst, r)
+	}
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.bodyDone(n)
+}
+
+// Copies r into the filters.
+func (w *Writer) copyFiltered(r io.Reader) (int64, error) {
+	if !w.isChunked && w.contentLength >= 0 {
+		r = limitReader(r, w.contentLength-w.bodyWritten)
+	}
+
+	n, err := copyBuffered(w.body, r)
+	if err != nil || w.isChunked {
+		return n, err
+	}
+
+	return n, w.bodyDone(n)
+}
+
+// Copies r as a sequence of chunks, one per read.
+func (w *Writer) copyChunked(r io.Reader) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
+
+	var total int64
+
+	for {
+		n, err := r.Read(buf)
+
+		if n > 0 {
+			werr := writeChunk(w.dst, buf[:n])
+			if werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Writes p as one chunk: the size line, the data and the CRLF go out in a single (vectored) write.
+func writeChunk(dst io.Writer, p []byte) error {
+	var sizeLine [20]byte
+	head := strconv.AppendInt(sizeLine[:0], int64(len(p)), 16)
+	head = append(head, '\r', '\n')
+
+	chunk := net.Buffers{head, p, []byte("\r\n")}
+	_, err := chunk.WriteTo(dst)
+	return err
+}
+
+// io.CopyBuffer with a pooled buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	// Hide dst's ReadFrom so CopyBuffer really uses our buffer
+	return io.CopyBuffer(writerOnly{dst}, src, *bufp)
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+// io.LimitReader, except that a LimitedReader (like the one ServeContent passes)
+// gets its N lowered instead of being wrapped in another one: isFile and the
+// connection's ReadFrom only look one level deep.
+func limitReader(r io.Reader, n int64) io.Reader {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		lr.N = min(lr.N, n)
+		return lr
+	}
+	return io.LimitReader(r, n)
+}
+
+// Reports whether r is a file, maybe behind a LimitReader: what sendfile can handle.
+// For anything else the connection's ReadFrom would allocate a fresh buffer on every call.
+func isFile(r io.Reader) bool {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	_, ok := r.(*os.File)
+	return ok
+}
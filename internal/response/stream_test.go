@@ -0,0 +1,277 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A loopback TCP connection, so the sendfile path is the one being used.
+// Whatever arrives on the other end is handed to read.
+func tcpPair(t testing.TB, read func(net.Conn)) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	// Accepted before the listener is closed, or the connection could be reset
+	other, err := ln.Accept()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer other.Close()
+		read(other)
+	}()
+
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+
+	return conn
+}
+
+// Writes a file of the given size with some non-repeating content.
+func tempFile(t testing.TB, size int) string {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	name := filepath.Join(t.TempDir(), "body.bin")
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+	return name
+}
+
+func TestWriteBodyFrom(t *testing.T) {
+	// Test: A file is sent whole, and the response is complete after it
+	name := tempFile(t, 100_000)
+	want, err := os.ReadFile(name)
+	require.NoError(t, err)
+
+	received := make(chan []byte, 1)
+	conn := tcpPair(t, func(c net.Conn) {
+		data, _ := io.ReadAll(c)
+		received <- data
+	})
+
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	w := NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(want))))
+	n, err := w.WriteBodyFrom(f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(want)), n)
+	assert.Equal(t, writerStateReadyForStatus, w.writerStatus)
+	conn.Close()
+
+	data := <-received
+	_, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+	require.True(t, found)
+	assert.Equal(t, want, body)
+
+	// Test: Never more than Content-Length, even if the reader has more
+	received = make(chan []byte, 1)
+	conn = tcpPair(t, func(c net.Conn) {
+		data, _ := io.ReadAll(c)
+		received <- data
+	})
+
+	w = NewWriter(conn)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err = w.WriteBodyFrom(strings.NewReader("hello, world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	conn.Close()
+
+	data = <-received
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nhello"))
+
+	// Test: A chunked response gets one chunk per read, and can be finished as usual
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		w := NewWriter(server)
+		w.WriteStatusLine(StatusOk)
+		w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+		w.WriteBodyFrom(io.MultiReader(strings.NewReader("hello, "), strings.NewReader("world")))
+		w.WriteChunkedBodyDone(nil)
+		server.Close()
+	}()
+
+	_, br := readHead(t, client)
+	assert.Equal(t, "hello, ", readChunk(t, br))
+	assert.Equal(t, "world", readChunk(t, br))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "0\r\n\r\n", string(rest))
+
+	// Test: Nothing is written before the headers
+	w = NewWriter(client)
+	_, err = w.WriteBodyFrom(strings.NewReader("nope"))
+	assert.Error(t, err)
+}
+
+func TestWriteBodyMultiple(t *testing.T) {
+	// Test: The body can be written in pieces, until Content-Length is reached
+	server, client := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		w := NewWriter(server)
+		w.WriteStatusLine(StatusOk)
+		w.WriteHeaders(GetDefaultHeaders(10))
+		w.WriteBody([]byte("hello"))
+		w.WriteBody([]byte(", "))
+		w.WriteBody([]byte("you"))
+		_, err := w.WriteBody([]byte("too much"))
+		errs <- err
+	}()
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nhello, you"))
+	assert.Error(t, <-errs)
+}
+
+func TestWriteBodyFromMemory(t *testing.T) {
+	// Test: Memory doesn't grow with the size of the file
+	allocs := func(size int) uint64 {
+		name := tempFile(t, size)
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		defer f.Close()
+
+		conn := tcpPair(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+		w := NewWriter(conn)
+		w.WriteStatusLine(StatusOk)
+		w.WriteHeaders(GetDefaultHeaders(size))
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		n, err := w.WriteBodyFrom(f)
+		runtime.ReadMemStats(&after)
+
+		require.NoError(t, err)
+		require.Equal(t, int64(size), n)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	small := allocs(64 << 10)
+	large := allocs(16 << 20)
+
+	// Some slack for whatever the runtime allocates meanwhile, but nowhere near the 16MB
+	assert.Less(t, large, small+(256<<10), "small: %d, large: %d", small, large)
+}
+
+var benchSizes = []int{4 << 10, 1 << 20, 16 << 20}
+
+// Streaming the file into the connection
+func BenchmarkWriteBodyFrom(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(sizeName(size), func(b *testing.B) {
+			name := tempFile(b, size)
+			conn := tcpPair(b, func(c net.Conn) { io.Copy(io.Discard, c) })
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for b.Loop() {
+				f, err := os.Open(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				w := NewWriter(conn)
+				w.writerStatus = writerStateReadyForBody
+				w.contentLength = int64(size)
+				_, err = w.WriteBodyFrom(f)
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// What Chapter9 used to do: read the whole file, then write it
+func BenchmarkWriteBodyReadFile(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(sizeName(size), func(b *testing.B) {
+			name := tempFile(b, size)
+			conn := tcpPair(b, func(c net.Conn) { io.Copy(io.Discard, c) })
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for b.Loop() {
+				data, err := os.ReadFile(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				w := NewWriter(conn)
+				w.writerStatus = writerStateReadyForBody
+				w.contentLength = int64(size)
+				_, err = w.WriteBody(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Streaming from a reader that isn't a file, through the pooled buffers
+func BenchmarkWriteBodyFromReader(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(sizeName(size), func(b *testing.B) {
+			data := bytes.Repeat([]byte("x"), size)
+			conn := tcpPair(b, func(c net.Conn) { io.Copy(io.Discard, c) })
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for b.Loop() {
+				w := NewWriter(conn)
+				w.writerStatus = writerStateReadyForBody
+				w.contentLength = int64(size)
+				_, err := w.WriteBodyFrom(onlyReader{bytes.NewReader(data)})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Hides WriteTo, like most readers that aren't in memory already
+type onlyReader struct {
+	io.Reader
+}
+
+func sizeName(size int) string {
+	if size >= 1<<20 {
+		return fmt.Sprintf("%dMB", size>>20)
+	}
+	return fmt.Sprintf("%dKB", size>>10)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+)
+
+// Used when Config.MaxPipelined is zero
+const DefaultMaxPipelined = 8
+
+// What the connReader found on the connection: a request, or the error that ends it
+type readResult struct {
+	req *request.Request
+	err error
+}
+
+// Reads the requests of a connection one after another, while the handlers
+// answer the ones before, so a client can pipeline them. Whatever it reads past
+// a request is kept for the next one, or for whoever hijacks the connection.
+//
+// Reading from the connection is also how we notice the client hanging up: a
+// read that fails cancels the request being handled.
+type connReader struct {
+	conn net.Conn
+
+	// How many parsed requests can wait for the handler
+	max int
+
+	// What the requests can't go over
+	limits request.Limits
+
+	// Of the current run, see start
+	queue  chan readResult
+	stopCh chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex
+	running  bool
+	stopping bool
+	// Read, but not part of a request yet
+	pending []byte
+	// Set once the connection context is done, so stop doesn't undo the deadline that interrupts the read
+	closed   bool
+	stopWake func() bool
+	// Cancels the context of the request being handled
+	cancelCurrent context.CancelFunc
+}
+
+func newConnReader(ctx context.Context, conn net.Conn, max int) *connReader {
+	cr := &connReader{
+		conn: conn,
+		max:  max,
+	}
+
+	// When the server is closed (or the client is gone) there's nothing more to read
+	cr.stopWake = context.AfterFunc(ctx, func() {
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+		cr.closed = true
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+
+	return cr
+}
+
+// Starts reading requests into a new queue.
+func (cr *connReader) start() {
+	cr.mu.Lock()
+	cr.running = true
+	cr.stopping = false
+	cr.mu.Unlock()
+
+	// The reader holds one more while it waits for room
+	cr.queue = make(chan readResult, cr.max-1)
+	cr.stopCh = make(chan struct{})
+	cr.done = make(chan struct{})
+
+	go cr.run(cr.queue, cr.stopCh, cr.done)
+}
+
+func (cr *connReader) run(queue chan<- readResult, stopCh <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer close(queue)
+
+	for {
+		req, err := cr.readRequest()
+		if err != nil {
+			if cr.isStopping() || errors.Is(err, io.EOF) {
+				return
+			}
+			select {
+			case queue <- readResult{err: err}:
+			case <-stopCh:
+			}
+			return
+		}
+
+		select {
+		case queue <- readResult{req: req}:
+		case <-stopCh:
+			return
+		}
+
+		// Whatever comes after this one isn't for us, or not yet
+		if lastRequest(req) {
+			cr.watch()
+			return
+		}
+	}
+}
+
+// Reads the next request, starting with the pending bytes.
+func (cr *connReader) readRequest() (*request.Request, error) {
+	cr.mu.Lock()
+	pending := cr.pending
+	cr.pending = nil
+	cr.mu.Unlock()
+
+	tee := &teeReader{r: cr.conn}
+	req, err := request.RequestFromReaderWithLimits(io.MultiReader(bytes.NewReader(pending), tee), cr.limits)
+
+	if tee.err != nil && !(cr.isStopping() && errors.Is(tee.err, os.ErrDeadlineExceeded)) {
+		// Gone, or closed its end
+		cr.hangUp()
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if err != nil {
+		// Nothing it read made a request, so all of it is still pending. Unless
+		// it was cut off in the middle of a body: nobody can pick up from there.
+		if tee.overflow {
+			cr.pending = nil
+		} else {
+			cr.pending = append(pending, tee.data...)
+		}
+		return nil, err
+	}
+
+	cr.pending = bytes.Clone(req.Buffered())
+	return req, nil
+}
+
+// Waits for the client to send something else or to hang up, without parsing
+// anything. Like readRequest, a failed read cancels the request being handled.
+func (cr *connReader) watch() {
+	buf := make([]byte, 1)
+	n, err := cr.conn.Read(buf)
+
+	cr.mu.Lock()
+	if n > 0 {
+		cr.pending = append(cr.pending, buf[:n]...)
+	}
+	// A timeout we caused in stop() is not a disconnect
+	stopped := cr.stopping && errors.Is(err, os.ErrDeadlineExceeded)
+	cr.mu.Unlock()
+
+	if n == 0 && err != nil && !stopped {
+		cr.hangUp()
+	}
+}
+
+// Sets the cancel function of the request being handled, nil between requests.
+func (cr *connReader) setCurrent(cancel context.CancelFunc) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cancelCurrent = cancel
+}
+
+// The client is gone, the request being handled can stop. The ones it sent
+// before that still get their turn, whoever is left to read the answers.
+func (cr *connReader) hangUp() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.cancelCurrent != nil {
+		cr.cancelCurrent()
+	}
+}
+
+func (cr *connReader) isStopping() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.stopping
+}
+
+// Stops reading and returns the bytes that were read but aren't part of a
+// request yet. Requests that were already parsed and are still in the queue are
+// dropped. The connection can be read normally again afterwards, or by start.
+func (cr *connReader) stop() []byte {
+	cr.mu.Lock()
+	if !cr.running {
+		defer cr.mu.Unlock()
+		return cr.pending
+	}
+	cr.running = false
+	cr.stopping = true
+	cr.mu.Unlock()
+
+	close(cr.stopCh)
+
+	// Unblock the Read by making it time out right away
+	cr.conn.SetReadDeadline(time.Unix(1, 0))
+	<-cr.done
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.closed {
+		cr.conn.SetReadDeadline(time.Time{})
+	}
+
+	return cr.pending
+}
+
+// Stops reading for good and lets go of the connection, for a hijack: nothing
+// the server does afterwards touches it. Returns the pending bytes.
+func (cr *connReader) detach() []byte {
+	cr.stopWake()
+	pending := cr.stop()
+	cr.conn.SetReadDeadline(time.Time{})
+	return pending
+}
+
+// Whether the request is the last one the client is sending before it waits for
+// the answer: it wants the connection closed afterwards, or switched to another
+// protocol, in which case what follows isn't a request.
+func lastRequest(req *request.Request) bool {
+	return req.Headers.HasToken("Connection", "close") ||
+		req.Headers.Get("Upgrade") != "" ||
+		req.RequestLine.Method == "CONNECT"
+}
+
+// How much of a request the teeReader keeps, enough for the headers of most.
+// Bodies go past it, and aren't kept twice.
+const maxTee = 64 << 10
+
+// Keeps a copy of what it reads, up to maxTee, and the error that stopped it
+type teeReader struct {
+	r    io.Reader
+	data []byte
+	err  error
+
+	// Read more than maxTee, data is gone
+	overflow bool
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if !t.overflow {
+		if len(t.data)+n > maxTee {
+			t.overflow = true
+			t.data = nil
+		} else {
+			t.data = append(t.data, p[:n]...)
+		}
+	}
+	if err != nil {
+		t.err = err
+	}
+	return n, err
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/neixir/httpfromtcp/internal/request"
 	"github.com/neixir/httpfromtcp/internal/response"
@@ -15,6 +22,49 @@ type Server struct {
 	Listener net.Listener
 	IsClosed atomic.Bool
 	Handler  HandlerFunc
+	Config   Config
+
+	// Parent of every request context, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Optional settings for ServeWithConfig. The zero value is what Serve uses.
+type Config struct {
+	// If positive, each request's context is cancelled after this long
+	RequestTimeout time.Duration
+
+	// How many requests a client can send ahead on one connection, while it waits
+	// for the answer to the first (DefaultMaxPipelined if 0). Past that, the
+	// server doesn't read any more until it has answered one.
+	MaxPipelined int
+
+	// How big requests can get. Fields that are zero get the value in
+	// request.DefaultLimits, negative ones mean no limit. Requests over them are
+	// answered with 413, 414 or 431, and the connection is closed.
+	Limits request.Limits
+}
+
+// The limits with the defaults filled in
+func (c Config) limits() request.Limits {
+	l := c.Limits
+	d := request.DefaultLimits
+	if l.MaxRequestLine == 0 {
+		l.MaxRequestLine = d.MaxRequestLine
+	}
+	if l.MaxHeaderBytes == 0 {
+		l.MaxHeaderBytes = d.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount == 0 {
+		l.MaxHeaderCount = d.MaxHeaderCount
+	}
+	if l.MaxFieldSize == 0 {
+		l.MaxFieldSize = d.MaxFieldSize
+	}
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = d.MaxBodySize
+	}
+	return l
 }
 
 type HandlerFunc func(w *response.Writer, req *request.Request)
@@ -27,24 +77,42 @@ type HandlerError struct {
 // Creates a net.Listener and returns a new Server instance.
 // Starts listening for requests inside a goroutine.
 func Serve(port int, handler HandlerFunc) (*Server, error) {
+	return ServeWithConfig(port, handler, Config{})
+}
+
+// Like Serve, with the settings in cfg.
+func ServeWithConfig(port int, handler HandlerFunc, cfg Config) (*Server, error) {
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
 
+	return ServeListener(l, handler, cfg), nil
+}
+
+// Like ServeWithConfig, on a listener that's already listening, for a specific
+// address or for something that isn't TCP at all. Close closes l.
+func ServeListener(l net.Listener, handler HandlerFunc, cfg Config) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	server := Server{
 		Listener: l,
 		Handler:  handler,
+		Config:   cfg,
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 
 	go server.listen()
 
-	return &server, nil
+	return &server
 }
 
-// Closes the listener and the server
+// Closes the listener and the server.
+// The contexts of the requests still being handled are cancelled.
 func (s *Server) Close() error {
 	s.IsClosed.Store(true)
+	s.cancel()
 	err := s.Listener.Close()
 	if err != nil {
 		return err
@@ -73,21 +141,161 @@ func (s *Server) listen() {
 	}
 }
 
+// Answers the requests on conn in the order they came, for as long as the
+// client and the handlers want to keep the connection.
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	// Done when the server is closed
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
 
-	// Parse the request from the connection
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		fmt.Println(err)
-		// TODO De fet, envia 500 Bad Request
+	max := s.Config.MaxPipelined
+	if max <= 0 {
+		max = DefaultMaxPipelined
+	}
+	cr := newConnReader(ctx, conn, max)
+	cr.limits = s.Config.limits()
+	cr.start()
+
+	for {
+		next, ok := <-cr.queue
+		if !ok {
+			break
+		}
+		if next.err != nil {
+			refuse(conn, next.err)
+			break
+		}
+
+		keepAlive, hijacked := s.serve(ctx, conn, cr, next.req)
+		// If the handler hijacked the connection it belongs to the handler now,
+		// so we must not touch it again.
+		if hijacked {
+			return
+		}
+		if !keepAlive || ctx.Err() != nil {
+			break
+		}
+
+		// The reader stopped after this one, but it turned out not to be the last
+		if lastRequest(next.req) {
+			cr.stop()
+			cr.start()
+		}
+	}
+
+	cr.stop()
+	conn.Close()
+}
+
+// Answers a request that didn't parse, 400 unless it went over a limit. The
+// connection closes afterwards, what comes after it can't be trusted to be a request.
+func refuse(conn net.Conn, err error) {
+	// Reading failed, there's nobody to answer
+	var netErr net.Error
+	if errors.As(err, &netErr) {
 		return
 	}
 
-	// Create a new empty bytes.Buffer for the handler to write to
+	status := response.StatusBadRequest
+	var limitErr *request.LimitError
+	if errors.As(err, &limitErr) {
+		status = response.StatusCode(limitErr.Status)
+	}
+
+	body := fmt.Sprintf("%d %s\n", status, response.StatusText(status))
+	w := response.NewWriter(conn)
+	w.SetWriteDeadline(time.Now().Add(refuseTimeout))
+	w.WriteStatusLine(status)
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("Connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+
+	// Closing with unread data would reset the connection, and the client might
+	// lose the answer with it. Read (and drop) some of what it's still sending first.
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(refuseTimeout))
+		io.Copy(io.Discard, io.LimitReader(conn, refuseDrain))
+	}
+}
+
+// How long refuse waits for the client, and how much it reads from it
+const (
+	refuseTimeout = time.Second
+	refuseDrain   = 256 << 10
+)
+
+// Runs the handler for one request. Reports whether the connection can take
+// another request, and whether the handler hijacked it.
+func (s *Server) serve(connCtx context.Context, conn net.Conn, cr *connReader, req *request.Request) (keepAlive, hijacked bool) {
+	req.RemoteAddr = conn.RemoteAddr().String()
+
+	// Every request gets a context that ends when the client disconnects,
+	// when the server is closed, or when the request timeout expires.
+	ctx, cancel := context.WithCancel(connCtx)
+	defer cancel()
+	cr.setCurrent(cancel)
+	defer cr.setCurrent(nil)
+
+	if s.Config.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.Config.RequestTimeout)
+		defer cancel()
+	}
+
+	ctx = request.ContextWithRequestID(ctx, requestID(req))
+	req = req.WithContext(ctx)
+
+	// Temporary files of uploads and such
+	defer req.Finish()
+
 	res := response.NewWriter(conn)
+	res.BeforeHijack(cr.detach)
 
 	// Call the handler function
 	s.Handler(res, req)
 
+	if res.Hijacked() {
+		return false, true
+	}
+
+	return res.KeepAlive(req.RequestLine.Method) && !req.Headers.HasToken("Connection", "close"), false
+}
+
+// Uses the client's X-Request-ID if it sent a sensible one, otherwise makes one up.
+func requestID(req *request.Request) string {
+	id := req.Headers.Get("X-Request-ID")
+	if id != "" && len(id) <= 128 {
+		return id
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// StripPrefix returns a handler that removes prefix from the request target before
+// calling h, and answers 404 to requests outside of it. Handy for mounting a
+// FileServer under a path.
+func StripPrefix(prefix string, h HandlerFunc) HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		target := req.RequestLine.RequestTarget
+		rest, ok := strings.CutPrefix(target, prefix)
+		// The prefix has to end where a path segment does: /assetsfoo isn't under /assets
+		if ok && !strings.HasSuffix(prefix, "/") && rest != "" && rest[0] != '/' && rest[0] != '?' {
+			ok = false
+		}
+		if !ok {
+			body := "404 Not Found\n"
+			w.WriteStatusLine(response.StatusNotFound)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+			return
+		}
+
+		// Copy the request, the caller may still be using the original
+		r2 := *req
+		r2.RequestLine.RequestTarget = "/" + strings.TrimPrefix(rest, "/")
+		h(w, &r2)
+	}
 }
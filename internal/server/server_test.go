@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	hijacked := make(chan []byte, 1)
+
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// After the hijack the writer refuses to touch the connection
+		_, err = w.WriteBody([]byte("nope"))
+		assert.ErrorIs(t, err, response.ErrHijacked)
+
+		// Whatever the parser didn't buffer is still waiting on the connection
+		rest := make([]byte, len("early bytes")-len(buffered))
+		_, err = io.ReadFull(conn, rest)
+		assert.NoError(t, err)
+
+		// The connection stays open because it was hijacked: the server leaves it to us, even once this handler returns
+		conn.Write([]byte("switched\n"))
+		hijacked <- append(buffered, rest...)
+		conn.Close()
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\n\r\nearly bytes"))
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "switched\n", string(data))
+	assert.Equal(t, "early bytes", string(<-hijacked))
+}
+
+func TestRequestContext(t *testing.T) {
+	results := make(chan error, 1)
+	ids := make(chan string, 1)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		ids <- request.RequestIDFromContext(req.Context())
+		<-req.Context().Done()
+		results <- req.Context().Err()
+	}
+
+	// Test: Client disconnect cancels the context
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: abc123\r\n\r\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "abc123", <-ids)
+	conn.Close()
+	assert.ErrorIs(t, waitErr(t, results), context.Canceled)
+
+	// Test: Request timeout
+	s2, err := ServeWithConfig(0, handler, Config{RequestTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	conn, err = net.Dial("tcp", s2.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, <-ids)
+	assert.ErrorIs(t, waitErr(t, results), context.DeadlineExceeded)
+
+	// Test: Closing the server cancels requests in flight
+	s3, err := Serve(0, handler)
+	require.NoError(t, err)
+
+	conn, err = net.Dial("tcp", s3.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	<-ids
+	s3.Close()
+	assert.ErrorIs(t, waitErr(t, results), context.Canceled)
+}
+
+func waitErr(t *testing.T, ch chan error) error {
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("request context was not cancelled")
+		return nil
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		target := req.RequestLine.RequestTarget
+		if target == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		body := target + "\n"
+		h := headers.Headers{"Content-Length": strconv.Itoa(len(body))}
+		if target == "/close" {
+			h.Set("Connection", "close")
+		}
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Sends all the requests in one go, and reads the bodies of the responses until the server closes the connection
+	roundTrip := func(data string) []string {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(data))
+		require.NoError(t, err)
+
+		var bodies []string
+		rr := response.NewResponseReader(conn)
+		for {
+			res, err := rr.ReadResponse()
+			if err != nil {
+				break
+			}
+			bodies = append(bodies, string(res.Body))
+			rr = response.NewResponseReader(io.MultiReader(bytes.NewReader(res.Buffered()), conn))
+		}
+		return bodies
+	}
+
+	// Test: Answered in order, even when the first one takes longer, and with a CRLF in between
+	bodies := roundTrip("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /fast HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody\r\n" +
+		"GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, []string{"/slow\n", "/fast\n", "/last\n"}, bodies)
+
+	// Test: Nothing after a request that says Connection: close
+	bodies = roundTrip("GET /first HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n" +
+		"GET /ignored HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, []string{"/first\n"}, bodies)
+
+	// Test: Nor after a response that says it
+	bodies = roundTrip("GET /close HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /ignored HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, []string{"/close\n"}, bodies)
+
+	// Test: A request that isn't one gets a 400 and ends the connection, after answering the ones before it
+	bodies = roundTrip("GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"NOT A REQUEST\r\n\r\n" +
+		"GET /ignored HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, []string{"/ok\n", "400 Bad Request\n"}, bodies)
+}
+
+func TestHeadKeepAlive(t *testing.T) {
+	// Writes the body whatever the method, like a lot of handlers do
+	handler := func(w *response.Writer, req *request.Request) {
+		body := "hello\n"
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(headers.Headers{"Content-Length": strconv.Itoa(len(body))})
+		if req.RequestLine.RequestTarget != "/nobody" {
+			w.WriteBody([]byte(body))
+		}
+	}
+
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Sends the requests in one go, and reads everything until the server closes the connection
+	roundTrip := func(data string) string {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(data))
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		out, _ := io.ReadAll(conn)
+		return string(out)
+	}
+
+	// Test: A HEAD answered with a body ends the connection, the GET after it isn't answered behind those bytes
+	out := roundTrip("HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200"))
+
+	// Test: A HEAD answered without one keeps it open
+	out = roundTrip("HEAD /nobody HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello\n"))
+}
+
+func TestLimits(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	s, err := ServeWithConfig(0, handler, Config{Limits: request.Limits{
+		MaxRequestLine: 64,
+		MaxHeaderCount: 3,
+		MaxBodySize:    10,
+	}})
+	require.NoError(t, err)
+	defer s.Close()
+
+	status := func(data string) response.StatusCode {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(data))
+		require.NoError(t, err)
+		res, err := response.NewResponseReader(conn).ReadResponse()
+		require.NoError(t, err)
+		return res.StatusLine.StatusCode
+	}
+
+	// Test: Within the limits
+	assert.Equal(t, response.StatusOk, status("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n0123456789"))
+
+	// Test: A target that's too long, even before its line ends
+	assert.Equal(t, response.StatusURITooLong, status("GET /"+strings.Repeat("a", 100)))
+
+	// Test: Too many headers
+	assert.Equal(t, response.StatusRequestHeaderFieldsTooLarge, status("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n"))
+
+	// Test: A body that's too big, without waiting for it
+	assert.Equal(t, response.StatusContentTooLarge, status("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1000000\r\n\r\n"))
+
+	// Test: Zero is the default, not no limit at all
+	assert.Equal(t, response.StatusRequestHeaderFieldsTooLarge, status("GET / HTTP/1.1\r\nX: "+strings.Repeat("a", 100<<10)+"\r\n\r\n"))
+}
+
+func TestPipeliningLimit(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	cr := newConnReader(context.Background(), server, 2)
+	cr.start()
+	defer cr.stop()
+
+	req := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// Test: Two requests can wait, one in the queue and one in the reader
+	for range 2 {
+		client.SetWriteDeadline(time.Now().Add(time.Second))
+		_, err := client.Write(req)
+		require.NoError(t, err)
+	}
+
+	// Test: The third isn't even read
+	client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := client.Write(req)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Test: Until the first one is taken
+	next := <-cr.queue
+	require.NoError(t, next.err)
+	client.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err = client.Write(req)
+	assert.NoError(t, err)
+}
+
+func TestStripPrefix(t *testing.T) {
+	h := StripPrefix("/assets", func(w *response.Writer, req *request.Request) {
+		body := req.RequestLine.RequestTarget
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	})
+
+	serve := func(target string) (response.StatusCode, string) {
+		req, err := request.RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: x\r\n\r\n"))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		h(response.NewWriter(&buf), req)
+		res, err := response.NewResponseReader(&buf).ReadResponse()
+		require.NoError(t, err)
+		return res.StatusLine.StatusCode, string(res.Body)
+	}
+
+	// Test: Under the prefix, and the prefix itself
+	for target, want := range map[string]string{
+		"/assets/app.js":  "/app.js",
+		"/assets":         "/",
+		"/assets/":        "/",
+		"/assets?v=2":     "/?v=2",
+		"/assets/x/y?v=2": "/x/y?v=2",
+	} {
+		status, body := serve(target)
+		assert.Equal(t, response.StatusOk, status, target)
+		assert.Equal(t, want, body, target)
+	}
+
+	// Test: A path that only starts with the same letters isn't under it
+	status, _ := serve("/assetsfoo")
+	assert.Equal(t, response.StatusNotFound, status)
+	status, _ = serve("/other")
+	assert.Equal(t, response.StatusNotFound, status)
+}
+
+func TestTeeReader(t *testing.T) {
+	// Test: The start of a request is kept, in case it has to be handed back
+	tee := &teeReader{r: strings.NewReader("GET / HTTP/1.1\r\n")}
+	_, err := io.ReadAll(tee)
+	require.NoError(t, err)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(tee.data))
+	assert.False(t, tee.overflow)
+
+	// Test: A body isn't
+	tee = &teeReader{r: strings.NewReader(strings.Repeat("x", maxTee+1))}
+	_, err = io.ReadAll(tee)
+	require.NoError(t, err)
+	assert.Nil(t, tee.data)
+	assert.True(t, tee.overflow)
+}
@@ -0,0 +1,207 @@
+// Package servertest helps testing handlers, like net/http/httptest does for
+// net/http: a ResponseRecorder takes what a handler writes and parses it back,
+// NewRequest makes requests without a client, and NewServer runs a real server
+// on a loopback port for the tests that need the network.
+package servertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+// The client address of the requests from NewRequest, from the documentation range
+const RemoteAddr = "192.0.2.1:1234"
+
+// A ResponseRecorder records the bytes a handler writes to its Writer, exactly as
+// they would go out on the wire, and parses them back into a response.
+type ResponseRecorder struct {
+	// The Writer to give the handler
+	Writer *response.Writer
+
+	// The method of the request being answered. The answer to a HEAD has no
+	// body, whatever its headers say, so Parse needs to know.
+	Method string
+
+	conn *recordingConn
+}
+
+// NewRecorder returns a ResponseRecorder with nothing written yet.
+func NewRecorder() *ResponseRecorder {
+	conn := &recordingConn{}
+	return &ResponseRecorder{
+		Writer: response.NewWriter(conn),
+		conn:   conn,
+	}
+}
+
+// Record runs h with req and a new recorder, and returns the recorder.
+func Record(h server.HandlerFunc, req *request.Request) *ResponseRecorder {
+	rec := NewRecorder()
+	rec.Method = req.RequestLine.Method
+	h(rec.Writer, req)
+	return rec
+}
+
+// Bytes returns everything the handler wrote, framing included, and what it
+// wrote to the connection after a hijack too.
+func (rec *ResponseRecorder) Bytes() []byte {
+	return rec.conn.buf.Bytes()
+}
+
+// Parse parses what the handler wrote as a response: the status line, the
+// headers, the body (dechunked) and the trailers. It's an error if that isn't a
+// whole, valid response, or if there's anything after it.
+func (rec *ResponseRecorder) Parse() (*response.Response, error) {
+	if rec.conn.buf.Len() == 0 {
+		return nil, errors.New("nothing was written")
+	}
+
+	rr := response.NewResponseReader(bytes.NewReader(rec.Bytes()))
+	rr.Method = rec.Method
+	res, err := rr.ReadResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	// After a 101 the rest is the new protocol's business
+	if len(res.Buffered()) > 0 && res.StatusLine.StatusCode != response.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%d bytes after the end of the response", len(res.Buffered()))
+	}
+
+	return res, nil
+}
+
+// Result is Parse for tests: it fails t, showing what was written, if the
+// response doesn't parse.
+func (rec *ResponseRecorder) Result(t testing.TB) *response.Response {
+	t.Helper()
+
+	res, err := rec.Parse()
+	if err != nil {
+		t.Fatalf("servertest: invalid response: %v\n%q", err, rec.Bytes())
+	}
+	return res
+}
+
+// A net.Conn that keeps what's written to it and has nothing to read
+type recordingConn struct {
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.buf.Write(p)
+}
+
+func (c *recordingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *recordingConn) LocalAddr() net.Addr                { return recorderAddr("192.0.2.2:80") }
+func (c *recordingConn) RemoteAddr() net.Addr               { return recorderAddr(RemoteAddr) }
+func (c *recordingConn) SetDeadline(t time.Time) error      { return nil }
+func (c *recordingConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *recordingConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type recorderAddr string
+
+func (a recorderAddr) Network() string { return "servertest" }
+func (a recorderAddr) String() string  { return string(a) }
+
+// NewRequest returns a request as the parser would make it out of
+//
+//	<method> <target> HTTP/1.1
+//	Host: example.com
+//	Content-Length: <length of body>
+//
+// followed by the body. target is a path, or an absolute URL whose host goes in
+// Host instead. Other headers can be added to req.Headers afterwards.
+// Like httptest.NewRequest, it panics if that isn't a valid request.
+func NewRequest(method, target string, body io.Reader) *request.Request {
+	host := "example.com"
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			panic("servertest: invalid target: " + err.Error())
+		}
+		host = u.Host
+		target = u.RequestURI()
+	}
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = io.ReadAll(body)
+		if err != nil {
+			panic("servertest: reading body: " + err.Error())
+		}
+	}
+
+	raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n", method, target, host)
+	if body != nil {
+		raw += fmt.Sprintf("Content-Length: %d\r\n", len(data))
+	}
+	raw += "\r\n" + string(data)
+
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	if err != nil {
+		panic("servertest: invalid request: " + err.Error())
+	}
+	req.RemoteAddr = RemoteAddr
+
+	return req
+}
+
+// A Server is a server listening on a loopback port, for tests.
+type Server struct {
+	// http://127.0.0.1:port, without a trailing slash
+	URL    string
+	Server *server.Server
+}
+
+// NewServer starts a server for h on a free loopback port. Close it when the test is done.
+func NewServer(h server.HandlerFunc) *Server {
+	return NewServerWithConfig(h, server.Config{})
+}
+
+// Like NewServer, with the settings in cfg.
+func NewServerWithConfig(h server.HandlerFunc, cfg server.Config) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("servertest: failed to listen: " + err.Error())
+	}
+
+	return &Server{
+		URL:    "http://" + l.Addr().String(),
+		Server: server.ServeListener(l, h, cfg),
+	}
+}
+
+// Addr returns the address the server listens on, host:port.
+func (s *Server) Addr() string {
+	return s.Server.Listener.Addr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.Server.Close()
+}
@@ -0,0 +1,90 @@
+package servertest
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/client"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.Headers.Get("Host") + " " + string(req.Body)
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestRecorder(t *testing.T) {
+	// Test: A plain response, and the request as the parser makes it
+	req := NewRequest("POST", "/submit?x=1", strings.NewReader("hello"))
+	assert.Equal(t, "5", req.Headers.Get("Content-Length"))
+	assert.Equal(t, RemoteAddr, req.RemoteAddr)
+
+	rec := Record(echo, req)
+	res := rec.Result(t)
+	assert.Equal(t, response.StatusOk, res.StatusLine.StatusCode)
+	assert.Equal(t, "text/plain", res.Headers.Get("Content-Type"))
+	assert.Equal(t, "POST /submit?x=1 example.com hello", string(res.Body))
+	assert.True(t, strings.HasPrefix(string(rec.Bytes()), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Absolute URLs go into Host
+	res = Record(echo, NewRequest("GET", "http://localhost:42069/x", nil)).Result(t)
+	assert.Equal(t, "GET /x localhost:42069 ", string(res.Body))
+
+	// Test: Chunks come out dechunked, with their trailers
+	rec = Record(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Sum"})
+		w.WriteChunkedBody([]byte("hello, "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone(headers.Headers{"X-Sum": "abc"})
+	}, NewRequest("GET", "/", nil))
+	res = rec.Result(t)
+	assert.Equal(t, "hello, world", string(res.Body))
+	assert.Equal(t, "abc", res.Trailers.Get("X-Sum"))
+
+	// Test: The answer to a HEAD has no body
+	res = Record(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(100))
+	}, NewRequest("HEAD", "/", nil)).Result(t)
+	assert.Equal(t, "100", res.Headers.Get("Content-Length"))
+	assert.Empty(t, res.Body)
+
+	// Test: Nothing, half a response, or more than one, aren't a response
+	for _, h := range []func(w *response.Writer, req *request.Request){
+		func(w *response.Writer, req *request.Request) {},
+		func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.WriteBody([]byte("short"))
+		},
+		func(w *response.Writer, req *request.Request) {
+			echo(w, req)
+			echo(w, req)
+		},
+	} {
+		_, err := Record(h, NewRequest("GET", "/", nil)).Parse()
+		assert.Error(t, err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(echo)
+	defer s.Close()
+	assert.True(t, strings.HasPrefix(s.URL, "http://127.0.0.1:"))
+
+	res, err := client.Get(context.Background(), s.URL+"/hello")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "GET /hello "+s.Addr()+" ", string(body))
+}
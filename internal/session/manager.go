@@ -0,0 +1,305 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/cookie"
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/server"
+)
+
+const (
+	DefaultCookieName      = "session"
+	DefaultIdleTimeout     = 30 * time.Minute
+	DefaultAbsoluteTimeout = 12 * time.Hour
+	DefaultRotateInterval  = 15 * time.Minute
+
+	// After a rotation the old ID still works for a bit, for the requests that
+	// were already on their way with it
+	rotationGrace = 30 * time.Second
+)
+
+// Settings for a Manager. Zero fields get the defaults, except Keys, which is required.
+type Config struct {
+	// HMAC keys for the cookie, at least 32 bytes each. The first one signs and
+	// all of them verify, so a key can be replaced by putting the new one first
+	// and dropping the old one later.
+	Keys [][]byte
+
+	// Cookie attributes. The cookie is always HttpOnly, and SameSite=Lax unless set.
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	SameSite   cookie.SameSite
+
+	// A session nobody uses for this long is over
+	IdleTimeout time.Duration
+	// And so is one this old, used or not
+	AbsoluteTimeout time.Duration
+	// The session gets a new ID at least this often, so a stolen cookie doesn't last
+	RotateInterval time.Duration
+}
+
+// A Manager loads and saves the sessions of the requests that go through its Middleware.
+type Manager struct {
+	store Store
+	cfg   Config
+}
+
+// NewManager returns a Manager that keeps the sessions in store.
+func NewManager(store Store, cfg Config) (*Manager, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("session: no keys to sign the cookie")
+	}
+	for _, key := range cfg.Keys {
+		if len(key) < 32 {
+			return nil, errors.New("session: keys must be at least 32 bytes")
+		}
+	}
+
+	if cfg.CookieName == "" {
+		cfg.CookieName = DefaultCookieName
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.SameSite == cookie.SameSiteDefault {
+		cfg.SameSite = cookie.SameSiteLax
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.AbsoluteTimeout <= 0 {
+		cfg.AbsoluteTimeout = DefaultAbsoluteTimeout
+	}
+	if cfg.RotateInterval <= 0 {
+		cfg.RotateInterval = DefaultRotateInterval
+	}
+
+	// Checked here and not when the first cookie is set
+	err := (&cookie.Cookie{Name: cfg.CookieName, Path: cfg.Path, Domain: cfg.Domain, Secure: cfg.Secure, SameSite: cfg.SameSite}).Valid()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{store: store, cfg: cfg}, nil
+}
+
+// Middleware gives every request a session, available with FromRequest, Get and Set.
+// A new session isn't stored, and gets no cookie, until something is set in it.
+// The session is saved and the cookie set when the handler writes the headers;
+// changes made after that are still saved, but a Regenerate comes too late to
+// reach the client.
+func (m *Manager) Middleware(h server.HandlerFunc) server.HandlerFunc {
+	return func(w *response.Writer, req *request.Request) {
+		s := m.load(req)
+		req = req.WithContext(contextWithSession(req.Context(), s))
+
+		w.AddFilter(func(status response.StatusCode, h headers.Headers, next io.Writer) io.WriteCloser {
+			m.commit(s, h)
+			return nil
+		})
+
+		h(w, req)
+
+		// Headers never written (a hijack) or changes after them: save what we can
+		m.commit(s, nil)
+	}
+}
+
+// Finds the session of the request, or starts a new one.
+func (m *Manager) load(req *request.Request) *Session {
+	now := time.Now()
+	s := &Session{record: Record{Values: map[string]any{}, Created: now, LastSeen: now, Rotated: now}}
+
+	c, err := req.Cookie(m.cfg.CookieName)
+	if err != nil {
+		return s
+	}
+
+	id, ok := m.verify(c.Value)
+	if !ok {
+		return s
+	}
+
+	rec, found, err := m.store.Load(id)
+
+	// An old ID only says where the session went; a few hops at most, in case
+	// it rotated again during the grace period
+	moved := false
+	for hops := 0; err == nil && found && rec.Successor != "" && hops < 3; hops++ {
+		id = rec.Successor
+		moved = true
+		rec, found, err = m.store.Load(id)
+	}
+
+	if err != nil {
+		log.Printf("session: loading: %v", err)
+		return s
+	}
+	if !found || rec.Successor != "" {
+		return s
+	}
+
+	if now.After(m.expires(rec)) {
+		m.store.Delete(id)
+		return s
+	}
+
+	s.id = id
+	s.record = rec
+	s.stored = true
+	s.moved = moved
+	return s
+}
+
+// Saves the session if needed and, if h isn't nil (the headers haven't gone out
+// yet), sets the cookie when the ID changed.
+func (m *Manager) commit(s *Session, h headers.Headers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if s.destroyed {
+		if s.stored {
+			m.store.Delete(s.id)
+			if h != nil {
+				m.setCookie(h, "", -1)
+			}
+		}
+		s.id = ""
+		s.stored = false
+		s.dirty = false
+		return
+	}
+
+	// A new session with nothing in it isn't worth storing
+	if !s.stored && !s.dirty {
+		return
+	}
+
+	// The ID can only change while we can still tell the client
+	rotate := h != nil && (!s.stored || s.regenerate || now.Sub(s.record.Rotated) >= m.cfg.RotateInterval)
+
+	// Came with the old ID, the client still has to learn the new one
+	if s.moved && h != nil && !rotate {
+		m.setCookie(h, m.sign(s.id), m.maxAge(s.record))
+		s.moved = false
+	}
+
+	// Only touched now and then, to keep the idle timeout going without a write on every request
+	touch := now.Sub(s.record.LastSeen) >= m.cfg.IdleTimeout/10
+	if !s.dirty && !rotate && !touch {
+		return
+	}
+
+	if rotate {
+		oldID := s.id
+		s.id = newID()
+		s.record.Rotated = now
+
+		if s.stored {
+			if s.regenerate {
+				// Whoever knew the old ID must not be able to use it anymore
+				m.store.Delete(oldID)
+			} else {
+				// Only a pointer, so a late request with the old ID saves to the new one
+				m.store.Save(oldID, Record{Created: s.record.Created, Successor: s.id}, now.Add(rotationGrace))
+			}
+		}
+
+		m.setCookie(h, m.sign(s.id), m.maxAge(s.record))
+		s.moved = false
+	}
+
+	s.record.LastSeen = now
+	err := m.store.Save(s.id, s.record, m.expires(s.record))
+	if err != nil {
+		log.Printf("session: saving: %v", err)
+		return
+	}
+
+	s.stored = true
+	s.dirty = false
+	s.regenerate = false
+}
+
+// The cookie's Max-Age, up to the absolute timeout
+func (m *Manager) maxAge(r Record) int {
+	maxAge := int(time.Until(r.Created.Add(m.cfg.AbsoluteTimeout)).Seconds())
+	return max(maxAge, 1)
+}
+
+// When a record stops being valid, whichever timeout comes first
+func (m *Manager) expires(r Record) time.Time {
+	idle := r.LastSeen.Add(m.cfg.IdleTimeout)
+	absolute := r.Created.Add(m.cfg.AbsoluteTimeout)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+func (m *Manager) setCookie(h headers.Headers, value string, maxAge int) {
+	cookie.SetCookie(h, &cookie.Cookie{
+		Name:     m.cfg.CookieName,
+		Value:    value,
+		Path:     m.cfg.Path,
+		Domain:   m.cfg.Domain,
+		MaxAge:   maxAge,
+		Secure:   m.cfg.Secure,
+		HttpOnly: true,
+		SameSite: m.cfg.SameSite,
+	})
+}
+
+// 256 random bits, URL safe so they can go in a cookie as they are
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The cookie value is the ID and its HMAC: "id.mac"
+func (m *Manager) sign(id string) string {
+	return id + "." + base64.RawURLEncoding.EncodeToString(m.mac(m.cfg.Keys[0], id))
+}
+
+// Returns the ID in a cookie value if any of the keys signed it.
+func (m *Manager) verify(value string) (string, bool) {
+	id, sig, found := strings.Cut(value, ".")
+	if !found || id == "" {
+		return "", false
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+
+	for _, key := range m.cfg.Keys {
+		if hmac.Equal(mac, m.mac(key, id)) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// The cookie name goes in too, so a value can't be moved to another cookie
+func (m *Manager) mac(key []byte, id string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(m.cfg.CookieName + "|" + id))
+	return h.Sum(nil)
+}
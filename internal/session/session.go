@@ -0,0 +1,125 @@
+// Package session implements server-side sessions: the data lives in a Store,
+// and the client only gets a signed cookie with a random session ID.
+package session
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+)
+
+// A Session is the data of one client, as loaded for one of its requests.
+// It's safe to use from several goroutines.
+type Session struct {
+	mu     sync.Mutex
+	id     string
+	record Record
+
+	// Whether it exists in the store yet
+	stored bool
+	// Values changed since it was last saved
+	dirty bool
+	// Regenerate or Destroy were called
+	regenerate bool
+	destroyed  bool
+	// Loaded through an ID that was rotated away, the client needs the cookie again
+	moved bool
+}
+
+// ID returns the current session ID. It's "" for a new session until it's saved.
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// Get returns the value stored under key, or nil.
+func (s *Session) Get(key string) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.record.Values[key]
+}
+
+// Set stores value under key.
+func (s *Session) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record.Values[key] = value
+	s.dirty = true
+}
+
+// Delete removes key from the session.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.record.Values, key)
+	s.dirty = true
+}
+
+// Keys returns the keys in the session, in no particular order.
+func (s *Session) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Collect(maps.Keys(s.record.Values))
+}
+
+// Regenerate gives the session a new ID, keeping its data, and forgets the old one.
+// Call it whenever the privileges change (logging in, mostly), so that an ID
+// somebody planted in the browser before (session fixation) is worth nothing.
+func (s *Session) Regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.regenerate = true
+	s.dirty = true
+}
+
+// Destroy deletes the session and its cookie, for logging out.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroyed = true
+	s.record.Values = map[string]any{}
+}
+
+type contextKey struct{}
+
+func contextWithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromRequest returns the session of the request, or nil if it didn't go through
+// the Manager's Middleware.
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+// Get returns the value stored under key in the request's session, if there's
+// one of type T.
+func Get[T any](req *request.Request, key string) (T, bool) {
+	var zero T
+
+	s := FromRequest(req)
+	if s == nil {
+		return zero, false
+	}
+
+	v, ok := s.Get(key).(T)
+	if !ok {
+		return zero, false
+	}
+	return v, true
+}
+
+// Set stores value under key in the request's session.
+// It panics if the request has no session, that's a missing Middleware.
+func Set[T any](req *request.Request, key string, value T) {
+	s := FromRequest(req)
+	if s == nil {
+		panic("session: request has no session, is the Manager's Middleware missing?")
+	}
+	s.Set(key, value)
+}
@@ -0,0 +1,343 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	key1 = bytes.Repeat([]byte("k"), 32)
+	key2 = bytes.Repeat([]byte("j"), 32)
+)
+
+func testHandler(w *response.Writer, req *request.Request) {
+	body := ""
+
+	switch req.RequestLine.RequestTarget {
+	case "/count":
+		n, _ := Get[int](req, "count")
+		Set(req, "count", n+1)
+		body = strconv.Itoa(n + 1)
+
+	case "/peek":
+		n, _ := Get[int](req, "count")
+		user, _ := Get[string](req, "user")
+		body = fmt.Sprintf("%d %s", n, user)
+
+	case "/login":
+		FromRequest(req).Regenerate()
+		Set(req, "user", "admin")
+
+	case "/logout":
+		FromRequest(req).Destroy()
+
+	case "/late":
+		// Set after the headers are gone, it must still be saved
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		Set(req, "count", 100)
+		return
+	}
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+var client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// Does a GET with the session cookie, if any, and returns the body and the new cookie, if any.
+func get(t *testing.T, url string, c *http.Cookie) (string, *http.Cookie) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if c != nil {
+		req.AddCookie(c)
+	}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	cookies := res.Cookies()
+	require.LessOrEqual(t, len(cookies), 1)
+	if len(cookies) == 0 {
+		return string(body), nil
+	}
+	return string(body), cookies[0]
+}
+
+func newManager(t *testing.T, store Store, cfg Config) *Manager {
+	if cfg.Keys == nil {
+		cfg.Keys = [][]byte{key1}
+	}
+	m, err := NewManager(store, cfg)
+	require.NoError(t, err)
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+	s := servertest.NewServer(newManager(t, store, Config{}).Middleware(testHandler))
+	defer s.Close()
+	base := s.URL
+
+	// Test: Nothing stored and no cookie until something is set
+	body, c := get(t, base+"/peek", nil)
+	assert.Equal(t, "0 ", body)
+	assert.Nil(t, c)
+	assert.Equal(t, 0, store.Len())
+
+	// Test: The first Set creates the session and its cookie
+	body, c = get(t, base+"/count", nil)
+	assert.Equal(t, "1", body)
+	require.NotNil(t, c)
+	assert.Equal(t, "session", c.Name)
+	assert.True(t, c.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, c.SameSite)
+	assert.Equal(t, "/", c.Path)
+	assert.Greater(t, c.MaxAge, 0)
+	assert.Equal(t, 1, store.Len())
+
+	// Test: The cookie brings the session back, and isn't sent again
+	body, c2 := get(t, base+"/count", c)
+	assert.Equal(t, "2", body)
+	assert.Nil(t, c2)
+
+	// Test: A tampered cookie is a new session
+	id, _, _ := strings.Cut(c.Value, ".")
+	forged := &http.Cookie{Name: "session", Value: id + ".AAAA"}
+	body, _ = get(t, base+"/peek", forged)
+	assert.Equal(t, "0 ", body)
+
+	// Test: Values set after the headers are saved too
+	get(t, base+"/late", c)
+	body, _ = get(t, base+"/peek", c)
+	assert.Equal(t, "100 ", body)
+
+	// Test: Logging in changes the ID and keeps the data; the old ID is worthless
+	_, loggedIn := get(t, base+"/login", c)
+	require.NotNil(t, loggedIn)
+	assert.NotEqual(t, c.Value, loggedIn.Value)
+	body, _ = get(t, base+"/peek", loggedIn)
+	assert.Equal(t, "100 admin", body)
+	body, _ = get(t, base+"/peek", c)
+	assert.Equal(t, "0 ", body)
+
+	// Test: Logging out deletes the session and the cookie
+	_, deleted := get(t, base+"/logout", loggedIn)
+	require.NotNil(t, deleted)
+	assert.Equal(t, -1, deleted.MaxAge) // net/http's way of saying Max-Age=0
+	body, _ = get(t, base+"/peek", loggedIn)
+	assert.Equal(t, "0 ", body)
+	assert.Equal(t, 0, store.Len())
+}
+
+func TestTimeouts(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+
+	// Test: Idle timeout
+	s := servertest.NewServer(newManager(t, store, Config{IdleTimeout: 100 * time.Millisecond}).Middleware(testHandler))
+	defer s.Close()
+	base := s.URL
+	_, c := get(t, base+"/count", nil)
+	require.NotNil(t, c)
+	time.Sleep(50 * time.Millisecond)
+	body, _ := get(t, base+"/count", c)
+	assert.Equal(t, "2", body)
+	time.Sleep(150 * time.Millisecond)
+	body, _ = get(t, base+"/count", c)
+	assert.Equal(t, "1", body)
+
+	// Test: Absolute timeout, however busy the session is
+	s2 := servertest.NewServer(newManager(t, store, Config{AbsoluteTimeout: 150 * time.Millisecond}).Middleware(testHandler))
+	defer s2.Close()
+	base = s2.URL
+	_, c = get(t, base+"/count", nil)
+	require.NotNil(t, c)
+	for range 3 {
+		time.Sleep(40 * time.Millisecond)
+		get(t, base+"/count", c)
+	}
+	time.Sleep(100 * time.Millisecond)
+	body, _ = get(t, base+"/count", c)
+	assert.Equal(t, "1", body)
+
+	// Test: The ID rotates, and the old cookie works for a little while
+	s3 := servertest.NewServer(newManager(t, store, Config{RotateInterval: 50 * time.Millisecond}).Middleware(testHandler))
+	defer s3.Close()
+	base = s3.URL
+	_, c = get(t, base+"/count", nil)
+	require.NotNil(t, c)
+	time.Sleep(60 * time.Millisecond)
+	body, rotated := get(t, base+"/count", c)
+	assert.Equal(t, "2", body)
+	require.NotNil(t, rotated)
+	assert.NotEqual(t, c.Value, rotated.Value)
+	body, _ = get(t, base+"/peek", rotated)
+	assert.Equal(t, "2 ", body)
+	body, _ = get(t, base+"/peek", c)
+	assert.Equal(t, "2 ", body)
+}
+
+func TestRotationGrace(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+	s := servertest.NewServer(newManager(t, store, Config{RotateInterval: 50 * time.Millisecond}).Middleware(testHandler))
+	defer s.Close()
+	base := s.URL
+
+	_, c := get(t, base+"/count", nil)
+	require.NotNil(t, c)
+	time.Sleep(60 * time.Millisecond)
+	_, rotated := get(t, base+"/count", c)
+	require.NotNil(t, rotated)
+	oldID, _, _ := strings.Cut(c.Value, ".")
+
+	// Test: A write with the old ID goes to the session under the new one, and the client gets the new cookie again
+	body, again := get(t, base+"/count", c)
+	assert.Equal(t, "3", body)
+	require.NotNil(t, again)
+	assert.Equal(t, rotated.Value, again.Value)
+	body, _ = get(t, base+"/peek", rotated)
+	assert.Equal(t, "3 ", body)
+
+	// Test: And the old ID still goes away when the grace period is over
+	store.mu.Lock()
+	entry := store.sessions[oldID]
+	store.mu.Unlock()
+	assert.NotEmpty(t, entry.record.Successor)
+	assert.False(t, entry.expires.After(time.Now().Add(rotationGrace)))
+	assert.Equal(t, 2, store.Len())
+}
+
+func TestKeyRotation(t *testing.T) {
+	store := NewMemoryStore(0)
+	defer store.Close()
+
+	// Test: A cookie signed with the old key still works after adding a new one
+	s := servertest.NewServer(newManager(t, store, Config{Keys: [][]byte{key1}}).Middleware(testHandler))
+	defer s.Close()
+	oldBase := s.URL
+	_, c := get(t, oldBase+"/count", nil)
+	require.NotNil(t, c)
+
+	s2 := servertest.NewServer(newManager(t, store, Config{Keys: [][]byte{key2, key1}}).Middleware(testHandler))
+	defer s2.Close()
+	newBase := s2.URL
+	body, _ := get(t, newBase+"/count", c)
+	assert.Equal(t, "2", body)
+
+	// Test: And stops working once it's dropped
+	s3 := servertest.NewServer(newManager(t, store, Config{Keys: [][]byte{key2}}).Middleware(testHandler))
+	defer s3.Close()
+	droppedBase := s3.URL
+	body, _ = get(t, droppedBase+"/count", c)
+	assert.Equal(t, "1", body)
+
+	// Test: Bad configurations
+	_, err := NewManager(store, Config{})
+	assert.Error(t, err)
+	_, err = NewManager(store, Config{Keys: [][]byte{[]byte("short")}})
+	assert.Error(t, err)
+	_, err = NewManager(store, Config{Keys: [][]byte{key1}, CookieName: "bad name"})
+	assert.Error(t, err)
+}
+
+func TestGetSet(t *testing.T) {
+	s := &Session{record: Record{Values: map[string]any{}}}
+	req := (&request.Request{}).WithContext(contextWithSession(t.Context(), s))
+
+	// Test: Typed access
+	Set(req, "n", 42)
+	n, ok := Get[int](req, "n")
+	assert.True(t, ok)
+	assert.Equal(t, 42, n)
+
+	// Test: Wrong type or missing
+	_, ok = Get[string](req, "n")
+	assert.False(t, ok)
+	_, ok = Get[int](req, "missing")
+	assert.False(t, ok)
+
+	// Test: No session
+	_, ok = Get[int](&request.Request{}, "n")
+	assert.False(t, ok)
+	assert.Panics(t, func() { Set(&request.Request{}, "n", 1) })
+}
+
+type profile struct {
+	Name  string
+	Roles []string
+}
+
+func TestStores(t *testing.T) {
+	gob.Register(profile{})
+
+	fileStore, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	memoryStore := NewMemoryStore(20 * time.Millisecond)
+	defer memoryStore.Close()
+
+	for name, store := range map[string]Store{"memory": memoryStore, "file": fileStore} {
+		now := time.Now().Round(0)
+		rec := Record{
+			Values:   map[string]any{"user": profile{Name: "jo", Roles: []string{"admin"}}, "n": 3},
+			Created:  now,
+			LastSeen: now,
+			Rotated:  now,
+		}
+
+		// Test: Save and Load
+		require.NoError(t, store.Save("abc", rec, now.Add(time.Hour)), name)
+		got, found, err := store.Load("abc")
+		require.NoError(t, err, name)
+		require.True(t, found, name)
+		assert.Equal(t, rec.Values, got.Values, name)
+		assert.True(t, rec.Created.Equal(got.Created), name)
+
+		// Test: What's loaded is a copy
+		got.Values["n"] = 4
+		got, _, _ = store.Load("abc")
+		assert.Equal(t, 3, got.Values["n"], name)
+
+		// Test: Delete, twice
+		require.NoError(t, store.Delete("abc"), name)
+		require.NoError(t, store.Delete("abc"), name)
+		_, found, err = store.Load("abc")
+		require.NoError(t, err, name)
+		assert.False(t, found, name)
+
+		// Test: Expired records aren't loaded
+		require.NoError(t, store.Save("old", rec, now.Add(-time.Second)), name)
+		_, found, _ = store.Load("old")
+		assert.False(t, found, name)
+	}
+
+	// Test: Sweeping
+	memoryStore.Save("old", Record{}, time.Now().Add(-time.Second))
+	memoryStore.Save("new", Record{}, time.Now().Add(time.Hour))
+	assert.Eventually(t, func() bool { return memoryStore.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	fileStore.Save("old", Record{}, time.Now().Add(-time.Second))
+	fileStore.Save("new", Record{}, time.Now().Add(time.Hour))
+	require.NoError(t, fileStore.Sweep())
+	entries, _ := filepath.Glob(filepath.Join(fileStore.dir, "*"))
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,262 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Record is what a Store keeps for a session.
+type Record struct {
+	Values map[string]any
+
+	// When the session started, for the absolute timeout
+	Created time.Time
+	// The last request that used it, for the idle timeout
+	LastSeen time.Time
+	// When the ID was last changed
+	Rotated time.Time
+
+	// Set in what's left under an ID after a rotation: the ID the session moved
+	// to. Such a record has nothing else in it and is never saved again.
+	Successor string
+}
+
+func (r Record) clone() Record {
+	r.Values = maps.Clone(r.Values)
+	if r.Values == nil {
+		r.Values = map[string]any{}
+	}
+	return r
+}
+
+// A Store keeps sessions by ID. Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns the record for id, and false if there isn't one or it has expired.
+	Load(id string) (Record, bool, error)
+
+	// Save stores the record for id, which can be forgotten after expires.
+	Save(id string, r Record, expires time.Time) error
+
+	// Delete forgets id. Deleting an id that doesn't exist isn't an error.
+	Delete(id string) error
+}
+
+// MemoryStore keeps sessions in memory, so they're lost when the process exits.
+// Expired sessions are removed in the background.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type memoryEntry struct {
+	record  Record
+	expires time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore that looks for expired sessions
+// every sweepEvery (every minute if it's 0). Call Close to stop it.
+func NewMemoryStore(sweepEvery time.Duration) *MemoryStore {
+	if sweepEvery <= 0 {
+		sweepEvery = time.Minute
+	}
+
+	s := &MemoryStore{
+		sessions: map[string]memoryEntry{},
+		stop:     make(chan struct{}),
+	}
+	go s.sweepLoop(sweepEvery)
+
+	return s
+}
+
+func (s *MemoryStore) Load(id string) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[id]
+	if !ok || time.Now().After(e.expires) {
+		return Record{}, false, nil
+	}
+	// A copy, the caller is going to change it
+	return e.record.clone(), true, nil
+}
+
+func (s *MemoryStore) Save(id string, r Record, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[id] = memoryEntry{record: r.clone(), expires: expires}
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+// Len returns how many sessions are stored, expired or not.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Sweep removes the expired sessions now.
+func (s *MemoryStore) Sweep() {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, e := range s.sessions {
+		if now.After(e.expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Close stops the background sweeping.
+func (s *MemoryStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+func (s *MemoryStore) sweepLoop(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// FileStore keeps each session in its own file in a directory, encoded with
+// encoding/gob, so they survive restarts. Values of types of your own have to be
+// registered with gob.Register.
+type FileStore struct {
+	dir string
+}
+
+// On disk, the record with its expiry
+type fileEntry struct {
+	Record  Record
+	Expires time.Time
+}
+
+// NewFileStore returns a FileStore in dir, which is created if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// The file name is a hash of the ID, so nothing in the ID ends up in a path
+func (s *FileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".session")
+}
+
+func (s *FileStore) Load(id string) (Record, bool, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+
+	var e fileEntry
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&e)
+	if err != nil {
+		return Record{}, false, err
+	}
+
+	if time.Now().After(e.Expires) {
+		os.Remove(s.path(id))
+		return Record{}, false, nil
+	}
+
+	return e.Record.clone(), true, nil
+}
+
+func (s *FileStore) Save(id string, r Record, expires time.Time) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(fileEntry{Record: r, Expires: expires})
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file and renamed, so a crash never leaves half a session
+	f, err := os.CreateTemp(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path(id))
+}
+
+func (s *FileStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Sweep removes the files of expired sessions. Unlike MemoryStore it doesn't run
+// by itself, call it now and then.
+func (s *FileStore) Sweep() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".session") {
+			continue
+		}
+
+		name := filepath.Join(s.dir, entry.Name())
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+
+		var e fileEntry
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(&e) != nil || now.After(e.Expires) {
+			os.Remove(name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,459 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types (frame opcodes, RFC 6455 section 5.2)
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// Close status codes (RFC 6455 section 7.4.1)
+const (
+	CloseNormalClosure     = 1000
+	CloseGoingAway         = 1001
+	CloseProtocolError     = 1002
+	CloseUnsupportedData   = 1003
+	CloseNoStatusReceived  = 1005
+	CloseInvalidPayload    = 1007
+	ClosePolicyViolation   = 1008
+	CloseMessageTooBig     = 1009
+	CloseInternalServerErr = 1011
+)
+
+// Control frames can't carry more than this (RFC 6455 section 5.5)
+const maxControlPayload = 125
+
+// How long Close waits for the peer to answer our close frame
+const closeTimeout = 5 * time.Second
+
+var (
+	ErrMessageTooBig = errors.New("websocket: message exceeds size limit")
+	ErrCloseSent     = errors.New("websocket: close frame already sent")
+)
+
+// Returned by ReadMessage when the peer closes the connection.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// Conn is a WebSocket connection. ReadMessage must only be called from one goroutine
+// at a time; writes are serialized internally, so a goroutine can push messages
+// while another one reads.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+
+	subprotocol    string
+	maxMessageSize int64
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	// Set once we've seen the peer's close frame
+	closeReceived bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool) *Conn {
+	return &Conn{
+		conn:           conn,
+		br:             br,
+		isServer:       isServer,
+		maxMessageSize: defaultMaxMessageSize,
+	}
+}
+
+// The subprotocol selected during the handshake, or "".
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Changes the largest message ReadMessage accepts.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.maxMessageSize = limit
+}
+
+// The underlying network connection, e.g. to set deadlines.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// A single frame as it came off the wire (payload already unmasked)
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// ReadMessage returns the next text or binary message, joining fragments.
+// Pings are answered and pongs skipped along the way. When the peer closes
+// the connection, the close is answered and a *CloseError is returned.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	messageType = -1
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return -1, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			err = c.writeFrame(PongMessage, f.payload, true)
+			if err != nil && err != ErrCloseSent {
+				return -1, nil, err
+			}
+			continue
+
+		case PongMessage:
+			continue
+
+		case CloseMessage:
+			return -1, nil, c.handleClose(f.payload)
+
+		case TextMessage, BinaryMessage:
+			if messageType != -1 {
+				return -1, nil, c.fail(CloseProtocolError, "new message started before the previous one finished")
+			}
+			messageType = f.opcode
+
+		case continuationFrame:
+			if messageType == -1 {
+				return -1, nil, c.fail(CloseProtocolError, "continuation frame without a message")
+			}
+
+		default:
+			return -1, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", f.opcode))
+		}
+
+		if int64(len(data)+len(f.payload)) > c.maxMessageSize {
+			c.fail(CloseMessageTooBig, "message too big")
+			return -1, nil, ErrMessageTooBig
+		}
+		data = append(data, f.payload...)
+
+		if f.fin {
+			break
+		}
+	}
+
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return -1, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+	}
+
+	return messageType, data, nil
+}
+
+// Reads one frame and checks the rules that apply to every frame.
+func (c *Conn) readFrame() (frame, error) {
+	var head [2]byte
+	_, err := io.ReadFull(c.br, head[:])
+	if err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		fin:    head[0]&0x80 != 0,
+		opcode: int(head[0] & 0x0f),
+	}
+	masked := head[1]&0x80 != 0
+
+	// We don't negotiate any extension, so the reserved bits must be 0
+	if head[0]&0x70 != 0 {
+		return frame{}, c.fail(CloseProtocolError, "reserved bits set")
+	}
+
+	// Clients must mask every frame, servers must not mask any
+	if masked != c.isServer {
+		return frame{}, c.fail(CloseProtocolError, "bad masking")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, c.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+	if err != nil {
+		return frame{}, err
+	}
+
+	if f.opcode >= CloseMessage {
+		if !f.fin {
+			return frame{}, c.fail(CloseProtocolError, "fragmented control frame")
+		}
+		if length > maxControlPayload {
+			return frame{}, c.fail(CloseProtocolError, "control frame too long")
+		}
+	}
+
+	// Don't even allocate a frame that can't fit in a message
+	if int64(length) > c.maxMessageSize {
+		c.fail(CloseMessageTooBig, "message too big")
+		return frame{}, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		_, err = io.ReadFull(c.br, mask[:])
+		if err != nil {
+			return frame{}, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(c.br, f.payload)
+	if err != nil {
+		return frame{}, err
+	}
+
+	if masked {
+		maskBytes(mask, f.payload)
+	}
+
+	return f, nil
+}
+
+// Answers the peer's close frame and turns it into a *CloseError.
+func (c *Conn) handleClose(payload []byte) error {
+	c.closeReceived = true
+
+	code := CloseNoStatusReceived
+	text := ""
+
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		code = int(binary.BigEndian.Uint16(payload))
+		text = string(payload[2:])
+		if !validCloseCode(code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(text) {
+			return c.fail(CloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+
+	// Echo the status code back, unless we started the closing handshake ourselves
+	reply := []byte{}
+	if code != CloseNoStatusReceived {
+		reply = closePayload(code, "")
+	}
+	c.writeFrame(CloseMessage, reply, true)
+	c.conn.Close()
+
+	return &CloseError{Code: code, Text: text}
+}
+
+// Sends a close frame with the given code and drops the connection.
+// Used when the peer breaks the protocol, so there's no point waiting for its answer.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeFrame(CloseMessage, closePayload(code, reason), true)
+	c.conn.Close()
+	return &CloseError{Code: code, Text: reason}
+}
+
+// WriteMessage sends data as a single frame.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return c.writeControl(messageType, data)
+	}
+
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return errors.New("websocket: text message is not valid UTF-8")
+	}
+
+	return c.writeFrame(messageType, data, true)
+}
+
+// WriteFragmented sends data split into frames of at most fragmentSize bytes.
+// Control frames (like pings) sent from other goroutines can be interleaved between the fragments.
+func (c *Conn) WriteFragmented(messageType int, data []byte, fragmentSize int) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return errors.New("websocket: only data messages can be fragmented")
+	}
+	if fragmentSize <= 0 {
+		return errors.New("websocket: fragment size must be positive")
+	}
+
+	opcode := messageType
+	for {
+		n := min(fragmentSize, len(data))
+		fin := n == len(data)
+
+		err := c.writeFrame(opcode, data[:n], fin)
+		if err != nil {
+			return err
+		}
+
+		if fin {
+			return nil
+		}
+
+		data = data[n:]
+		opcode = continuationFrame
+	}
+}
+
+// Sends a ping; the answer is consumed by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(PingMessage, data)
+}
+
+func (c *Conn) writeControl(opcode int, data []byte) error {
+	if opcode != PingMessage && opcode != PongMessage && opcode != CloseMessage {
+		return fmt.Errorf("websocket: unknown message type %d", opcode)
+	}
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: control frame payload too long")
+	}
+
+	return c.writeFrame(opcode, data, true)
+}
+
+// Close starts the closing handshake with 1000 (normal closure).
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormalClosure, "")
+}
+
+// CloseWithCode sends a close frame, waits a little for the peer's answer
+// and closes the connection.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	if c.closeReceived {
+		// Handshake already finished in ReadMessage
+		return c.conn.Close()
+	}
+
+	err := c.writeFrame(CloseMessage, closePayload(code, reason), true)
+	if err != nil && err != ErrCloseSent {
+		c.conn.Close()
+		return err
+	}
+
+	// Wait for the close frame from the peer, discarding anything before it
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	for {
+		f, err := c.readFrame()
+		if err != nil || f.opcode == CloseMessage {
+			break
+		}
+	}
+
+	return c.conn.Close()
+}
+
+// Writes a single frame. Frames written by a client are masked.
+func (c *Conn) writeFrame(opcode int, payload []byte, fin bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+
+	if c.isServer {
+		buf = append(buf, payload...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(mask, buf[start:])
+	}
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// XORs b with the masking key, in place. Masking and unmasking are the same operation.
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// A reason too long for a control frame is cut, without splitting a character.
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatusReceived {
+		return []byte{}
+	}
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+		for len(reason) > 0 && !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	p := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(p, reason...)
+}
+
+// Codes a peer is allowed to send in a close frame (RFC 6455 section 7.4)
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+// Package websocket implements the server side of the WebSocket protocol (RFC 6455)
+// on top of our server: a handler upgrades the request and then talks frames
+// over the hijacked connection.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/neixir/httpfromtcp/internal/headers"
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+)
+
+// The GUID every server concatenates with the client key (RFC 6455, section 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Used when Upgrader.MaxMessageSize is zero
+const defaultMaxMessageSize = 1 << 20
+
+// Upgrader holds the options for turning an HTTP request into a WebSocket connection.
+type Upgrader struct {
+	// Subprotocols the server speaks, in order of preference.
+	// The first one that the client also offers is selected.
+	Subprotocols []string
+
+	// Largest message (after joining fragments) we accept from the peer.
+	// Zero means defaultMaxMessageSize.
+	MaxMessageSize int64
+
+	// If set and it returns false, the handshake is refused with 403.
+	// Browsers always send Origin, so this is where cross-site checks go.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// Computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Reports whether the request asks to be upgraded to a WebSocket.
+func IsUpgrade(req *request.Request) bool {
+	return req.Headers.HasToken("Connection", "upgrade") &&
+		req.Headers.HasToken("Upgrade", "websocket")
+}
+
+// Upgrade validates the opening handshake, answers it with 101 Switching Protocols
+// and hijacks the connection. If the handshake is not valid, an error response
+// has already been written when Upgrade returns the error.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		return nil, refuse(w, response.StatusMethodNotAllowed, "websocket: method must be GET")
+	}
+
+	if !IsUpgrade(req) {
+		return nil, refuse(w, response.StatusBadRequest, "websocket: not a websocket upgrade request")
+	}
+
+	if req.Headers.Get("Sec-WebSocket-Version") != "13" {
+		return nil, refuse(w, response.StatusUpgradeRequired, "websocket: unsupported version")
+	}
+
+	key := strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Key"))
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return nil, refuse(w, response.StatusBadRequest, "websocket: invalid Sec-WebSocket-Key")
+	}
+
+	if u.CheckOrigin != nil && !u.CheckOrigin(req) {
+		return nil, refuse(w, response.StatusForbidden, "websocket: origin not allowed")
+	}
+
+	subprotocol := u.selectSubprotocol(req)
+
+	err = w.WriteStatusLine(response.StatusSwitchingProtocols)
+	if err != nil {
+		return nil, err
+	}
+
+	h := headers.Headers{
+		"Upgrade":              "websocket",
+		"Connection":           "Upgrade",
+		"Sec-WebSocket-Accept": AcceptKey(key),
+	}
+	if subprotocol != "" {
+		h["Sec-WebSocket-Protocol"] = subprotocol
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// The client may have sent its first frames together with the handshake,
+	// so those bytes have to be read before anything else on the connection.
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), netConn))
+
+	c := newConn(netConn, br, true)
+	c.subprotocol = subprotocol
+	c.maxMessageSize = u.MaxMessageSize
+	if c.maxMessageSize == 0 {
+		c.maxMessageSize = defaultMaxMessageSize
+	}
+
+	return c, nil
+}
+
+// Picks the first of our subprotocols that the client also offered.
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := req.Headers.Get("Sec-WebSocket-Protocol")
+	if offered == "" {
+		return ""
+	}
+
+	for _, ours := range u.Subprotocols {
+		for _, theirs := range strings.Split(offered, ",") {
+			if strings.TrimSpace(theirs) == ours {
+				return ours
+			}
+		}
+	}
+
+	return ""
+}
+
+// Writes a plain text error response for a failed handshake and returns msg as an error.
+func refuse(w *response.Writer, status response.StatusCode, msg string) error {
+	body := fmt.Sprintf("%d %s\n", status, response.StatusText(status))
+
+	w.WriteStatusLine(status)
+	h := response.GetDefaultHeaders(len(body))
+	switch status {
+	case response.StatusUpgradeRequired:
+		h["Sec-WebSocket-Version"] = "13"
+	case response.StatusMethodNotAllowed:
+		h["Allow"] = "GET"
+	}
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+
+	return errors.New(msg)
+}
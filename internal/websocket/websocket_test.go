@@ -0,0 +1,205 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/neixir/httpfromtcp/internal/request"
+	"github.com/neixir/httpfromtcp/internal/response"
+	"github.com/neixir/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /ws HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Protocol: chat, superchat\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"\r\n"
+
+// Starts a server that upgrades every request and echoes messages back until the client closes.
+func startEchoServer(t *testing.T, u *Upgrader) *servertest.Server {
+	s := servertest.NewServer(func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		for {
+			mt, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(mt, data)
+		}
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Sends the handshake and returns the status line, the response headers and a client side Conn.
+func dial(t *testing.T, s *servertest.Server, hs string) (string, string, *Conn) {
+	conn, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write([]byte(hs))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+
+	head := ""
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		head += line
+	}
+
+	return statusLine, head, newConn(conn, br, false)
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgrade(t *testing.T) {
+	s := startEchoServer(t, &Upgrader{Subprotocols: []string{"superchat", "chat"}})
+
+	// Test: Valid handshake
+	statusLine, head, c := dial(t, s, handshake)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	assert.Contains(t, head, "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "Sec-WebSocket-Protocol: superchat\r\n")
+
+	// Test: Text message echo
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hola")))
+	mt, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "hola", string(data))
+
+	// Test: Fragmented binary message comes back joined
+	require.NoError(t, c.WriteFragmented(BinaryMessage, []byte("0123456789"), 3))
+	mt, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, mt)
+	assert.Equal(t, "0123456789", string(data))
+
+	// Test: Large message uses the 16 bit length
+	big := strings.Repeat("x", 70000)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte(big)))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, big, string(data))
+
+	// Test: Ping is answered with a pong (which ReadMessage skips)
+	require.NoError(t, c.Ping([]byte("are you there")))
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("after ping")))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+
+	// Test: Close handshake
+	require.NoError(t, c.Close())
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	s := startEchoServer(t, &Upgrader{
+		CheckOrigin: func(req *request.Request) bool {
+			return req.Headers.Get("Origin") != "https://evil.example"
+		},
+	})
+
+	// Test: Wrong version
+	statusLine, head, _ := dial(t, s, strings.Replace(handshake, "Version: 13", "Version: 8", 1))
+	assert.Equal(t, "HTTP/1.1 426 Upgrade Required\r\n", statusLine)
+	assert.Contains(t, head, "Sec-WebSocket-Version: 13\r\n")
+
+	// Test: Key that isn't 16 bytes
+	statusLine, _, _ = dial(t, s, strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\n", statusLine)
+
+	// Test: Not an upgrade
+	statusLine, _, _ = dial(t, s, "GET /ws HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\n", statusLine)
+
+	// Test: Wrong method
+	statusLine, head, _ = dial(t, s, strings.Replace(handshake, "GET", "POST", 1))
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n", statusLine)
+	assert.Contains(t, head, "Allow: GET\r\n")
+
+	// Test: Origin rejected
+	statusLine, _, _ = dial(t, s, strings.Replace(handshake, "Host: localhost\r\n", "Host: localhost\r\nOrigin: https://evil.example\r\n", 1))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", statusLine)
+}
+
+func TestCloseReason(t *testing.T) {
+	// 200 bytes of two byte characters, too much for a control frame
+	reason := strings.Repeat("é", 100)
+
+	s := servertest.NewServer(func(w *response.Writer, req *request.Request) {
+		c, err := (&Upgrader{}).Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		c.CloseWithCode(CloseGoingAway, reason)
+	})
+	t.Cleanup(s.Close)
+
+	// Test: A long reason is cut to fit, at a character boundary, instead of breaking the frame
+	_, _, c := dial(t, s, handshake)
+	_, _, err := c.ReadMessage()
+	var ce *CloseError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, CloseGoingAway, ce.Code)
+	assert.Equal(t, reason[:122], ce.Text)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	s := startEchoServer(t, &Upgrader{MaxMessageSize: 16})
+
+	closeCode := func(err error) int {
+		var ce *CloseError
+		if errors.As(err, &ce) {
+			return ce.Code
+		}
+		return 0
+	}
+
+	// Test: Invalid UTF-8 in a text message
+	_, _, c := dial(t, s, handshake)
+	require.NoError(t, c.writeFrame(TextMessage, []byte{0xff, 0xfe}, true))
+	_, _, err := c.ReadMessage()
+	assert.Equal(t, CloseInvalidPayload, closeCode(err))
+
+	// Test: Message over the size limit
+	_, _, c = dial(t, s, handshake)
+	require.NoError(t, c.WriteFragmented(BinaryMessage, make([]byte, 32), 8))
+	_, _, err = c.ReadMessage()
+	assert.Equal(t, CloseMessageTooBig, closeCode(err))
+
+	// Test: Unmasked frame from the client
+	_, _, c = dial(t, s, handshake)
+	c.isServer = true // writes without a mask
+	require.NoError(t, c.writeFrame(TextMessage, []byte("hi"), true))
+	c.isServer = false
+	_, _, err = c.ReadMessage()
+	assert.Equal(t, CloseProtocolError, closeCode(err))
+
+	// Test: Continuation without a message
+	_, _, c = dial(t, s, handshake)
+	require.NoError(t, c.writeFrame(continuationFrame, []byte("hi"), true))
+	_, _, err = c.ReadMessage()
+	assert.Equal(t, CloseProtocolError, closeCode(err))
+}